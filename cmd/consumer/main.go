@@ -5,18 +5,20 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/handler"
 	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/nats"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
 	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
 )
 
 const (
-	defaultRedisAddr = "redis:6379"
-	defaultNatsURL   = "nats://nats:4222"
-	defaultDedupTTL  = 5 * time.Second
+	defaultRedisAddr       = "redis:6379"
+	defaultNatsURL         = "nats://nats:4222"
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 func main() {
@@ -28,22 +30,93 @@ func main() {
 	log.Printf("Starting consumer with ID: %s", consumerID)
 
 	// Create Redis client
-	redisClient, err := redis.NewClient(defaultRedisAddr)
+	// Credentials and TLS come from REDIS_* and NATS_* environment variables
+	redisClient, err := redis.NewClientWithOptions(redis.OptionsFromEnv(envOr("REDIS_ADDR", defaultRedisAddr)))
 	if err != nil {
 		log.Fatalf("Failed to create Redis client: %v", err)
 	}
 	defer redisClient.Close()
 
 	// Create NATS client
-	natsClient, err := nats.NewClient(defaultNatsURL)
+	natsClient, err := nats.NewClientWithOptions(nats.OptionsFromEnv(envOr("NATS_URL", defaultNatsURL)))
 	if err != nil {
 		log.Fatalf("Failed to create NATS client: %v", err)
 	}
 	defer natsClient.Close()
 
-	// Create context that can be cancelled
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Compose event handlers from config, falling back to log, metrics, ledger and latency
+	handlerConfig := handler.DefaultConfig()
+	if path := os.Getenv("HANDLERS_CONFIG"); path != "" {
+		handlerConfig, err = handler.LoadConfig(path)
+		if err != nil {
+			log.Fatalf("Failed to load handler config: %v", err)
+		}
+	}
+	// Metric increments are aggregated locally and flushed in batches
+	metrics := pipeline.NewMetricsAggregator(redisClient, 0, 0)
+	handlers, err := handlerConfig.Build(handler.WithMetrics(redisClient, metrics))
+	if err != nil {
+		log.Fatalf("Failed to build handlers: %v", err)
+	}
+	log.Printf("Registered %d event handlers", handlers.Len())
+
+	dedupTTL := pipeline.DefaultDedupTTL
+	if v := os.Getenv("DEDUP_TTL"); v != "" {
+		if dedupTTL, err = time.ParseDuration(v); err != nil || dedupTTL <= 0 {
+			log.Fatalf("Invalid DEDUP_TTL %q: want a positive duration such as 3s", v)
+		}
+	}
+
+	// Tenants isolate groups of keys by pattern; without a config every key shares one lane
+	var tenants []pipeline.Tenant
+	if path := os.Getenv("TENANTS_CONFIG"); path != "" {
+		tenantConfig, err := pipeline.LoadTenantConfig(path)
+		if err != nil {
+			log.Fatalf("Failed to load tenant config: %v", err)
+		}
+		if tenants, err = tenantConfig.Build(); err != nil {
+			log.Fatalf("Invalid tenant config: %v", err)
+		}
+		log.Printf("Configured %d tenants", len(tenants))
+	}
+
+	// Shaping policies throttle or debounce matching keys in place of the dedup window
+	var policies []pipeline.Policy
+	if path := os.Getenv("SHAPING_CONFIG"); path != "" {
+		shapingConfig, err := pipeline.LoadShapingConfig(path)
+		if err != nil {
+			log.Fatalf("Failed to load shaping config: %v", err)
+		}
+		if policies, err = shapingConfig.Build(); err != nil {
+			log.Fatalf("Invalid shaping config: %v", err)
+		}
+		log.Printf("Configured %d shaping policies", len(policies))
+	}
+
+	// Capturing values publishes the value writers keep in each key's shadow with its event
+	captureValues := false
+	if v := os.Getenv("CAPTURE_VALUES"); v != "" {
+		if captureValues, err = strconv.ParseBool(v); err != nil {
+			log.Fatalf("Invalid CAPTURE_VALUES %q: %v", v, err)
+		}
+	}
+
+	p, err := pipeline.New(pipeline.Options{
+		ConsumerID:    consumerID,
+		Redis:         redisClient,
+		Source:        eventSource(redisClient),
+		Bus:           natsClient,
+		Handlers:      handlers,
+		Latency:       redisClient,
+		DedupTTL:      dedupTTL,
+		Tenants:       tenants,
+		Policies:      policies,
+		Metrics:       metrics,
+		CaptureValues: captureValues,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create pipeline: %v", err)
+	}
 
 	// Handle shutdown gracefully
 	sigCh := make(chan os.Signal, 1)
@@ -52,84 +125,57 @@ func main() {
 	go func() {
 		sig := <-sigCh
 		log.Printf("Received signal %v, shutting down...", sig)
-		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+		defer cancel()
+		if err := p.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown did not complete: %v", err)
+		}
 	}()
 
-	// Subscribe to NATS stream for deduplicated events
-	if err := natsClient.SubscribeExpiredKeys(ctx, func(key string) {
-		log.Printf("Consumer %s processing deduplicated key: %s", consumerID, key)
-		// Increment consumer-specific metric
-		if err := redisClient.IncrementConsumerMetric(ctx, consumerID); err != nil {
-			log.Printf("Failed to increment consumer metric: %v", err)
-		}
-		// Increment consumed metric
-		if err := redisClient.IncrementConsumed(ctx); err != nil {
-			log.Printf("Failed to increment consumed metric: %v", err)
-		}
-	}); err != nil {
-		log.Fatalf("Failed to subscribe to NATS stream: %v", err)
+	// Run returns pipeline.ErrShutdownTimeout once Shutdown gives up on in-flight work, so a stuck
+	// shutdown still exits, with a non-zero status
+	if err := p.Run(context.Background()); err != nil {
+		log.Fatalf("Pipeline error: %v", err)
 	}
+}
 
-	// Process Redis expired keys with automatic reconnection
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			log.Printf("Subscribing to Redis key expiration events...")
-			// Subscribe to Redis key expiration events
-			psc := redisClient.Subscribe(ctx, "__keyevent@0__:expired")
-
-			// Process messages until error or context cancellation
-			for {
-				select {
-				case <-ctx.Done():
-					psc.Close()
-					return
-				default:
-					msg, err := psc.ReceiveMessage(ctx)
-					if err != nil {
-						log.Printf("Error receiving message: %v, will reconnect in 5 seconds", err)
-						psc.Close()
-						time.Sleep(5 * time.Second)
-						break
-					}
-
-					// Process the expired key
-					go handleRedisExpiredKey(ctx, msg.Payload, redisClient, natsClient, consumerID)
-				}
+// eventSource selects how expired keys arrive from EVENT_SOURCE: keyspace notifications, the
+// default, or "zset" to poll the deadline index, tuned by POLL_INTERVAL, POLL_BATCH and POLL_LEASE
+func eventSource(redisClient *redis.Client) pipeline.EventSource {
+	switch source := envOr("EVENT_SOURCE", "notifications"); source {
+	case "notifications":
+		return pipeline.NewNotificationSource(redisClient, 0)
+	case "zset":
+		var interval, lease time.Duration
+		var batch int
+		var err error
+		if v := os.Getenv("POLL_INTERVAL"); v != "" {
+			if interval, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid POLL_INTERVAL %q: %v", v, err)
+			}
+		}
+		if v := os.Getenv("POLL_BATCH"); v != "" {
+			if batch, err = strconv.Atoi(v); err != nil {
+				log.Fatalf("Invalid POLL_BATCH %q: %v", v, err)
+			}
+		}
+		if v := os.Getenv("POLL_LEASE"); v != "" {
+			if lease, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid POLL_LEASE %q: %v", v, err)
 			}
 		}
+		log.Printf("Polling %s for due keys", redis.DeadlineIndex)
+		return pipeline.NewPollingSource(redisClient, interval, batch, lease)
+	default:
+		log.Fatalf("Invalid EVENT_SOURCE %q: must be notifications or zset", source)
+		return nil
 	}
 }
 
-// handleRedisExpiredKey handles Redis key expiration events and publishes them to NATS
-func handleRedisExpiredKey(ctx context.Context, key string, redisClient *redis.Client, natsClient *nats.Client, consumerID string) {
-	log.Printf("Consumer %s received Redis expired key: %s", consumerID, key)
-
-	// Ignore dedup keys
-	if strings.HasPrefix(key, redis.DedupPrefix) {
-		log.Printf("Ignoring dedup key: %s", key)
-		return
-	}
-
-	// Try to create dedup key
-	ok, err := redisClient.CreateDedupKey(ctx, key, defaultDedupTTL)
-	if err != nil {
-		log.Printf("Failed to create dedup key for %s: %v", key, err)
-		return
-	}
-
-	// If dedup key already exists, ignore this event
-	if !ok {
-		log.Printf("Dedup key already exists for %s, ignoring", key)
-		return
-	}
-
-	// Publish expired key to NATS
-	if err := natsClient.PublishExpiredKey(ctx, key); err != nil {
-		log.Printf("Failed to publish key %s to NATS: %v", key, err)
-		return
+// envOr returns $name, or def if it is unset
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
-	log.Printf("Successfully published key %s to NATS", key)
+	return def
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/internal/auth"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+)
+
+// secureAPI wraps the /api/ routes of next with the authentication configured in $AUTH_CONFIG.
+// It also returns the TLS config to serve with when mTLS is enabled. Without $AUTH_CONFIG the API
+// stays open, for local development.
+func secureAPI(next http.Handler) (http.Handler, *tls.Config, error) {
+	path := os.Getenv("AUTH_CONFIG")
+	if path == "" {
+		log.Printf("AUTH_CONFIG is not set, the API is open to anyone who can reach it")
+		return next, nil, nil
+	}
+
+	cfg, err := auth.LoadConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	authn, err := cfg.Authenticator()
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := cfg.ServerTLS()
+	if err != nil {
+		return nil, nil, err
+	}
+	audit, err := auth.NewAuditLog(cfg.AuditLog, cfg.AuditReads)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	api := auth.Middleware(authn, audit, requiredRole, next)
+	// The UI's static files are public; it authenticates its own API calls
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			if queryTokenPaths[r.URL.Path] {
+				r = auth.AllowQueryToken(r)
+			}
+			api.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), tlsConfig, nil
+}
+
+// queryTokenPaths are the routes EventSource connects to. It cannot set an Authorization header,
+// so only these accept the token as a query parameter.
+var queryTokenPaths = map[string]bool{api.Prefix + "/stream": true}
+
+// requiredRole lets viewers read and requires operators for anything that changes state
+func requiredRole(r *http.Request) auth.Role {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return auth.RoleViewer
+	default:
+		return auth.RoleOperator
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// Exit codes for "generator run"
+const (
+	exitPass  = 0
+	exitFail  = 1 // a threshold failed
+	exitError = 2 // the run could not be carried out
+)
+
+// Thresholds gate a CLI run; negative values disable a check
+type Thresholds struct {
+	MaxLost       int64         `json:"max_lost"`
+	MaxDuplicates int64         `json:"max_duplicates"`
+	MaxP99        time.Duration `json:"max_p99"` // per latency stage, 0 disables
+}
+
+// RunSummary is the result of a CLI run
+type RunSummary struct {
+	RunID      string                          `json:"run_id"`
+	Status     string                          `json:"status"`
+	State      string                          `json:"state"`
+	Reason     string                          `json:"reason"` // why draining ended
+	Duration   string                          `json:"duration"`
+	Generated  int64                           `json:"generated"`
+	Consumed   int64                           `json:"consumed"`
+	Lost       int64                           `json:"lost"`
+	LossRatio  float64                         `json:"loss_ratio"`
+	Duplicates int64                           `json:"duplicates"`
+	Consumers  map[string]int64                `json:"consumers"`
+	Latency    map[string]redis.LatencySummary `json:"latency"`
+	Injection  *redis.InjectionReport          `json:"injection,omitempty"`
+	Failures   []string                        `json:"failures"`
+	Pass       bool                            `json:"pass"`
+}
+
+// jsonFlag sets a pointer field from a JSON flag value
+type jsonFlag struct{ target interface{} }
+
+func (f jsonFlag) String() string { return "" }
+
+func (f jsonFlag) Set(v string) error { return json.Unmarshal([]byte(v), f.target) }
+
+// runCLI implements "generator run": one headless test run gated on thresholds, writing its summary to stdout
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("generator run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	redisAddr := fs.String("redis", redisAddr(), "Redis address")
+	configFile := fs.String("config", "", "JSON file with the test config; flags override its values")
+	output := fs.String("output", "table", "summary format: table or json")
+
+	var flags TestConfig
+	fs.Int64Var(&flags.NumKeys, "num-keys", 1000, "number of keys to generate")
+	fs.Int64Var(&flags.KeyDelay, "key-delay", 10, "delay between keys in ms")
+	fs.Int64Var(&flags.KeyTTL, "key-ttl", 100, "key TTL in ms")
+	fs.Int64Var(&flags.DedupWindow, "dedup-window", pipeline.DefaultDedupTTL.Milliseconds(), "consumers' dedup window in ms")
+	fs.Int64Var(&flags.QuietPeriod, "quiet-period", 0, "stop draining after this many ms without consumption (default 5000)")
+	fs.Int64Var(&flags.DrainTimeout, "drain-timeout", 0, "give up draining after this many ms (default: longest key TTL + 1m)")
+	fs.IntVar(&flags.BatchSize, "batch-size", 0, "keys per pipelined write")
+	fs.IntVar(&flags.Workers, "workers", 0, "parallel writers")
+	fs.Var(jsonFlag{&flags.Profile}, "profile", "load profile as JSON")
+	fs.Var(jsonFlag{&flags.TTL}, "ttl-distribution", "TTL distribution as JSON")
+	fs.Var(jsonFlag{&flags.Duplicates}, "duplicates", "duplicate injection as JSON")
+	fs.StringVar(&flags.Tenant, "tenant", "", "prefix the run ID with a tenant name")
+
+	var thresholds Thresholds
+	fs.Int64Var(&thresholds.MaxLost, "max-lost", 0, "fail if more keys than this are never consumed (-1 disables)")
+	fs.Int64Var(&thresholds.MaxDuplicates, "max-duplicates", 0, "fail if there are more unexpected duplicate deliveries than this (-1 disables)")
+	fs.DurationVar(&thresholds.MaxP99, "max-p99", 0, "fail if any latency stage's p99 exceeds this (0 disables)")
+
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "invalid -output %q: want table or json\n", *output)
+		return exitError
+	}
+
+	config := flags
+	if *configFile != "" {
+		var err error
+		if config, err = loadTestConfig(*configFile, fs, flags); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	if err := config.prepare(); err != nil {
+		fmt.Fprintf(stderr, "invalid test config: %v\n", err)
+		return exitError
+	}
+
+	redisClient, err := redis.NewClientWithOptions(redis.OptionsFromEnv(*redisAddr))
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to create Redis client: %v\n", err)
+		return exitError
+	}
+	defer redisClient.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	summary, err := runHeadless(ctx, redisClient, config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	summary.check(thresholds)
+
+	if *output == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(summary)
+	} else {
+		summary.writeTable(stdout)
+	}
+	if !summary.Pass {
+		return exitFail
+	}
+	return exitPass
+}
+
+// loadTestConfig reads a JSON test config over the flag defaults and applies the flags that were set
+// explicitly. Unknown fields are rejected, so a misspelled field fails instead of being ignored.
+func loadTestConfig(path string, fs *flag.FlagSet, flags TestConfig) (TestConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TestConfig{}, fmt.Errorf("failed to read config: %w", err)
+	}
+	// Pointer fields are only set by explicit flags, which are applied below, so the file must not decode into them
+	config := flags
+	config.Profile, config.TTL, config.Duplicates = nil, nil, nil
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return TestConfig{}, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	// A replay profile's timeline length replaces the num-keys default unless the file sets num_keys
+	if config.Profile != nil && config.Profile.Type == pipeline.ProfileReplay {
+		var fields map[string]json.RawMessage
+		json.Unmarshal(data, &fields)
+		if _, ok := fields["num_keys"]; !ok {
+			config.NumKeys = 0
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "num-keys":
+			config.NumKeys = flags.NumKeys
+		case "key-delay":
+			config.KeyDelay = flags.KeyDelay
+		case "key-ttl":
+			config.KeyTTL = flags.KeyTTL
+		case "dedup-window":
+			config.DedupWindow = flags.DedupWindow
+		case "quiet-period":
+			config.QuietPeriod = flags.QuietPeriod
+		case "drain-timeout":
+			config.DrainTimeout = flags.DrainTimeout
+		case "batch-size":
+			config.BatchSize = flags.BatchSize
+		case "workers":
+			config.Workers = flags.Workers
+		case "profile":
+			config.Profile = flags.Profile
+		case "ttl-distribution":
+			config.TTL = flags.TTL
+		case "duplicates":
+			config.Duplicates = flags.Duplicates
+		case "tenant":
+			config.Tenant = flags.Tenant
+		}
+	})
+	return config, nil
+}
+
+// runHeadless generates a run, waits for it to settle and collects its summary
+func runHeadless(ctx context.Context, redisClient *redis.Client, config TestConfig) (*RunSummary, error) {
+	run, err := createRun(ctx, redisClient, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start run: %w", err)
+	}
+	log.Printf("Run %s started", run.ID)
+
+	generated, err := pipeline.NewGenerator(redisClient).Run(ctx, config.generatorConfig(run.ID))
+	if err != nil {
+		return nil, err
+	}
+	expectGenerated(redisClient, run.ID, config.NumKeys, generated)
+
+	endedAt := time.Now().UTC()
+	run.EndedAt = &endedAt
+	run.Status = redis.RunCompleted
+	if generated < config.NumKeys {
+		run.Status = redis.RunStopped
+	}
+
+	run.State = redis.RunDraining
+	if err := redisClient.SaveRun(ctx, run); err != nil {
+		log.Printf("Failed to save run %s: %v", run.ID, err)
+	}
+
+	// Keep draining through a stop so the summary reflects what was generated
+	waitCtx := context.WithoutCancel(ctx)
+	run.State, run.Outcome = drain(waitCtx, redisClient, run.ID, config.drainOptions(endedAt))
+
+	summary, err := summarize(waitCtx, redisClient, run)
+	if err != nil {
+		return nil, err
+	}
+	summary.Duration = time.Since(run.StartedAt).Round(time.Millisecond).String()
+
+	run.Metrics = &redis.RunMetrics{Generated: summary.Generated, Consumed: summary.Consumed, Consumers: summary.Consumers}
+	if err := redisClient.SaveRun(waitCtx, run); err != nil {
+		log.Printf("Failed to save run %s: %v", run.ID, err)
+	}
+	return summary, nil
+}
+
+func summarize(ctx context.Context, redisClient *redis.Client, run *redis.RunRecord) (*RunSummary, error) {
+	generated, consumed, err := redisClient.GetMetrics(ctx, run.ID)
+	if err != nil {
+		return nil, err
+	}
+	consumers, err := redisClient.GetConsumerMetrics(ctx, run.ID)
+	if err != nil {
+		return nil, err
+	}
+	latency, err := redisClient.GetLatency(ctx, run.ID)
+	if err != nil {
+		return nil, err
+	}
+	v, err := redisClient.VerifyRun(ctx, run.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RunSummary{
+		RunID:      run.ID,
+		Status:     run.Status,
+		State:      run.State,
+		Reason:     run.Outcome.Reason,
+		Generated:  generated,
+		Consumed:   consumed,
+		Lost:       v.MissingCount,
+		Duplicates: v.DuplicateDeliveries,
+		Consumers:  consumers,
+		Latency:    latency,
+		Injection:  v.Injection,
+		Failures:   []string{},
+	}
+	if v.Expected > 0 {
+		s.LossRatio = float64(s.Lost) / float64(v.Expected)
+	}
+	if v.Injection != nil && len(v.Injection.NotRedelivered) > 0 {
+		s.Failures = append(s.Failures, fmt.Sprintf("%d out-of-window duplicates were not delivered again", len(v.Injection.NotRedelivered)))
+	}
+	return s, nil
+}
+
+// check evaluates the thresholds and sets Pass
+func (s *RunSummary) check(t Thresholds) {
+	if s.State != redis.RunSettled {
+		s.Failures = append(s.Failures, "consumption did not settle before the drain timeout")
+	}
+	if t.MaxLost >= 0 && s.Lost > t.MaxLost {
+		s.Failures = append(s.Failures, fmt.Sprintf("lost %d keys, max %d", s.Lost, t.MaxLost))
+	}
+	if t.MaxDuplicates >= 0 && s.Duplicates > t.MaxDuplicates {
+		s.Failures = append(s.Failures, fmt.Sprintf("%d duplicate deliveries, max %d", s.Duplicates, t.MaxDuplicates))
+	}
+	if t.MaxP99 > 0 {
+		maxMs := float64(t.MaxP99) / float64(time.Millisecond)
+		for _, stage := range sortedKeys(s.Latency) {
+			if p99 := s.Latency[stage].P99Ms; p99 > maxMs {
+				s.Failures = append(s.Failures, fmt.Sprintf("%s p99 %.1fms, max %.1fms", stage, p99, maxMs))
+			}
+		}
+	}
+	s.Pass = len(s.Failures) == 0
+}
+
+func (s *RunSummary) writeTable(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Run\t%s\n", s.RunID)
+	fmt.Fprintf(w, "Status\t%s, %s (%s) after %s\n", s.Status, s.State, s.Reason, s.Duration)
+	fmt.Fprintf(w, "Generated\t%d\n", s.Generated)
+	fmt.Fprintf(w, "Consumed\t%d\n", s.Consumed)
+	fmt.Fprintf(w, "Lost\t%d (%.2f%%)\n", s.Lost, 100*s.LossRatio)
+	fmt.Fprintf(w, "Duplicates\t%d\n", s.Duplicates)
+	if s.Injection != nil {
+		fmt.Fprintf(w, "Injected\t%d (suppressed %d/%d within, redelivered %d/%d outside, %d boundary)\n",
+			s.Injection.Injected, s.Injection.Suppressed, s.Injection.Within,
+			s.Injection.Redelivered, s.Injection.Outside, s.Injection.Boundary)
+	}
+	w.Flush()
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Consumer\tEvents")
+	for _, id := range sortedKeys(s.Consumers) {
+		fmt.Fprintf(w, "%s\t%d\n", id, s.Consumers[id])
+	}
+	w.Flush()
+
+	if len(s.Latency) > 0 {
+		fmt.Fprintln(out)
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "Stage\tCount\tp50 ms\tp95 ms\tp99 ms\tMax ms\t")
+		for _, stage := range sortedKeys(s.Latency) {
+			l := s.Latency[stage]
+			fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t\n", stage, l.Count, l.P50Ms, l.P95Ms, l.P99Ms, l.MaxMs)
+		}
+		w.Flush()
+	}
+
+	fmt.Fprintln(out)
+	if s.Pass {
+		fmt.Fprintln(out, "PASS")
+		return
+	}
+	fmt.Fprintln(out, "FAIL")
+	for _, f := range s.Failures {
+		fmt.Fprintf(out, "  - %s\n", f)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// writeConfig writes a JSON test config file and returns its path
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunCLIInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"unknown flag", []string{"-keys", "10"}, "flag provided but not defined: -keys"},
+		{"output format", []string{"-output", "yaml"}, `invalid -output "yaml"`},
+		{"malformed JSON flag", []string{"-profile", "{"}, `invalid value "{" for flag -profile`},
+		{"missing config file", []string{"-config", filepath.Join(t.TempDir(), "none.json")}, "failed to read config"},
+		{"malformed config file", []string{"-config", writeConfig(t, "{")}, "failed to parse config"},
+		{"misspelled config field", []string{"-config", writeConfig(t, `{"numkeys": 10}`)}, `unknown field "numkeys"`},
+		{"no keys", []string{"-num-keys", "0"}, "num_keys: must be positive"},
+		{"no keys in the config file", []string{"-config", writeConfig(t, `{"num_keys": 0}`)}, "num_keys: must be positive"},
+		{"no key TTL", []string{"-key-ttl", "0"}, "key_ttl: must be positive unless ttl_distribution is set"},
+		{"negative value", []string{"-key-delay", "-1"}, "key_delay: must not be negative"},
+		{"invalid profile", []string{"-profile", `{"type": "burst"}`}, "invalid test config: profile"},
+		{"invalid tenant", []string{"-tenant", "a b"}, "tenant: must be 1-64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCLI(tt.args, &stdout, &stderr); code != exitError {
+				t.Errorf("exit code %d, want %d", code, exitError)
+			}
+			if !strings.Contains(stderr.String(), tt.wantErr) {
+				t.Errorf("stderr %q, want it to contain %q", stderr.String(), tt.wantErr)
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("summary written for an invalid run: %s", stdout.String())
+			}
+		})
+	}
+}
+
+// Headless runs against miniredis with no consumers, so every key is lost once the quiet period ends
+func TestRunCLI(t *testing.T) {
+	mr := miniredis.RunT(t)
+	base := []string{"-redis", mr.Addr(), "-key-delay", "0", "-key-ttl", "1", "-quiet-period", "1", "-output", "json"}
+
+	tests := []struct {
+		name          string
+		args          []string
+		wantCode      int
+		wantGenerated int64
+		wantFailures  []string
+		wantTenant    bool
+	}{
+		{
+			name:          "lost keys fail the default threshold",
+			args:          []string{"-num-keys", "3"},
+			wantCode:      exitFail,
+			wantGenerated: 3,
+			wantFailures:  []string{"lost 3 keys, max 0"},
+		},
+		{
+			name:          "threshold disabled",
+			args:          []string{"-num-keys", "3", "-max-lost", "-1"},
+			wantCode:      exitPass,
+			wantGenerated: 3,
+			wantFailures:  []string{},
+		},
+		{
+			name:          "config file",
+			args:          []string{"-config", writeConfig(t, `{"num_keys": 5, "key_delay": 0, "key_ttl": 1, "quiet_period": 1, "tenant": "team-a"}`), "-max-lost", "5"},
+			wantCode:      exitPass,
+			wantGenerated: 5,
+			wantFailures:  []string{},
+			wantTenant:    true,
+		},
+		{
+			name:          "flags override the config file",
+			args:          []string{"-config", writeConfig(t, `{"num_keys": 5, "tenant": "team-a"}`), "-num-keys", "2", "-max-lost", "1"},
+			wantCode:      exitFail,
+			wantGenerated: 2,
+			wantFailures:  []string{"lost 2 keys, max 1"},
+			wantTenant:    true,
+		},
+		{
+			name:          "tenant flag",
+			args:          []string{"-num-keys", "1", "-tenant", "team-a", "-max-lost", "-1"},
+			wantCode:      exitPass,
+			wantGenerated: 1,
+			wantFailures:  []string{},
+			wantTenant:    true,
+		},
+		{
+			name:          "fields left out of the config file keep the flag defaults",
+			args:          []string{"-config", writeConfig(t, `{"key_ttl": 1}`), "-max-lost", "-1"},
+			wantCode:      exitPass,
+			wantGenerated: 1000,
+			wantFailures:  []string{},
+		},
+		{
+			name:          "replay timeline sets the key count",
+			args:          []string{"-config", writeConfig(t, `{"profile": {"type": "replay", "timeline": "0,3\n5,2"}}`), "-max-lost", "-1"},
+			wantCode:      exitPass,
+			wantGenerated: 5,
+			wantFailures:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runCLI(append(append([]string{}, base...), tt.args...), &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("exit code %d, want %d (stderr %s)", code, tt.wantCode, stderr.String())
+			}
+			var summary RunSummary
+			if err := json.Unmarshal(stdout.Bytes(), &summary); err != nil {
+				t.Fatalf("failed to decode summary %q: %v", stdout.String(), err)
+			}
+			if summary.Generated != tt.wantGenerated || summary.Lost != tt.wantGenerated || summary.Consumed != 0 {
+				t.Errorf("summary %+v, want %d keys generated and lost", summary, tt.wantGenerated)
+			}
+			if summary.State != redis.RunSettled || summary.Reason != redis.SettledQuiet || summary.Status != redis.RunCompleted {
+				t.Errorf("run %s, %s (%s), want completed and settled after the quiet period", summary.Status, summary.State, summary.Reason)
+			}
+			if !reflect.DeepEqual(summary.Failures, tt.wantFailures) || summary.Pass != (tt.wantCode == exitPass) {
+				t.Errorf("failures %q, pass %v; want %q", summary.Failures, summary.Pass, tt.wantFailures)
+			}
+			if strings.HasPrefix(summary.RunID, "team-a-") != tt.wantTenant {
+				t.Errorf("run ID %q, tenant prefix wanted: %v", summary.RunID, tt.wantTenant)
+			}
+		})
+	}
+}
+
+func TestRunSummaryCheck(t *testing.T) {
+	latency := map[string]redis.LatencySummary{
+		"notify":  {Count: 10, P99Ms: 80},
+		"process": {Count: 10, P99Ms: 120},
+	}
+	tests := []struct {
+		name       string
+		summary    RunSummary
+		thresholds Thresholds
+		want       []string
+	}{
+		{
+			name:       "within every threshold",
+			summary:    RunSummary{State: redis.RunSettled, Lost: 1, Duplicates: 2, Latency: latency},
+			thresholds: Thresholds{MaxLost: 1, MaxDuplicates: 2, MaxP99: 120 * time.Millisecond},
+		},
+		{
+			name:       "every threshold exceeded",
+			summary:    RunSummary{State: redis.RunSettled, Lost: 2, Duplicates: 3, Latency: latency},
+			thresholds: Thresholds{MaxLost: 1, MaxDuplicates: 2, MaxP99: 100 * time.Millisecond},
+			want:       []string{"lost 2 keys, max 1", "3 duplicate deliveries, max 2", "process p99 120.0ms, max 100.0ms"},
+		},
+		{
+			name:       "checks disabled",
+			summary:    RunSummary{State: redis.RunSettled, Lost: 2, Duplicates: 3, Latency: latency},
+			thresholds: Thresholds{MaxLost: -1, MaxDuplicates: -1},
+		},
+		{
+			name:       "timed out",
+			summary:    RunSummary{State: redis.RunTimedOut},
+			thresholds: Thresholds{MaxLost: -1, MaxDuplicates: -1},
+			want:       []string{"consumption did not settle before the drain timeout"},
+		},
+		{
+			name:       "failures found while summarizing are kept",
+			summary:    RunSummary{State: redis.RunSettled, Failures: []string{"1 out-of-window duplicates were not delivered again"}},
+			thresholds: Thresholds{},
+			want:       []string{"1 out-of-window duplicates were not delivered again"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.summary
+			s.check(tt.thresholds)
+			if len(s.Failures) != len(tt.want) || (len(tt.want) > 0 && !reflect.DeepEqual(s.Failures, tt.want)) {
+				t.Errorf("failures %q, want %q", s.Failures, tt.want)
+			}
+			if s.Pass != (len(tt.want) == 0) {
+				t.Errorf("pass %v with failures %q", s.Pass, s.Failures)
+			}
+		})
+	}
+}
+
+func TestRunSummaryTable(t *testing.T) {
+	s := &RunSummary{
+		RunID:     "run-1",
+		Status:    redis.RunCompleted,
+		State:     redis.RunSettled,
+		Reason:    redis.SettledQuiet,
+		Duration:  "1.5s",
+		Generated: 10,
+		Consumed:  9,
+		Lost:      1,
+		LossRatio: 0.1,
+		Consumers: map[string]int64{"consumer-2": 4, "consumer-1": 5},
+		Latency:   map[string]redis.LatencySummary{"notify": {Count: 9, P50Ms: 1, P95Ms: 2, P99Ms: 3, MaxMs: 4}},
+		Injection: &redis.InjectionReport{Injected: 4, Within: 2, Suppressed: 2, Outside: 2, Redelivered: 1},
+		Failures:  []string{"lost 1 keys, max 0"},
+	}
+	var out bytes.Buffer
+	s.writeTable(&out)
+	got := out.String()
+	for _, want := range []string{
+		"Run         run-1\n",
+		"Status      completed, settled (quiet_period) after 1.5s\n",
+		"Lost        1 (10.00%)\n",
+		"Injected    4 (suppressed 2/2 within, redelivered 1/2 outside, 0 boundary)\n",
+		"Consumer    Events\nconsumer-1  5\nconsumer-2  4\n",
+		"notify",
+		"FAIL\n  - lost 1 keys, max 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("table does not contain %q:\n%s", want, got)
+		}
+	}
+
+	s.Failures, s.Pass, s.Injection, s.Latency = nil, true, nil, nil
+	out.Reset()
+	s.writeTable(&out)
+	got = out.String()
+	if !strings.HasSuffix(got, "\nPASS\n") || strings.Contains(got, "Injected") || strings.Contains(got, "Stage") {
+		t.Errorf("passing table without injection or latency:\n%s", got)
+	}
+}
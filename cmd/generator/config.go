@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+type TestConfig struct {
+	NumKeys     int64 `json:"num_keys"`     // 0 with a replay profile uses the timeline length
+	KeyDelay    int64 `json:"key_delay"`    // milliseconds, ignored when a profile is set
+	KeyTTL      int64 `json:"key_ttl"`      // milliseconds, ignored when a TTL distribution is set
+	DedupWindow int64 `json:"dedup_window"` // milliseconds
+
+	// Draining ends once consumption makes no progress for QuietPeriod, or after DrainTimeout
+	QuietPeriod  int64 `json:"quiet_period,omitempty"`  // milliseconds, default 5s
+	DrainTimeout int64 `json:"drain_timeout,omitempty"` // milliseconds, default the longest key TTL + 1m
+
+	Profile    *pipeline.LoadProfile     `json:"profile,omitempty"`
+	TTL        *pipeline.TTLDistribution `json:"ttl_distribution,omitempty"`
+	Duplicates *pipeline.DuplicateConfig `json:"duplicates,omitempty"` // window defaults to DedupWindow
+	BatchSize  int                       `json:"batch_size,omitempty"` // keys per pipelined write
+	Workers    int                       `json:"workers,omitempty"`    // parallel writers
+
+	// Tenant prefixes the run ID, so keys can be matched by tenant pattern as gen-key:<tenant>-*
+	Tenant string `json:"tenant,omitempty"`
+	// Shadow records each key's value in a shadow key, for consumers that capture values
+	Shadow bool `json:"shadow,omitempty"`
+	// Index adds each key to the deadline index, for consumers polling it in place of notifications
+	Index bool `json:"index,omitempty"`
+}
+
+// Limits on TestConfig values, so a typo cannot start a run that never ends or floods Redis
+const (
+	maxNumKeys    = 100_000_000
+	maxDurationMs = int64(24 * time.Hour / time.Millisecond)
+	maxKeyDelayMs = int64(time.Hour / time.Millisecond)
+	maxBatchSize  = 10_000
+	maxWorkers    = 256
+)
+
+// configError lists every invalid field of a TestConfig
+type configError []api.FieldError
+
+func (e configError) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// prepare validates the config and fills in values derived from other fields.
+// Validation failures are returned as a configError.
+func (c *TestConfig) prepare() error {
+	var errs configError
+	check := func(field string, v, max int64) {
+		switch {
+		case v < 0:
+			errs = append(errs, api.FieldError{Field: field, Message: "must not be negative"})
+		case v > max:
+			errs = append(errs, api.FieldError{Field: field, Message: fmt.Sprintf("must be at most %d", max)})
+		}
+	}
+	check("num_keys", c.NumKeys, maxNumKeys)
+	check("key_delay", c.KeyDelay, maxKeyDelayMs)
+	check("key_ttl", c.KeyTTL, maxDurationMs)
+	check("dedup_window", c.DedupWindow, maxDurationMs)
+	check("quiet_period", c.QuietPeriod, maxDurationMs)
+	check("drain_timeout", c.DrainTimeout, maxDurationMs)
+	check("batch_size", int64(c.BatchSize), maxBatchSize)
+	check("workers", int64(c.Workers), maxWorkers)
+	if c.Tenant != "" && !pipeline.ValidTenantName(c.Tenant) {
+		errs = append(errs, api.FieldError{Field: "tenant", Message: "must be 1-64 letters, digits, '-' or '_'"})
+	}
+
+	if c.Profile != nil {
+		if err := c.Profile.Validate(); err != nil {
+			errs = append(errs, api.FieldError{Field: "profile", Message: err.Error()})
+		} else if c.NumKeys == 0 {
+			c.NumKeys, _ = c.Profile.KeyCount()
+			check("num_keys", c.NumKeys, maxNumKeys)
+		}
+	}
+	if c.NumKeys == 0 {
+		errs = append(errs, api.FieldError{Field: "num_keys", Message: "must be positive unless a replay profile sets it"})
+	}
+	if c.TTL != nil {
+		if err := c.TTL.Validate(); err != nil {
+			errs = append(errs, api.FieldError{Field: "ttl_distribution", Message: err.Error()})
+		}
+	} else if c.KeyTTL == 0 {
+		errs = append(errs, api.FieldError{Field: "key_ttl", Message: "must be positive unless ttl_distribution is set"})
+	}
+	if c.DedupWindow == 0 {
+		c.DedupWindow = pipeline.DefaultDedupTTL.Milliseconds()
+	}
+	if c.Duplicates != nil {
+		if c.Duplicates.Window == 0 {
+			c.Duplicates.Window = c.DedupWindow
+		}
+		if err := c.Duplicates.Validate(); err != nil {
+			errs = append(errs, api.FieldError{Field: "duplicates", Message: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *TestConfig) generatorConfig(runID string) pipeline.GeneratorConfig {
+	return pipeline.GeneratorConfig{
+		RunID:      runID,
+		NumKeys:    c.NumKeys,
+		KeyDelay:   time.Duration(c.KeyDelay) * time.Millisecond,
+		KeyTTL:     time.Duration(c.KeyTTL) * time.Millisecond,
+		Profile:    c.Profile,
+		TTL:        c.TTL,
+		Duplicates: c.Duplicates,
+		Shadow:     c.Shadow,
+		Index:      c.Index,
+		BatchSize:  c.BatchSize,
+		Workers:    c.Workers,
+	}
+}
+
+// maxTTL bounds how long after generation ends the run's last key can expire
+func (c *TestConfig) maxTTL() time.Duration {
+	maxTTL := time.Duration(c.KeyTTL) * time.Millisecond
+	if c.TTL != nil {
+		maxTTL = c.TTL.MaxTTL(c.NumKeys)
+	}
+	if c.Duplicates != nil {
+		maxTTL += c.Duplicates.MaxGap()
+	}
+	return maxTTL
+}
+
+// createRun initializes the ledger and run record for a new run
+func createRun(ctx context.Context, redisClient *redis.Client, config TestConfig) (*redis.RunRecord, error) {
+	runID, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+	if config.Tenant != "" {
+		runID = config.Tenant + "-" + runID
+	}
+	profileType := pipeline.ProfileConstant
+	if config.Profile != nil {
+		profileType = config.Profile.Type
+	}
+	log.Printf("Starting run %s with config: NumKeys=%d, KeyDelay=%dms, KeyTTL=%dms, DedupWindow=%dms, Profile=%s",
+		runID, config.NumKeys, config.KeyDelay, config.KeyTTL, config.DedupWindow, profileType)
+
+	// Every run has its own key, metrics and ledger namespace, so nothing is reset here
+	if err := redisClient.InitRunLedger(ctx, runID, config.NumKeys); err != nil {
+		return nil, err
+	}
+
+	configJSON, _ := json.Marshal(config)
+	run := &redis.RunRecord{
+		ID:        runID,
+		Status:    redis.RunRunning,
+		State:     redis.RunGenerating,
+		Config:    configJSON,
+		StartedAt: time.Now().UTC(),
+	}
+	if err := redisClient.SaveRun(ctx, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// expectGenerated lowers a stopped run's expected count to the keys it actually generated
+func expectGenerated(redisClient *redis.Client, runID string, numKeys, generated int64) {
+	if generated >= numKeys {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRedisTimeout)
+	defer cancel()
+	if err := redisClient.SetRunExpected(ctx, runID, generated); err != nil {
+		log.Printf("Failed to update expected count for run %s: %v", runID, err)
+	}
+}
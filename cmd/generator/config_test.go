@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+)
+
+func TestPrepare(t *testing.T) {
+	replay := &pipeline.LoadProfile{Type: pipeline.ProfileReplay, Timeline: "0,3\n5,2"}
+	uniform := &pipeline.TTLDistribution{Type: pipeline.TTLUniform, Min: 10, Max: 20}
+
+	tests := []struct {
+		name       string
+		config     TestConfig
+		wantFields []string // fields reported invalid, in order
+		want       TestConfig
+	}{
+		{
+			name:   "dedup window defaults",
+			config: TestConfig{NumKeys: 10, KeyTTL: 100},
+			want:   TestConfig{NumKeys: 10, KeyTTL: 100, DedupWindow: pipeline.DefaultDedupTTL.Milliseconds()},
+		},
+		{
+			name:   "replay timeline sets num_keys",
+			config: TestConfig{KeyTTL: 100, DedupWindow: 500, Profile: replay},
+			want:   TestConfig{NumKeys: 5, KeyTTL: 100, DedupWindow: 500, Profile: replay},
+		},
+		{
+			name:   "explicit num_keys wins over the timeline",
+			config: TestConfig{NumKeys: 2, KeyTTL: 100, DedupWindow: 500, Profile: replay},
+			want:   TestConfig{NumKeys: 2, KeyTTL: 100, DedupWindow: 500, Profile: replay},
+		},
+		{
+			name:   "ttl distribution replaces key_ttl",
+			config: TestConfig{NumKeys: 10, DedupWindow: 500, TTL: uniform},
+			want:   TestConfig{NumKeys: 10, DedupWindow: 500, TTL: uniform},
+		},
+		{
+			name:   "duplicate window defaults to the dedup window",
+			config: TestConfig{NumKeys: 10, KeyTTL: 100, DedupWindow: 500, Duplicates: &pipeline.DuplicateConfig{Probability: 0.5, MinDelay: 10}},
+			want:   TestConfig{NumKeys: 10, KeyTTL: 100, DedupWindow: 500, Duplicates: &pipeline.DuplicateConfig{Probability: 0.5, MinDelay: 10, Window: 500}},
+		},
+		{
+			name:   "tenant",
+			config: TestConfig{NumKeys: 10, KeyTTL: 100, DedupWindow: 500, Tenant: "team_a-1"},
+			want:   TestConfig{NumKeys: 10, KeyTTL: 100, DedupWindow: 500, Tenant: "team_a-1"},
+		},
+		{
+			name:       "invalid tenant",
+			config:     TestConfig{NumKeys: 10, KeyTTL: 100, Tenant: "team a"},
+			wantFields: []string{"tenant"},
+		},
+		{
+			name:       "no keys",
+			config:     TestConfig{KeyTTL: 100},
+			wantFields: []string{"num_keys"},
+		},
+		{
+			name:       "no key TTL",
+			config:     TestConfig{NumKeys: 10},
+			wantFields: []string{"key_ttl"},
+		},
+		{
+			name:       "negative values",
+			config:     TestConfig{NumKeys: -1, KeyDelay: -1, KeyTTL: -1, QuietPeriod: -1},
+			wantFields: []string{"num_keys", "key_delay", "key_ttl", "quiet_period"},
+		},
+		{
+			name:       "above the limits",
+			config:     TestConfig{NumKeys: maxNumKeys + 1, KeyTTL: maxDurationMs + 1, BatchSize: maxBatchSize + 1, Workers: maxWorkers + 1},
+			wantFields: []string{"num_keys", "key_ttl", "batch_size", "workers"},
+		},
+		{
+			name:       "invalid nested configs",
+			config:     TestConfig{NumKeys: 10, Profile: &pipeline.LoadProfile{Type: "wave"}, TTL: &pipeline.TTLDistribution{Type: pipeline.TTLUniform}, Duplicates: &pipeline.DuplicateConfig{Probability: 2, MinDelay: 10}},
+			wantFields: []string{"profile", "ttl_distribution", "duplicates"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			err := config.prepare()
+			if tt.wantFields == nil {
+				if err != nil {
+					t.Fatalf("prepare() = %v", err)
+				}
+				if !reflect.DeepEqual(config, tt.want) {
+					t.Errorf("prepared %+v, want %+v", config, tt.want)
+				}
+				return
+			}
+			var errs configError
+			if !errors.As(err, &errs) {
+				t.Fatalf("prepare() = %v, want a configError", err)
+			}
+			fields := make([]string, len(errs))
+			for i, f := range errs {
+				fields[i] = f.Field
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("invalid fields %q, want %q (%v)", fields, tt.wantFields, err)
+			}
+			for _, f := range errs {
+				if f == (api.FieldError{Field: f.Field}) {
+					t.Errorf("field %s has no message", f.Field)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+)
+
+// consumerStaleAfter is how long a consumer may miss heartbeats before it is shown as stale
+const consumerStaleAfter = 3 * pipeline.DefaultHeartbeatInterval
+
+// handleConsumers lists registered consumers on GET and removes the stale ones on DELETE
+func (s *server) handleConsumers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		consumers, err := s.redis.ListConsumers(ctx, consumerStaleAfter)
+		if err != nil {
+			api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to list consumers: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(consumers)
+	case http.MethodDelete:
+		removed, err := s.redis.PruneConsumers(ctx, consumerStaleAfter)
+		if err != nil {
+			api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to prune consumers: %v", err))
+			return
+		}
+		if removed == nil {
+			removed = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"removed": removed})
+	default:
+		api.MethodNotAllowed(w)
+	}
+}
+
+// handleConsumer removes one consumer from the registry
+func (s *server) handleConsumer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		api.MethodNotAllowed(w)
+		return
+	}
+	id := r.PathValue("id")
+	removed, err := s.redis.RemoveConsumer(r.Context(), id)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to remove consumer: %v", err))
+		return
+	}
+	if !removed {
+		api.WriteError(w, http.StatusNotFound, api.CodeNotFound, "Consumer not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// liveConsumers returns the IDs of consumers with a recent heartbeat
+func (s *server) liveConsumers(ctx context.Context) (map[string]bool, error) {
+	consumers, err := s.redis.ListConsumers(ctx, consumerStaleAfter)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(consumers))
+	for _, c := range consumers {
+		if !c.Stale {
+			live[c.ID] = true
+		}
+	}
+	return live, nil
+}
+
+// staleConsumers returns the consumers of a run's distribution that are stale or no longer registered
+func staleConsumers(consumers map[string]int64, live map[string]bool) []string {
+	stale := []string{}
+	for id := range consumers {
+		if !live[id] {
+			stale = append(stale, id)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	defaultJobListLimit = 100
+	maxJobListLimit     = 1000
+	maxJobDelay         = 365 * 24 * time.Hour
+	maxJobRequestBytes  = 1 << 20
+)
+
+// JobTime is when a job fires: at a time, or after a delay in milliseconds
+type JobTime struct {
+	At      *time.Time `json:"at,omitempty"`
+	DelayMs int64      `json:"delay_ms,omitempty"`
+}
+
+// ScheduleRequest schedules a job through POST /api/v1/jobs; an empty ID is generated
+type ScheduleRequest struct {
+	ID      string `json:"id,omitempty"`
+	Payload string `json:"payload"`
+	JobTime
+}
+
+// due resolves the time a job fires, relative to now for a delay
+func (t JobTime) due(now time.Time) (time.Time, error) {
+	var at time.Time
+	switch {
+	case t.At != nil && t.DelayMs != 0:
+		return time.Time{}, errors.New("set either at or delay_ms, not both")
+	case t.At != nil:
+		at = *t.At
+	case t.DelayMs > maxJobDelay.Milliseconds():
+		return time.Time{}, fmt.Errorf("jobs can be scheduled at most %v ahead", maxJobDelay)
+	case t.DelayMs > 0:
+		at = now.Add(time.Duration(t.DelayMs) * time.Millisecond)
+	default:
+		return time.Time{}, errors.New("at or a positive delay_ms is required")
+	}
+	if at.Sub(now) > maxJobDelay {
+		return time.Time{}, fmt.Errorf("jobs can be scheduled at most %v ahead", maxJobDelay)
+	}
+	return at, nil
+}
+
+// handleJobs schedules a job on POST and lists scheduled jobs on GET
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listJobs(w, r)
+	case http.MethodPost:
+		s.scheduleJob(w, r)
+	default:
+		api.MethodNotAllowed(w)
+	}
+}
+
+func (s *server) scheduleJob(w http.ResponseWriter, r *http.Request) {
+	var req ScheduleRequest
+	if !decodeJobRequest(w, r, &req) {
+		return
+	}
+	if req.ID == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to generate job ID: %v", err))
+			return
+		}
+		req.ID = hex.EncodeToString(b)
+	}
+	if !redis.ValidJobID(req.ID) {
+		api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, "Job ID must be 1-128 letters, digits, '.', '_', ':' or '-'")
+		return
+	}
+	at, err := req.due(time.Now())
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid job time: %v", err))
+		return
+	}
+
+	if err := s.scheduler.Schedule(r.Context(), req.ID, req.Payload, at); err != nil {
+		writeJobError(w, "schedule", req.ID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(redis.Job{ID: req.ID, At: at.UTC(), Payload: req.Payload})
+}
+
+func (s *server) listJobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid %s: must be an RFC 3339 time", name))
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := int64(defaultJobListLimit)
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > maxJobListLimit {
+			api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid limit: must be 1-%d", maxJobListLimit))
+			return
+		}
+		limit = n
+	}
+
+	jobs, err := s.scheduler.List(r.Context(), from, to, limit)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to list jobs: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// handleJob reschedules a job on PATCH and cancels it on DELETE
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodPatch:
+		var req JobTime
+		if !decodeJobRequest(w, r, &req) {
+			return
+		}
+		at, err := req.due(time.Now())
+		if err != nil {
+			api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid job time: %v", err))
+			return
+		}
+		if err := s.scheduler.Reschedule(r.Context(), id, at); err != nil {
+			writeJobError(w, "reschedule", id, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		cancelled, err := s.scheduler.Cancel(r.Context(), id)
+		if err != nil {
+			api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to cancel job: %v", err))
+			return
+		}
+		if !cancelled {
+			api.WriteError(w, http.StatusNotFound, api.CodeNotFound, "Job not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		api.MethodNotAllowed(w)
+	}
+}
+
+// decodeJobRequest decodes a JSON job request body into v, writing the error if it is invalid
+func decodeJobRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJobRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeJobError maps the error of a scheduler operation such as "schedule" to its API error
+func writeJobError(w http.ResponseWriter, op, id string, err error) {
+	switch {
+	case errors.Is(err, redis.ErrJobExists):
+		api.WriteError(w, http.StatusConflict, api.CodeConflict, fmt.Sprintf("Job %s is already scheduled", id))
+	case errors.Is(err, redis.ErrJobNotFound):
+		api.WriteError(w, http.StatusNotFound, api.CodeNotFound, "Job not found")
+	case errors.Is(err, redis.ErrJobInPast):
+		api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, "Job must be scheduled in the future")
+	default:
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to %s job: %v", op, err))
+	}
+}
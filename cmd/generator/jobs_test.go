@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+func TestWriteJobError(t *testing.T) {
+	tests := []struct {
+		name       string
+		op         string
+		err        error
+		wantStatus int
+		want       api.Error
+	}{
+		{"exists", "schedule", fmt.Errorf("wrapped: %w", redis.ErrJobExists), http.StatusConflict, api.Error{Code: api.CodeConflict, Message: "Job invoice-1 is already scheduled"}},
+		{"not found", "reschedule", redis.ErrJobNotFound, http.StatusNotFound, api.Error{Code: api.CodeNotFound, Message: "Job not found"}},
+		{"in the past", "reschedule", redis.ErrJobInPast, http.StatusBadRequest, api.Error{Code: api.CodeBadRequest, Message: "Job must be scheduled in the future"}},
+		{"schedule failed", "schedule", errors.New("connection refused"), http.StatusInternalServerError, api.Error{Code: api.CodeInternal, Message: "Failed to schedule job: connection refused"}},
+		{"reschedule failed", "reschedule", errors.New("connection refused"), http.StatusInternalServerError, api.Error{Code: api.CodeInternal, Message: "Failed to reschedule job: connection refused"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeJobError(w, tt.op, "invoice-1", tt.err)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			var got api.Error
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("failed to decode %q: %v", w.Body.String(), err)
+			}
+			if got.Code != tt.want.Code || got.Message != tt.want.Message {
+				t.Errorf("error %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -15,13 +15,25 @@ const (
 )
 
 func main() {
+	// "generator run" performs a single headless test run instead of serving the UI
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runCLI(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Create Redis client
-	redisClient, err := redis.NewClient(defaultRedisAddr)
+	redisClient, err := redis.NewClientWithOptions(redis.OptionsFromEnv(redisAddr()))
 	if err != nil {
 		log.Fatalf("Failed to create Redis client: %v", err)
 	}
 	defer redisClient.Close()
 
+	// Fold per-consumer counter keys written by older consumers into the consumer hashes
+	if migrated, err := redisClient.MigrateConsumerMetrics(context.Background()); err != nil {
+		log.Printf("Failed to migrate legacy consumer metrics: %v", err)
+	} else if migrated > 0 {
+		log.Printf("Migrated %d legacy consumer metric keys", migrated)
+	}
+
 	// Create context that can be cancelled
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -41,3 +53,11 @@ func main() {
 		log.Fatalf("Web server error: %v", err)
 	}
 }
+
+// redisAddr returns $REDIS_ADDR, or the in-cluster default
+func redisAddr() string {
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		return addr
+	}
+	return defaultRedisAddr
+}
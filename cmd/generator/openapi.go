@@ -0,0 +1,39 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPI serves the OpenAPI document describing the v1 API
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// handleUnversioned serves the pre-v1 /api/... paths as deprecated aliases of /api/v1/...,
+// and reports unknown API paths as JSON errors
+func handleUnversioned(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == api.Prefix || strings.HasPrefix(r.URL.Path, api.Prefix+"/") {
+		api.WriteError(w, http.StatusNotFound, api.CodeNotFound, "No such API endpoint")
+		return
+	}
+
+	path := api.Prefix + strings.TrimPrefix(r.URL.Path, "/api")
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "<"+path+`>; rel="successor-version"`)
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path, r2.URL.RawPath = path, ""
+	http.DefaultServeMux.ServeHTTP(w, r2)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	defaultRunListLimit = 50
+	maxRunListLimit     = 1000
+)
+
+// ConfigChange is a test parameter that differs between two runs
+type ConfigChange struct {
+	Field string      `json:"field"`
+	Base  interface{} `json:"base"`
+	Other interface{} `json:"other"`
+}
+
+// MetricsDelta is the difference between two runs' metrics (other minus base)
+type MetricsDelta struct {
+	Generated     int64   `json:"generated"`
+	Consumed      int64   `json:"consumed"`
+	ConsumedRatio float64 `json:"consumed_ratio"`
+	Consumers     int     `json:"consumers"`
+}
+
+// RunComparison is returned by /api/v1/runs/{id}/compare/{other}
+type RunComparison struct {
+	Base          *redis.RunRecord `json:"base"`
+	Other         *redis.RunRecord `json:"other"`
+	ConfigChanges []ConfigChange   `json:"config_changes"`
+	Delta         MetricsDelta     `json:"delta"`
+}
+
+// completeRun records the end of key generation for a run. The record is saved outside s.mu
+// so a slow Redis cannot stall the handlers that need it.
+func (s *server) completeRun(state *runState, stopped bool) {
+	s.mu.Lock()
+	state.running = false
+	run := state.record
+	run.State = redis.RunDraining
+	endedAt := time.Now().UTC()
+	run.EndedAt = &endedAt
+	run.Status = redis.RunCompleted
+	if stopped {
+		run.Status = redis.RunStopped
+	}
+	snapshot := *run
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRedisTimeout)
+	defer cancel()
+	if err := s.redis.SaveRun(ctx, &snapshot); err != nil {
+		log.Printf("Failed to save run %s: %v", snapshot.ID, err)
+	}
+}
+
+// finalizeRun records a drained run's final state, outcome and metrics and stops tracking it.
+// Redis is read and written outside s.mu; the run stays tracked until its record is saved.
+func (s *server) finalizeRun(ctx context.Context, state *runState, final string, outcome *redis.RunOutcome) {
+	metrics, err := s.liveMetrics(ctx, state.record.ID)
+	if err != nil {
+		log.Printf("Failed to snapshot metrics for run %s: %v", state.record.ID, err)
+	}
+
+	s.mu.Lock()
+	run := state.record
+	run.State = final
+	run.Outcome = outcome
+	if metrics != nil {
+		run.Metrics = metrics
+	}
+	snapshot := *run
+	s.mu.Unlock()
+
+	saveErr := s.redis.SaveRun(ctx, &snapshot)
+	s.mu.Lock()
+	delete(s.runs, snapshot.ID)
+	s.mu.Unlock()
+	if saveErr != nil {
+		log.Printf("Failed to save run %s: %v", snapshot.ID, saveErr)
+		return
+	}
+	if metrics == nil {
+		return
+	}
+	log.Printf("Finalized run %s: generated=%d consumed=%d", snapshot.ID, metrics.Generated, metrics.Consumed)
+}
+
+func (s *server) liveMetrics(ctx context.Context, runID string) (*redis.RunMetrics, error) {
+	generated, consumed, err := s.redis.GetMetrics(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	consumers, err := s.redis.GetConsumerMetrics(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	return &redis.RunMetrics{Generated: generated, Consumed: consumed, Consumers: consumers}, nil
+}
+
+// getRun loads a run record, filling in live metrics if the run has not been finalized yet
+func (s *server) getRun(ctx context.Context, runID string) (*redis.RunRecord, error) {
+	run, err := s.redis.GetRun(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	if run.Metrics == nil {
+		metrics, err := s.liveMetrics(ctx, runID)
+		if err != nil {
+			return nil, err
+		}
+		run.Metrics = metrics
+	}
+	return run, nil
+}
+
+// handleRuns lists past runs, most recent first
+func (s *server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+
+	limit := int64(defaultRunListLimit)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > maxRunListLimit {
+			api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid limit: must be 1-%d", maxRunListLimit))
+			return
+		}
+		limit = n
+	}
+
+	runs, err := s.redis.ListRuns(r.Context(), limit)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to list runs: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// handleRun returns a single run record
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+
+	runID, err := s.resolveRunID(r)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get current run: %v", err))
+		return
+	}
+
+	run, err := s.getRun(r.Context(), runID)
+	if errors.Is(err, redis.ErrRunNotFound) {
+		api.WriteError(w, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("Run %q not found", runID))
+		return
+	}
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get run: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// handleCompare compares the config and metrics of two runs
+func (s *server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+
+	runs := make([]*redis.RunRecord, 2)
+	for i, id := range []string{r.PathValue("id"), r.PathValue("other")} {
+		run, err := s.getRun(r.Context(), id)
+		if errors.Is(err, redis.ErrRunNotFound) {
+			api.WriteError(w, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("Run %q not found", id))
+			return
+		}
+		if err != nil {
+			api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get run: %v", err))
+			return
+		}
+		runs[i] = run
+	}
+
+	cmp, err := compareRuns(runs[0], runs[1])
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to compare runs: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmp)
+}
+
+func compareRuns(base, other *redis.RunRecord) (*RunComparison, error) {
+	cmp := &RunComparison{
+		Base:          base,
+		Other:         other,
+		ConfigChanges: []ConfigChange{},
+	}
+
+	baseConfig, err := decodeRunConfig(base)
+	if err != nil {
+		return nil, err
+	}
+	otherConfig, err := decodeRunConfig(other)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]bool)
+	for k := range baseConfig {
+		fields[k] = true
+	}
+	for k := range otherConfig {
+		fields[k] = true
+	}
+	for field := range fields {
+		b, o := baseConfig[field], otherConfig[field]
+		if fmt.Sprint(b) != fmt.Sprint(o) {
+			cmp.ConfigChanges = append(cmp.ConfigChanges, ConfigChange{Field: field, Base: b, Other: o})
+		}
+	}
+	sort.Slice(cmp.ConfigChanges, func(i, j int) bool { return cmp.ConfigChanges[i].Field < cmp.ConfigChanges[j].Field })
+
+	if base.Metrics != nil && other.Metrics != nil {
+		cmp.Delta = MetricsDelta{
+			Generated:     other.Metrics.Generated - base.Metrics.Generated,
+			Consumed:      other.Metrics.Consumed - base.Metrics.Consumed,
+			ConsumedRatio: consumedRatio(other.Metrics) - consumedRatio(base.Metrics),
+			Consumers:     len(other.Metrics.Consumers) - len(base.Metrics.Consumers),
+		}
+	}
+	return cmp, nil
+}
+
+// decodeRunConfig returns a run's stored config as generic JSON fields; a run without one has none
+func decodeRunConfig(run *redis.RunRecord) (map[string]interface{}, error) {
+	if len(run.Config) == 0 {
+		return nil, nil
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(run.Config, &config); err != nil {
+		return nil, fmt.Errorf("failed to decode config of run %s: %w", run.ID, err)
+	}
+	return config, nil
+}
+
+func consumedRatio(m *redis.RunMetrics) float64 {
+	if m.Generated == 0 {
+		return 0
+	}
+	return float64(m.Consumed) / float64(m.Generated)
+}
+
+// handleVerify reports missing and duplicate sequence numbers for a run
+func (s *server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+
+	runID, err := s.resolveRunID(r)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get current run: %v", err))
+		return
+	}
+
+	verification, err := s.redis.VerifyRun(r.Context(), runID)
+	if errors.Is(err, redis.ErrRunNotFound) {
+		api.WriteError(w, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("Run %q not found", runID))
+		return
+	}
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to verify run: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verification)
+}
+
+// handleLatency serves the p50/p95/p99 latency histograms recorded for a run
+func (s *server) handleLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+
+	runID, err := s.resolveRunID(r)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get current run: %v", err))
+		return
+	}
+
+	latency, err := s.redis.GetLatency(r.Context(), runID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get latency: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(latency)
+}
+
+// resolveRunID returns the {id} path value, resolving "current" to the most recently started run
+func (s *server) resolveRunID(r *http.Request) (string, error) {
+	runID := r.PathValue("id")
+	if runID != "current" {
+		return runID, nil
+	}
+	return s.redis.LatestRunID(r.Context())
+}
+
+// queryRunID returns the run_id query parameter, defaulting to the most recently started run
+func (s *server) queryRunID(r *http.Request) (string, error) {
+	if runID := r.URL.Query().Get("run_id"); runID != "" {
+		return runID, nil
+	}
+	return s.redis.LatestRunID(r.Context())
+}
+
+// newRunID returns a sortable, unique run identifier such as 20240102-150405-a1b2c3
+func newRunID() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate run ID: %w", err)
+	}
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b), nil
+}
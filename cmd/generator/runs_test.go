@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+func TestCompareRuns(t *testing.T) {
+	run := func(id, config string, metrics *redis.RunMetrics) *redis.RunRecord {
+		return &redis.RunRecord{ID: id, Config: json.RawMessage(config), Metrics: metrics}
+	}
+	tests := []struct {
+		name        string
+		base, other *redis.RunRecord
+		wantChanges []ConfigChange
+		wantDelta   MetricsDelta
+		wantErr     string
+	}{
+		{
+			name:        "identical",
+			base:        run("a", `{"num_keys": 100, "key_ttl": 500}`, &redis.RunMetrics{Generated: 100, Consumed: 100}),
+			other:       run("b", `{"key_ttl": 500, "num_keys": 100}`, &redis.RunMetrics{Generated: 100, Consumed: 100}),
+			wantChanges: []ConfigChange{},
+		},
+		{
+			name:  "config changes sorted by field",
+			base:  run("a", `{"num_keys": 100, "key_ttl": 500, "key_delay": 10}`, nil),
+			other: run("b", `{"num_keys": 200, "key_ttl": 500, "dedup_window": 3000}`, nil),
+			wantChanges: []ConfigChange{
+				{Field: "dedup_window", Base: nil, Other: 3000.0},
+				{Field: "key_delay", Base: 10.0, Other: nil},
+				{Field: "num_keys", Base: 100.0, Other: 200.0},
+			},
+		},
+		{
+			name: "metric deltas",
+			base: run("a", `{}`, &redis.RunMetrics{Generated: 100, Consumed: 50, Consumers: map[string]int64{"c1": 50}}),
+			other: run("b", `{}`, &redis.RunMetrics{Generated: 200, Consumed: 200,
+				Consumers: map[string]int64{"c1": 100, "c2": 100}}),
+			wantChanges: []ConfigChange{},
+			wantDelta:   MetricsDelta{Generated: 100, Consumed: 150, ConsumedRatio: 0.5, Consumers: 1},
+		},
+		{
+			name:        "nothing generated",
+			base:        run("a", `{}`, &redis.RunMetrics{}),
+			other:       run("b", `{}`, &redis.RunMetrics{Generated: 10, Consumed: 5}),
+			wantChanges: []ConfigChange{},
+			wantDelta:   MetricsDelta{Generated: 10, Consumed: 5, ConsumedRatio: 0.5},
+		},
+		{
+			name:        "no delta without both metrics",
+			base:        run("a", `{}`, &redis.RunMetrics{Generated: 100}),
+			other:       run("b", `{}`, nil),
+			wantChanges: []ConfigChange{},
+		},
+		{
+			name:        "run without a stored config",
+			base:        run("a", "", nil),
+			other:       run("b", `{"num_keys": 100}`, nil),
+			wantChanges: []ConfigChange{{Field: "num_keys", Base: nil, Other: 100.0}},
+		},
+		{
+			name:    "malformed config",
+			base:    run("a", `{}`, nil),
+			other:   run("b", `{"num_keys":`, nil),
+			wantErr: "failed to decode config of run b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmp, err := compareRuns(tt.base, tt.other)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("compareRuns() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("compareRuns() failed: %v", err)
+			}
+			if cmp.Base != tt.base || cmp.Other != tt.other {
+				t.Error("comparison does not carry both runs")
+			}
+			if !reflect.DeepEqual(cmp.ConfigChanges, tt.wantChanges) {
+				t.Errorf("config changes %+v, want %+v", cmp.ConfigChanges, tt.wantChanges)
+			}
+			if cmp.Delta != tt.wantDelta {
+				t.Errorf("delta %+v, want %+v", cmp.Delta, tt.wantDelta)
+			}
+		})
+	}
+}
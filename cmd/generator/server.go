@@ -3,67 +3,123 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
 	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
 )
 
-type TestConfig struct {
-	NumKeys     int64 `json:"num_keys"`
-	KeyDelay    int64 `json:"key_delay"`    // milliseconds
-	KeyTTL      int64 `json:"key_ttl"`      // milliseconds
-	DedupWindow int64 `json:"dedup_window"` // milliseconds
+type TestStatus struct {
+	RunID      string   `json:"run_id"`
+	IsRunning  bool     `json:"is_running"`
+	Generated  int64    `json:"generated"`
+	Consumed   int64    `json:"consumed"`
+	ActiveRuns []string `json:"active_runs"` // every run on this generator still generating keys
+	// State is generating, draining, settled or timed_out; Outcome is set once draining ends
+	State   string            `json:"state"`
+	Outcome *redis.RunOutcome `json:"outcome,omitempty"`
 }
 
-type TestStatus struct {
-	IsRunning bool  `json:"is_running"`
-	Generated int64 `json:"generated"`
-	Consumed  int64 `json:"consumed"`
+// StartResponse is returned by /api/v1/start
+type StartResponse struct {
+	RunID string `json:"run_id"`
+}
+
+// StopRequest optionally selects the run stopped by /api/v1/stop
+type StopRequest struct {
+	RunID string `json:"run_id"`
 }
 
 // TestMetrics represents the metrics for a key generation test
 type TestMetrics struct {
+	RunID     string           `json:"run_id"`
 	Generated int64            `json:"generated"`
 	Consumed  int64            `json:"consumed"`
 	Consumers map[string]int64 `json:"consumers"`
+	Stale     []string         `json:"stale_consumers"` // consumers without a recent heartbeat
+}
+
+const defaultRedisTimeout = 2 * time.Second
+
+// runState tracks a run started by this generator
+type runState struct {
+	record  *redis.RunRecord
+	config  TestConfig
+	cancel  context.CancelFunc
+	running bool // still generating keys
 }
 
 type server struct {
 	redis     *redis.Client
-	isRunning bool
+	generator *pipeline.Generator
+	scheduler *redis.Scheduler
+	runs      map[string]*runState // runs started here that have not been finalized
+	stream    *streamHub
 	mu        sync.Mutex
 }
 
-const (
-	defaultRedisTimeout = 2 * time.Second
-)
-
 func startWebServer(ctx context.Context, redisClient *redis.Client) error {
 	s := &server{
-		redis: redisClient,
+		redis:     redisClient,
+		generator: pipeline.NewGenerator(redisClient),
+		scheduler: redis.NewScheduler(redisClient),
+		runs:      make(map[string]*runState),
 	}
+	s.stream = newStreamHub(s)
+	go s.stream.run(ctx)
 
 	// API endpoints
-	http.HandleFunc("/api/start", s.handleStart)
-	http.HandleFunc("/api/stop", s.handleStop)
-	http.HandleFunc("/api/status", s.handleStatus)
-	http.HandleFunc("/api/metrics", s.getTestMetrics)
+	v1 := func(pattern string, handler http.HandlerFunc) { http.HandleFunc(api.Prefix+pattern, handler) }
+	v1("/start", s.handleStart)
+	v1("/stop", s.handleStop)
+	v1("/status", s.handleStatus)
+	v1("/metrics", s.getTestMetrics)
+	v1("/runs", s.handleRuns)
+	v1("/runs/{id}", s.handleRun)
+	v1("/runs/{id}/stop", s.handleStopRun)
+	v1("/runs/{id}/compare/{other}", s.handleCompare)
+	v1("/runs/{id}/verify", s.handleVerify)
+	v1("/runs/{id}/latency", s.handleLatency)
+	v1("/stream", s.handleStream)
+	v1("/consumers", s.handleConsumers)
+	v1("/consumers/{id}", s.handleConsumer)
+	v1("/tenants", s.handleTenants)
+	v1("/jobs", s.handleJobs)
+	v1("/jobs/{id}", s.handleJob)
+	v1("/openapi.json", handleOpenAPI)
+	http.HandleFunc("/api/", handleUnversioned)
 
 	// Serve static files for the UI
 	http.Handle("/", http.FileServer(http.Dir("web/dist")))
 
+	handler, tlsConfig, err := secureAPI(http.DefaultServeMux)
+	if err != nil {
+		return fmt.Errorf("failed to configure API authentication: %w", err)
+	}
+
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: nil,
+		Addr:      ":8080",
+		Handler:   handler,
+		TLSConfig: tlsConfig,
 	}
 
 	// Run server in a goroutine
 	go func() {
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Printf("HTTP server error: %v", err)
 		}
 	}()
@@ -75,155 +131,231 @@ func startWebServer(ctx context.Context, redisClient *redis.Client) error {
 
 func (s *server) handleStart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		api.MethodNotAllowed(w)
 		return
 	}
 
-	s.mu.Lock()
-	if s.isRunning {
-		s.mu.Unlock()
-		http.Error(w, "Test is already running", http.StatusConflict)
+	var config TestConfig
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields() // a misspelled field would otherwise silently run with its default
+	if err := dec.Decode(&config); err != nil {
+		api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
-	var config TestConfig
-	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-		s.mu.Unlock()
-		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+	if err := config.prepare(); err != nil {
+		var invalid configError
+		if errors.As(err, &invalid) {
+			api.WriteErrorDetails(w, http.StatusBadRequest, api.CodeInvalidConfig, "Invalid test config", []api.FieldError(invalid))
+			return
+		}
+		api.WriteError(w, http.StatusBadRequest, api.CodeInvalidConfig, fmt.Sprintf("Invalid test config: %v", err))
 		return
 	}
 
-	log.Printf("Starting test with config: NumKeys=%d, KeyDelay=%dms, KeyTTL=%dms, DedupWindow=%dms",
-		config.NumKeys, config.KeyDelay, config.KeyTTL, config.DedupWindow)
+	run, err := createRun(r.Context(), s.redis, config)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to start run: %v", err))
+		return
+	}
+	runID := run.ID
 
 	// Create a new background context for the key generation
 	genCtx, genCancel := context.WithCancel(context.Background())
+	state := &runState{record: run, config: config, cancel: genCancel, running: true}
 
-	// Reset metrics before starting
-	if err := s.redis.ResetMetrics(r.Context()); err != nil {
-		genCancel()
-		s.mu.Unlock()
-		http.Error(w, fmt.Sprintf("Failed to reset metrics: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	s.isRunning = true
+	s.mu.Lock()
+	s.runs[runID] = state
 	s.mu.Unlock()
 
 	// Start generating keys in background
-	go func() {
-		s.generateKeys(genCtx, config)
-		genCancel() // Clean up when done
-	}()
+	go s.generate(genCtx, state)
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StartResponse{RunID: runID})
+}
+
+// generate runs key generation for a run, then drains it and records the outcome
+func (s *server) generate(ctx context.Context, state *runState) {
+	run, config := state.record, state.config
+	generated, err := s.generator.Run(ctx, config.generatorConfig(run.ID))
+	state.cancel() // Clean up when done
+	if err != nil {
+		log.Printf("Run %s failed: %v", run.ID, err)
+	}
+
+	expectGenerated(s.redis, run.ID, config.NumKeys, generated)
+
+	// Generation is over, but keys keep expiring and being consumed while the run drains
+	s.completeRun(state, generated < config.NumKeys)
+
+	final, outcome := drain(context.Background(), s.redis, run.ID, config.drainOptions(time.Now()))
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRedisTimeout)
+	defer cancel()
+	s.finalizeRun(ctx, state, final, outcome)
 }
 
+// handleStop stops the run named by run_id (query or JSON body), or every running run if none is given
 func (s *server) handleStop(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		api.MethodNotAllowed(w)
 		return
 	}
 
+	runID := r.URL.Query().Get("run_id")
+	if runID == "" && r.ContentLength != 0 {
+		var req StopRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		runID = req.RunID
+	}
+
+	if runID == "" {
+		s.mu.Lock()
+		for _, state := range s.runs {
+			if state.running {
+				state.cancel()
+			}
+		}
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	s.stopRun(w, runID)
+}
+
+// handleStopRun stops a single run
+func (s *server) handleStopRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		api.MethodNotAllowed(w)
+		return
+	}
+	s.stopRun(w, r.PathValue("id"))
+}
+
+func (s *server) stopRun(w http.ResponseWriter, runID string) {
 	s.mu.Lock()
-	s.isRunning = false
+	state, ok := s.runs[runID]
+	if ok && state.running {
+		state.cancel()
+	}
 	s.mu.Unlock()
 
+	if !ok {
+		api.WriteError(w, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("Run %q is not managed by this generator", runID))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleStatus reports the run named by ?run_id=, defaulting to the most recently started run
 func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		api.MethodNotAllowed(w)
 		return
 	}
 
-	s.mu.Lock()
-	isRunning := s.isRunning
-	s.mu.Unlock()
-
-	generated, consumed, err := s.redis.GetMetrics(r.Context())
+	runID, err := s.queryRunID(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get metrics: %v", err), http.StatusInternalServerError)
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get current run: %v", err))
 		return
 	}
 
-	status := TestStatus{
-		IsRunning: isRunning,
-		Generated: generated,
-		Consumed:  consumed,
+	status, err := s.runStatus(r.Context(), runID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get status: %v", err))
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
 
-func (s *server) generateKeys(ctx context.Context, config TestConfig) {
-	log.Printf("Starting key generation: total keys=%d", config.NumKeys)
-	var i int64
-	for i = 0; i < config.NumKeys; i++ {
-		// Check if we should stop
-		s.mu.Lock()
-		if !s.isRunning {
-			log.Printf("Test stopped at key %d", i)
-			s.mu.Unlock()
-			return
+// runStatus reports a run's progress and state, or an idle status when runID is empty
+func (s *server) runStatus(ctx context.Context, runID string) (TestStatus, error) {
+	s.mu.Lock()
+	isRunning, tracked := false, false
+	var phase string
+	var outcome *redis.RunOutcome
+	if state, ok := s.runs[runID]; ok {
+		isRunning, tracked = state.running, true
+		phase = state.record.State
+	}
+	activeRuns := make([]string, 0)
+	for id, state := range s.runs {
+		if state.running {
+			activeRuns = append(activeRuns, id)
 		}
-		s.mu.Unlock()
-
-		// Create timeout context for Redis operation
-		opCtx, cancel := context.WithTimeout(ctx, defaultRedisTimeout)
+	}
+	s.mu.Unlock()
+	sort.Strings(activeRuns)
 
-		// Generate key with TTL
-		if err := s.redis.GenerateKey(opCtx, i, time.Duration(config.KeyTTL)*time.Millisecond); err != nil {
-			log.Printf("Failed to generate key %d: %v", i, err)
-			cancel()
-			continue
+	// Runs that finished draining, or were started by another generator, report their stored state
+	if !tracked && runID != "" {
+		run, err := s.redis.GetRun(ctx, runID)
+		if err != nil && !errors.Is(err, redis.ErrRunNotFound) {
+			return TestStatus{}, fmt.Errorf("failed to get run: %w", err)
 		}
-		cancel()
-
-		if i > 0 && i%100 == 0 {
-			log.Printf("Generated %d keys", i)
+		if run != nil {
+			phase, outcome = run.State, run.Outcome
 		}
-
-		// Wait for configured delay
-		time.Sleep(time.Duration(config.KeyDelay) * time.Millisecond)
 	}
 
-	log.Printf("Key generation complete: generated %d keys", i)
+	var generated, consumed int64
+	if runID != "" {
+		var err error
+		generated, consumed, err = s.redis.GetMetrics(ctx, runID)
+		if err != nil {
+			return TestStatus{}, fmt.Errorf("failed to get metrics: %w", err)
+		}
+	}
 
-	// Test complete
-	s.mu.Lock()
-	s.isRunning = false
-	s.mu.Unlock()
+	status := TestStatus{
+		RunID:      runID,
+		IsRunning:  isRunning,
+		Generated:  generated,
+		Consumed:   consumed,
+		ActiveRuns: activeRuns,
+		State:      phase,
+		Outcome:    outcome,
+	}
+	return status, nil
 }
 
+// getTestMetrics reports the metrics of the run named by ?run_id=, defaulting to the most recently started run
 func (s *server) getTestMetrics(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Get generated and consumed counts
-	generated, consumed, err := s.redis.GetMetrics(ctx)
+	runID, err := s.queryRunID(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get metrics: %v", err), http.StatusInternalServerError)
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get current run: %v", err))
 		return
 	}
 
-	// Get per-consumer metrics
-	consumers, err := s.redis.GetConsumerMetrics(ctx)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get consumer metrics: %v", err), http.StatusInternalServerError)
-		return
-	}
+	metrics := TestMetrics{RunID: runID, Consumers: map[string]int64{}, Stale: []string{}}
+	if runID != "" {
+		live, err := s.liveMetrics(ctx, runID)
+		if err != nil {
+			api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get metrics: %v", err))
+			return
+		}
+		metrics.Generated = live.Generated
+		metrics.Consumed = live.Consumed
+		metrics.Consumers = live.Consumers
 
-	metrics := TestMetrics{
-		Generated: generated,
-		Consumed:  consumed,
-		Consumers: consumers,
+		registered, err := s.liveConsumers(ctx)
+		if err != nil {
+			api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to get consumers: %v", err))
+			return
+		}
+		metrics.Stale = staleConsumers(live.Consumers, registered)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(metrics); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to encode metrics: %v", err), http.StatusInternalServerError)
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to encode metrics: %v", err))
 		return
 	}
 }
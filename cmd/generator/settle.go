@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	defaultQuietPeriod = 5 * time.Second
+	// defaultDrainSlack is added to the longest key TTL for the default drain timeout
+	defaultDrainSlack = time.Minute
+	drainPoll         = 500 * time.Millisecond
+)
+
+// drainOptions controls how long a run drains after generation ends
+type drainOptions struct {
+	lastExpiry time.Time     // when the last key is expected to have expired
+	quiet      time.Duration // settle once consumption makes no progress for this long after lastExpiry
+	timeout    time.Duration // give up draining after this long
+	poll       time.Duration // how often progress is checked
+}
+
+// progressSource reports a run's consumption progress, implemented by *redis.Client
+type progressSource interface {
+	RunProgress(ctx context.Context, runID string) (expected, consumed int64, err error)
+	VerifyRun(ctx context.Context, runID string) (*redis.Verification, error)
+}
+
+func (c *TestConfig) drainOptions(generationEnd time.Time) drainOptions {
+	opts := drainOptions{
+		lastExpiry: generationEnd.Add(c.maxTTL()),
+		quiet:      time.Duration(c.QuietPeriod) * time.Millisecond,
+		timeout:    time.Duration(c.DrainTimeout) * time.Millisecond,
+		poll:       drainPoll,
+	}
+	if opts.quiet <= 0 {
+		opts.quiet = defaultQuietPeriod
+	}
+	if opts.timeout <= 0 {
+		opts.timeout = c.maxTTL() + defaultDrainSlack
+	}
+	return opts
+}
+
+// drain waits for a run's keys to be consumed. It ends when every expected key has been consumed
+// and the last expiry has passed, when consumption makes no progress for the quiet period, or on
+// timeout, and returns the final run state with its outcome.
+func drain(ctx context.Context, source progressSource, runID string, opts drainOptions) (string, *redis.RunOutcome) {
+	start := time.Now()
+	lastProgress := start
+	var lastConsumed int64 = -1
+	reason := redis.SettledTimeout
+
+	ticker := time.NewTicker(opts.poll)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		expected, consumed, err := source.RunProgress(ctx, runID)
+		if err != nil {
+			log.Printf("Failed to check progress of run %s: %v", runID, err)
+		} else {
+			if consumed != lastConsumed {
+				lastConsumed = consumed
+				lastProgress = now
+			}
+			// Nothing can be consumed before keys expire, so the quiet period starts no earlier than that
+			quietSince := lastProgress
+			if quietSince.Before(opts.lastExpiry) {
+				quietSince = opts.lastExpiry
+			}
+			if consumed >= expected && !now.Before(opts.lastExpiry) {
+				reason = redis.SettledAllConsumed
+				break
+			}
+			if now.Sub(quietSince) >= opts.quiet {
+				reason = redis.SettledQuiet
+				break
+			}
+		}
+		if now.Sub(start) >= opts.timeout {
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return redis.RunTimedOut, &redis.RunOutcome{Reason: redis.SettledTimeout}
+		}
+	}
+
+	state := redis.RunSettled
+	if reason == redis.SettledTimeout {
+		state = redis.RunTimedOut
+	}
+	outcome := &redis.RunOutcome{Reason: reason}
+	v, err := source.VerifyRun(ctx, runID)
+	if err != nil {
+		log.Printf("Failed to verify run %s: %v", runID, err)
+		return state, outcome
+	}
+	outcome.Expected = v.Expected
+	outcome.Consumed = v.Consumed
+	outcome.Lost = v.MissingCount
+	outcome.Duplicates = v.DuplicateDeliveries
+	outcome.OK = v.OK && state == redis.RunSettled
+	log.Printf("Run %s %s (%s): consumed %d/%d, duplicates %d", runID, state, reason, v.Consumed, v.Expected, v.DuplicateDeliveries)
+	return state, outcome
+}
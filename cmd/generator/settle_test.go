@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// fakeProgress serves scripted consumption progress, one call at a time
+type fakeProgress struct {
+	expected int64
+	consumed func(call int) int64 // consumed count reported on the nth call, from 0
+	err      error
+	verify   *redis.Verification
+	calls    int
+}
+
+func (f *fakeProgress) RunProgress(ctx context.Context, runID string) (int64, int64, error) {
+	call := f.calls
+	f.calls++
+	if f.err != nil {
+		return 0, 0, f.err
+	}
+	return f.expected, f.consumed(call), nil
+}
+
+func (f *fakeProgress) VerifyRun(ctx context.Context, runID string) (*redis.Verification, error) {
+	if f.verify == nil {
+		return nil, errors.New("verification unavailable")
+	}
+	return f.verify, nil
+}
+
+func constant(n int64) func(int) int64 {
+	return func(int) int64 { return n }
+}
+
+func TestDrain(t *testing.T) {
+	clean := &redis.Verification{Expected: 3, Consumed: 3, OK: true}
+	lossy := &redis.Verification{Expected: 3, Consumed: 1, Missing: []int64{2, 3}, MissingCount: 2}
+
+	tests := []struct {
+		name        string
+		source      *fakeProgress
+		expiresIn   time.Duration
+		wantState   string
+		wantOutcome redis.RunOutcome
+		minElapsed  time.Duration
+		minCalls    int
+	}{
+		{
+			name:        "settled once every key is consumed",
+			source:      &fakeProgress{expected: 3, consumed: constant(3), verify: clean},
+			wantState:   redis.RunSettled,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledAllConsumed, Expected: 3, Consumed: 3, OK: true},
+		},
+		{
+			name:        "settling waits for the last expiry",
+			source:      &fakeProgress{expected: 3, consumed: constant(3), verify: clean},
+			expiresIn:   60 * time.Millisecond,
+			wantState:   redis.RunSettled,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledAllConsumed, Expected: 3, Consumed: 3, OK: true},
+			minElapsed:  60 * time.Millisecond,
+		},
+		{
+			name:        "settled after the quiet period",
+			source:      &fakeProgress{expected: 3, consumed: constant(1), verify: lossy},
+			wantState:   redis.RunSettled,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledQuiet, Expected: 3, Consumed: 1, Lost: 2},
+			minElapsed:  30 * time.Millisecond,
+		},
+		{
+			name:        "quiet period starts at the last expiry",
+			source:      &fakeProgress{expected: 3, consumed: constant(1), verify: lossy},
+			expiresIn:   40 * time.Millisecond,
+			wantState:   redis.RunSettled,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledQuiet, Expected: 3, Consumed: 1, Lost: 2},
+			minElapsed:  70 * time.Millisecond,
+		},
+		{
+			name: "progress resets the quiet period",
+			source: &fakeProgress{expected: 100, verify: lossy, consumed: func(call int) int64 {
+				return int64(min(call, 20))
+			}},
+			wantState:   redis.RunSettled,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledQuiet, Expected: 3, Consumed: 1, Lost: 2},
+			minCalls:    21,
+		},
+		{
+			name:        "timed out while consumption keeps progressing",
+			source:      &fakeProgress{expected: 1 << 40, consumed: func(call int) int64 { return int64(call) }, verify: clean},
+			wantState:   redis.RunTimedOut,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledTimeout, Expected: 3, Consumed: 3},
+			minElapsed:  300 * time.Millisecond,
+		},
+		{
+			name:        "timed out while progress cannot be read",
+			source:      &fakeProgress{err: errors.New("connection refused"), verify: lossy},
+			wantState:   redis.RunTimedOut,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledTimeout, Expected: 3, Consumed: 1, Lost: 2},
+			minElapsed:  300 * time.Millisecond,
+		},
+		{
+			name:        "outcome without counts when verification fails",
+			source:      &fakeProgress{expected: 3, consumed: constant(3)},
+			wantState:   redis.RunSettled,
+			wantOutcome: redis.RunOutcome{Reason: redis.SettledAllConsumed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			opts := drainOptions{
+				lastExpiry: start.Add(tt.expiresIn),
+				quiet:      30 * time.Millisecond,
+				timeout:    300 * time.Millisecond,
+				poll:       5 * time.Millisecond,
+			}
+			state, outcome := drain(context.Background(), tt.source, "run-1", opts)
+			elapsed := time.Since(start)
+			if state != tt.wantState {
+				t.Errorf("state %q, want %q", state, tt.wantState)
+			}
+			if outcome == nil || *outcome != tt.wantOutcome {
+				t.Errorf("outcome %+v, want %+v", outcome, tt.wantOutcome)
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("drained in %v, want at least %v", elapsed, tt.minElapsed)
+			}
+			if tt.source.calls < tt.minCalls {
+				t.Errorf("progress checked %d times, want at least %d", tt.source.calls, tt.minCalls)
+			}
+		})
+	}
+}
+
+func TestDrainCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	source := &fakeProgress{expected: 3, consumed: constant(1)}
+	opts := drainOptions{lastExpiry: time.Now().Add(time.Hour), quiet: time.Hour, timeout: time.Hour, poll: time.Millisecond}
+	state, outcome := drain(ctx, source, "run-1", opts)
+	if state != redis.RunTimedOut || *outcome != (redis.RunOutcome{Reason: redis.SettledTimeout}) {
+		t.Errorf("canceled drain returned %q %+v, want a bare timeout", state, outcome)
+	}
+}
+
+func TestDrainOptions(t *testing.T) {
+	end := time.Unix(1000, 0)
+	tests := []struct {
+		name   string
+		config TestConfig
+		want   drainOptions
+	}{
+		{
+			name:   "defaults",
+			config: TestConfig{KeyTTL: 100},
+			want:   drainOptions{lastExpiry: end.Add(100 * time.Millisecond), quiet: defaultQuietPeriod, timeout: 100*time.Millisecond + defaultDrainSlack, poll: drainPoll},
+		},
+		{
+			name:   "explicit",
+			config: TestConfig{KeyTTL: 100, QuietPeriod: 200, DrainTimeout: 3000},
+			want:   drainOptions{lastExpiry: end.Add(100 * time.Millisecond), quiet: 200 * time.Millisecond, timeout: 3 * time.Second, poll: drainPoll},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.drainOptions(end); got != tt.want {
+				t.Errorf("drainOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+)
+
+const (
+	streamInterval  = time.Second
+	streamKeepAlive = 15 * time.Second
+	streamBuffer    = 32
+)
+
+// Stream event types sent by /api/v1/stream
+const (
+	eventSnapshot = "snapshot" // full status and metrics, sent on connect and when the followed run changes
+	eventMetrics  = "metrics"  // counter deltas since the previous event
+	eventState    = "state"    // the run's status after its state changed
+	eventConsumer = "consumer" // a consumer started or stopped sending heartbeats
+)
+
+// StreamSnapshot is the payload of a snapshot event
+type StreamSnapshot struct {
+	Status  TestStatus  `json:"status"`
+	Metrics TestMetrics `json:"metrics"`
+}
+
+// StreamMetrics is the payload of a metrics event. Consumers holds the new totals of changed consumers only.
+type StreamMetrics struct {
+	RunID          string           `json:"run_id"`
+	Generated      int64            `json:"generated"`
+	Consumed       int64            `json:"consumed"`
+	GeneratedDelta int64            `json:"generated_delta"`
+	ConsumedDelta  int64            `json:"consumed_delta"`
+	Consumers      map[string]int64 `json:"consumers"`
+}
+
+// ConsumerEvent is the payload of a consumer event
+type ConsumerEvent struct {
+	ConsumerID string `json:"consumer_id"`
+	Event      string `json:"event"` // "join" or "leave"
+}
+
+type streamEvent struct {
+	name string
+	data interface{}
+}
+
+// subscriber is one connected stream client
+type subscriber struct {
+	runID   string // run to follow, empty for the most recent run
+	current string // run the client last received a snapshot for
+	primed  bool
+	events  chan streamEvent
+}
+
+// runView is the aggregator's last observation of a run
+type runView struct {
+	status  TestStatus
+	metrics TestMetrics
+}
+
+// streamHub polls Redis once per interval on behalf of every stream client and fans out the changes
+type streamHub struct {
+	s     *server
+	mu    sync.Mutex
+	subs  map[*subscriber]struct{}
+	views map[string]*runView
+	live  map[string]bool // consumers with a recent heartbeat, nil until first polled
+}
+
+func newStreamHub(s *server) *streamHub {
+	return &streamHub{
+		s:     s,
+		subs:  make(map[*subscriber]struct{}),
+		views: make(map[string]*runView),
+	}
+}
+
+func (h *streamHub) subscribe(runID string) *subscriber {
+	sub := &subscriber{runID: runID, events: make(chan streamEvent, streamBuffer)}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *streamHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// run aggregates until ctx is cancelled, then disconnects every client
+func (h *streamHub) run(ctx context.Context) {
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.poll(ctx)
+		case <-ctx.Done():
+			h.mu.Lock()
+			for sub := range h.subs {
+				delete(h.subs, sub)
+				close(sub.events)
+			}
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+// poll refreshes every run a client follows and sends the resulting events
+func (h *streamHub) poll(ctx context.Context) {
+	h.mu.Lock()
+	subs := make([]*subscriber, 0, len(h.subs))
+	for sub := range h.subs {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	latest, err := h.s.redis.LatestRunID(ctx)
+	if err != nil {
+		log.Printf("Stream failed to get latest run: %v", err)
+		return
+	}
+	live, err := h.s.liveConsumers(ctx)
+	if err != nil {
+		log.Printf("Stream failed to get consumers: %v", err)
+		return
+	}
+	consumerEvents := h.diffConsumers(live)
+
+	// Refresh each followed run once, however many clients follow it
+	runEvents := make(map[string][]streamEvent)
+	for _, sub := range subs {
+		runID := sub.runID
+		if runID == "" {
+			runID = latest
+		}
+		if _, done := runEvents[runID]; done || runID == "" {
+			continue
+		}
+		events, err := h.refresh(ctx, runID, live)
+		if err != nil {
+			log.Printf("Stream failed to refresh run %s: %v", runID, err)
+			continue
+		}
+		runEvents[runID] = events
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sub := range subs {
+		if _, ok := h.subs[sub]; !ok {
+			continue
+		}
+		runID := sub.runID
+		if runID == "" {
+			runID = latest
+		}
+		events, ok := runEvents[runID]
+		if !ok {
+			events = nil
+		} else if !sub.primed || sub.current != runID {
+			view := h.views[runID]
+			sub.primed, sub.current = true, runID
+			events = []streamEvent{{eventSnapshot, StreamSnapshot{Status: view.status, Metrics: view.metrics}}}
+		}
+		for _, evt := range append(consumerEvents, events...) {
+			select {
+			case sub.events <- evt:
+			default:
+				// A client that cannot keep up is dropped; EventSource reconnects and gets a fresh snapshot
+				delete(h.subs, sub)
+				close(sub.events)
+			}
+			if _, ok := h.subs[sub]; !ok {
+				break
+			}
+		}
+	}
+
+	// Forget runs nobody follows any more
+	for runID := range h.views {
+		if _, ok := runEvents[runID]; !ok {
+			delete(h.views, runID)
+		}
+	}
+}
+
+// diffConsumers records the live consumer set and returns join and leave events for what changed
+func (h *streamHub) diffConsumers(live map[string]bool) []streamEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev := h.live
+	h.live = live
+	if prev == nil {
+		return nil
+	}
+
+	var events []streamEvent
+	for _, id := range sortedKeys(live) {
+		if !prev[id] {
+			events = append(events, streamEvent{eventConsumer, ConsumerEvent{ConsumerID: id, Event: "join"}})
+		}
+	}
+	for _, id := range sortedKeys(prev) {
+		if !live[id] {
+			events = append(events, streamEvent{eventConsumer, ConsumerEvent{ConsumerID: id, Event: "leave"}})
+		}
+	}
+	return events
+}
+
+// refresh reads a run's status and metrics and returns the events describing what changed
+func (h *streamHub) refresh(ctx context.Context, runID string, live map[string]bool) ([]streamEvent, error) {
+	status, err := h.s.runStatus(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := h.s.liveMetrics(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	metrics := TestMetrics{
+		RunID:     runID,
+		Generated: current.Generated,
+		Consumed:  current.Consumed,
+		Consumers: current.Consumers,
+		Stale:     staleConsumers(current.Consumers, live),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev, ok := h.views[runID]
+	h.views[runID] = &runView{status: status, metrics: metrics}
+	if !ok {
+		return nil, nil
+	}
+
+	var events []streamEvent
+	if status.State != prev.status.State || status.IsRunning != prev.status.IsRunning {
+		events = append(events, streamEvent{eventState, status})
+	}
+
+	delta := StreamMetrics{
+		RunID:          runID,
+		Generated:      metrics.Generated,
+		Consumed:       metrics.Consumed,
+		GeneratedDelta: metrics.Generated - prev.metrics.Generated,
+		ConsumedDelta:  metrics.Consumed - prev.metrics.Consumed,
+		Consumers:      make(map[string]int64),
+	}
+	for id, n := range metrics.Consumers {
+		if last, seen := prev.metrics.Consumers[id]; !seen || n != last {
+			delta.Consumers[id] = n
+		}
+	}
+	if delta.GeneratedDelta != 0 || delta.ConsumedDelta != 0 || len(delta.Consumers) > 0 {
+		events = append(events, streamEvent{eventMetrics, delta})
+	}
+	return events, nil
+}
+
+// handleStream pushes snapshot, metrics, state and consumer events as Server-Sent Events.
+// ?run_id= follows one run; without it the stream follows the most recently started run.
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, "Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := s.stream.subscribe(r.URL.Query().Get("run_id"))
+	defer s.stream.unsubscribe(sub)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case evt, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(evt.data)
+			if err != nil {
+				log.Printf("Failed to encode %s event: %v", evt.name, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.name, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
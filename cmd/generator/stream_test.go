@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// newStreamServer returns a server backed by miniredis with its stream hub, without starting the aggregator
+func newStreamServer(t *testing.T) *server {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client, err := redis.NewClient(mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	s := &server{redis: client, runs: make(map[string]*runState)}
+	s.stream = newStreamHub(s)
+	return s
+}
+
+// startRun records a run as started on this generator at the given time
+func startRun(t *testing.T, s *server, runID string, at time.Time) {
+	t.Helper()
+	record := &redis.RunRecord{ID: runID, Status: "running", State: "generating", StartedAt: at}
+	if err := s.redis.SaveRun(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.runs[runID] = &runState{record: record, running: true}
+	s.mu.Unlock()
+}
+
+// consume counts n keys consumed by consumerID
+func consume(t *testing.T, s *server, runID, consumerID string, n int) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		if err := s.redis.IncrementConsumed(ctx, runID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.redis.IncrementConsumerMetric(ctx, runID, consumerID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// received drains the events already queued for sub, reporting whether its channel was closed
+func received(sub *subscriber) (events []streamEvent, closed bool) {
+	for {
+		select {
+		case evt, ok := <-sub.events:
+			if !ok {
+				return events, true
+			}
+			events = append(events, evt)
+		default:
+			return events, false
+		}
+	}
+}
+
+func eventNames(events []streamEvent) []string {
+	names := make([]string, len(events))
+	for i, evt := range events {
+		names[i] = evt.name
+	}
+	return names
+}
+
+// Every client following a run gets a snapshot first, then the same deltas, refreshed once per poll
+func TestStreamFanOut(t *testing.T) {
+	s := newStreamServer(t)
+	h := s.stream
+	ctx := context.Background()
+	start := time.Now()
+	startRun(t, s, "run-1", start)
+
+	latest := h.subscribe("")
+	pinned := h.subscribe("run-1")
+	h.poll(ctx)
+	for name, sub := range map[string]*subscriber{"latest": latest, "pinned": pinned} {
+		events, _ := received(sub)
+		if len(events) != 1 || events[0].name != eventSnapshot {
+			t.Fatalf("%s received %v, want a snapshot", name, eventNames(events))
+		}
+		snap := events[0].data.(StreamSnapshot)
+		if snap.Status.RunID != "run-1" || !snap.Status.IsRunning || snap.Metrics.RunID != "run-1" {
+			t.Errorf("%s snapshot %+v, want run-1 running", name, snap)
+		}
+	}
+
+	consume(t, s, "run-1", "consumer-1", 3)
+	consume(t, s, "run-1", "consumer-2", 1)
+	h.poll(ctx)
+	want := StreamMetrics{
+		RunID:         "run-1",
+		Consumed:      4,
+		ConsumedDelta: 4,
+		Consumers:     map[string]int64{"consumer-1": 3, "consumer-2": 1},
+	}
+	for name, sub := range map[string]*subscriber{"latest": latest, "pinned": pinned} {
+		events, _ := received(sub)
+		if len(events) != 1 || events[0].name != eventMetrics {
+			t.Fatalf("%s received %v, want metrics", name, eventNames(events))
+		}
+		if got := events[0].data.(StreamMetrics); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s received %+v, want %+v", name, got, want)
+		}
+	}
+
+	// Only changed consumers are sent, and nothing at all when nothing changed
+	consume(t, s, "run-1", "consumer-2", 1)
+	h.poll(ctx)
+	events, _ := received(pinned)
+	if len(events) != 1 || !reflect.DeepEqual(events[0].data.(StreamMetrics).Consumers, map[string]int64{"consumer-2": 2}) {
+		t.Errorf("received %+v, want consumer-2's new total only", events)
+	}
+	received(latest)
+	h.poll(ctx)
+	if events, _ := received(pinned); len(events) != 0 {
+		t.Errorf("received %v without a change", eventNames(events))
+	}
+
+	s.mu.Lock()
+	s.runs["run-1"].running = false
+	s.runs["run-1"].record.State = "draining"
+	s.mu.Unlock()
+	h.poll(ctx)
+	events, _ = received(pinned)
+	if len(events) != 1 || events[0].name != eventState || events[0].data.(TestStatus).State != "draining" {
+		t.Errorf("received %+v, want a draining state event", events)
+	}
+	received(latest)
+
+	// A newer run moves the unpinned client over with a fresh snapshot
+	startRun(t, s, "run-2", start.Add(time.Second))
+	h.poll(ctx)
+	events, _ = received(latest)
+	if len(events) != 1 || events[0].name != eventSnapshot || events[0].data.(StreamSnapshot).Status.RunID != "run-2" {
+		t.Errorf("latest received %+v, want a run-2 snapshot", events)
+	}
+	if events, _ := received(pinned); len(events) != 0 {
+		t.Errorf("pinned received %v after another run started", eventNames(events))
+	}
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	s := newStreamServer(t)
+	h := s.stream
+	ctx := context.Background()
+	startRun(t, s, "run-1", time.Now())
+
+	gone := h.subscribe("")
+	stays := h.subscribe("")
+	h.poll(ctx)
+	h.unsubscribe(gone)
+	h.unsubscribe(gone)
+	if _, closed := received(gone); !closed {
+		t.Error("unsubscribe left the channel open")
+	}
+
+	consume(t, s, "run-1", "consumer-1", 1)
+	h.poll(ctx)
+	if events, _ := received(stays); !reflect.DeepEqual(eventNames(events), []string{eventSnapshot, eventMetrics}) {
+		t.Errorf("remaining client received %v, want its snapshot and metrics", eventNames(events))
+	}
+
+	// Views are dropped once no client follows their run
+	h.unsubscribe(stays)
+	pinned := h.subscribe("run-2")
+	h.poll(ctx)
+	if _, ok := h.views["run-1"]; ok {
+		t.Error("run-1 still refreshed with no client following it")
+	}
+	h.unsubscribe(pinned)
+}
+
+// A client whose buffer is full is disconnected rather than blocking the others
+func TestStreamSlowConsumer(t *testing.T) {
+	s := newStreamServer(t)
+	h := s.stream
+	ctx := context.Background()
+	startRun(t, s, "run-1", time.Now())
+
+	slow := h.subscribe("")
+	fast := h.subscribe("")
+	h.poll(ctx)
+	received(fast)
+	for len(slow.events) < cap(slow.events) {
+		slow.events <- streamEvent{name: "filler"}
+	}
+
+	consume(t, s, "run-1", "consumer-1", 1)
+	h.poll(ctx)
+	events, closed := received(slow)
+	if !closed || len(events) != streamBuffer {
+		t.Errorf("slow client got %d events, closed %v; want its full buffer and a closed channel", len(events), closed)
+	}
+	h.mu.Lock()
+	_, subscribed := h.subs[slow]
+	h.mu.Unlock()
+	if subscribed {
+		t.Error("slow client still subscribed")
+	}
+	if events, closed := received(fast); closed || len(events) != 1 || events[0].name != eventMetrics {
+		t.Errorf("fast client got %v, closed %v; want metrics", eventNames(events), closed)
+	}
+
+	// Unsubscribing after the drop, as handleStream does on return, is harmless
+	h.unsubscribe(slow)
+}
+
+func TestStreamConsumerEvents(t *testing.T) {
+	s := newStreamServer(t)
+	h := s.stream
+	ctx := context.Background()
+	sub := h.subscribe("")
+
+	if err := s.redis.Heartbeat(ctx, "consumer-1"); err != nil {
+		t.Fatal(err)
+	}
+	h.poll(ctx)
+	if events, _ := received(sub); len(events) != 0 {
+		t.Errorf("first poll sent %v, want the consumers already running to be the baseline", eventNames(events))
+	}
+
+	if err := s.redis.Heartbeat(ctx, "consumer-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.redis.RemoveConsumer(ctx, "consumer-1"); err != nil {
+		t.Fatal(err)
+	}
+	h.poll(ctx)
+	events, _ := received(sub)
+	var got []ConsumerEvent
+	for _, evt := range events {
+		got = append(got, evt.data.(ConsumerEvent))
+	}
+	want := []ConsumerEvent{{ConsumerID: "consumer-2", Event: "join"}, {ConsumerID: "consumer-1", Event: "leave"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %+v, want %+v", got, want)
+	}
+}
+
+func TestStreamShutdown(t *testing.T) {
+	s := newStreamServer(t)
+	h := s.stream
+	subs := []*subscriber{h.subscribe(""), h.subscribe("run-1")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after its context was cancelled")
+	}
+	for i, sub := range subs {
+		if _, closed := received(sub); !closed {
+			t.Errorf("subscriber %d still open after shutdown", i)
+		}
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	s := newStreamServer(t)
+	h := s.stream
+	startRun(t, s, "run-1", time.Now())
+	srv := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status %d, want 405", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"?run_id=run-1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q, want text/event-stream", ct)
+	}
+
+	// The handler subscribes after writing its headers, so poll until it has
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+		}
+	}
+	subscribers := func() int {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.subs)
+	}
+	waitFor(func() bool { return subscribers() == 1 })
+	h.poll(context.Background())
+
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "event: snapshot" || !strings.HasPrefix(lines[1], "data: ") || lines[2] != "" {
+		t.Fatalf("received %q, want a snapshot event", lines)
+	}
+	var snap StreamSnapshot
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &snap); err != nil {
+		t.Fatalf("failed to decode snapshot: %v", err)
+	}
+	if snap.Status.RunID != "run-1" {
+		t.Errorf("snapshot for %q, want run-1", snap.Status.RunID)
+	}
+
+	// A client disconnecting unsubscribes it
+	cancel()
+	waitFor(func() bool { return subscribers() == 0 })
+}
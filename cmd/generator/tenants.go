@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+)
+
+// handleTenants lists each tenant's settings and usage counters
+func (s *server) handleTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		api.MethodNotAllowed(w)
+		return
+	}
+	tenants, err := s.redis.ListTenants(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to list tenants: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenants)
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one authorization decision
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Decision string    `json:"decision"` // "allow" or "deny"
+	Subject  string    `json:"subject,omitempty"`
+	Role     Role      `json:"role,omitempty"`
+	AuthBy   string    `json:"auth_method,omitempty"`
+	Required Role      `json:"required_role"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Remote   string    `json:"remote"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// AuditLog writes authorization decisions as JSON lines
+type AuditLog struct {
+	mu    sync.Mutex
+	w     io.Writer
+	reads bool // also record allowed viewer requests, which UI polling makes very frequent
+}
+
+// NewAuditLog writes to path, appending, or to stderr if path is empty
+func NewAuditLog(path string, reads bool) (*AuditLog, error) {
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		w = f
+	}
+	return &AuditLog{w: w, reads: reads}, nil
+}
+
+// Record writes an entry. Allowed viewer requests are skipped unless reads are audited.
+func (a *AuditLog) Record(e AuditEntry) {
+	if a == nil || (e.Decision == "allow" && e.Required == RoleViewer && !a.reads) {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write audit entry: %v", err)
+	}
+}
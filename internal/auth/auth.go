@@ -0,0 +1,72 @@
+// Package auth authenticates HTTP API callers and authorizes them by role
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Role is what an identity is allowed to do. Operators can do everything viewers can.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // read status, metrics and run history
+	RoleOperator Role = "operator" // also start and stop runs
+)
+
+// ErrNoCredentials means a request carried no credentials for an authenticator
+var ErrNoCredentials = errors.New("no credentials")
+
+// Allows reports whether r grants required
+func (r Role) Allows(required Role) bool {
+	switch r {
+	case RoleOperator:
+		return required == RoleOperator || required == RoleViewer
+	case RoleViewer:
+		return required == RoleViewer
+	default:
+		return false
+	}
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return r == RoleViewer || r == RoleOperator
+}
+
+// Identity is an authenticated caller
+type Identity struct {
+	Subject string `json:"subject"`
+	Role    Role   `json:"role"`
+	Method  string `json:"method"` // authenticator that accepted the caller: token, jwt or mtls
+}
+
+// Authenticator identifies the caller of a request. It returns ErrNoCredentials if the request
+// carries none of the credentials it understands, and another error if they are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain tries each authenticator in order; the first that finds credentials decides
+type Chain []Authenticator
+
+// Authenticate implements Authenticator
+func (c Chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+type identityKey struct{}
+
+// FromContext returns the identity the middleware authenticated, if any
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
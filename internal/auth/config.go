@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/secure"
+)
+
+// Config enables one or more authenticators for the API
+type Config struct {
+	Tokens     []TokenSpec `json:"tokens,omitempty"`
+	JWT        *JWTSpec    `json:"jwt,omitempty"`
+	MTLS       *MTLSSpec   `json:"mtls,omitempty"`
+	AuditLog   string      `json:"audit_log,omitempty"`   // file to append decisions to, stderr if empty
+	AuditReads bool        `json:"audit_reads,omitempty"` // also record allowed viewer requests
+}
+
+// TokenSpec is a static bearer token given inline or in a file
+type TokenSpec struct {
+	Subject   string `json:"subject"`
+	Role      Role   `json:"role"`
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+// JWTSpec validates OIDC JWTs with keys from a local JWKS file
+type JWTSpec struct {
+	JWKSFile  string          `json:"jwks_file"`
+	Issuer    string          `json:"issuer,omitempty"`
+	Audience  string          `json:"audience,omitempty"`
+	RoleClaim string          `json:"role_claim,omitempty"`
+	Roles     map[string]Role `json:"roles,omitempty"` // claim value to role, e.g. a group name
+}
+
+// MTLSSpec serves the API over TLS and accepts verified client certificates
+type MTLSSpec struct {
+	CertFile     string          `json:"cert_file"`      // server certificate
+	KeyFile      string          `json:"key_file"`       // server key
+	ClientCAFile string          `json:"client_ca_file"` // CAs client certificates must chain to
+	Subjects     map[string]Role `json:"subjects"`       // client common name to role, "*" for any
+}
+
+// LoadConfig reads a JSON auth configuration from path
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse auth config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Authenticator builds the configured authenticators, tried in the order tokens, JWT, mTLS
+func (c *Config) Authenticator() (Authenticator, error) {
+	var chain Chain
+
+	if len(c.Tokens) > 0 {
+		tokens := make(Tokens, 0, len(c.Tokens))
+		for i, spec := range c.Tokens {
+			if !spec.Role.Valid() {
+				return nil, fmt.Errorf("token %d: unknown role %q", i, spec.Role)
+			}
+			secret := secure.Secret{Value: spec.Token, File: spec.TokenFile}
+			if !secret.IsSet() {
+				return nil, fmt.Errorf("token %d: token or token_file is required", i)
+			}
+			tokens = append(tokens, StaticToken{Subject: spec.Subject, Role: spec.Role, Token: secret.Source()})
+		}
+		chain = append(chain, tokens)
+	}
+
+	if c.JWT != nil {
+		if c.JWT.JWKSFile == "" {
+			return nil, errors.New("jwt: jwks_file is required")
+		}
+		keys, err := JWKSFile(c.JWT.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		for claim, role := range c.JWT.Roles {
+			if !role.Valid() {
+				return nil, fmt.Errorf("jwt: unknown role %q for %q", role, claim)
+			}
+		}
+		chain = append(chain, &JWT{
+			Issuer:    c.JWT.Issuer,
+			Audience:  c.JWT.Audience,
+			RoleClaim: c.JWT.RoleClaim,
+			Roles:     c.JWT.Roles,
+			Keys:      keys,
+		})
+	}
+
+	if c.MTLS != nil {
+		for subject, role := range c.MTLS.Subjects {
+			if !role.Valid() {
+				return nil, fmt.Errorf("mtls: unknown role %q for %q", role, subject)
+			}
+		}
+		chain = append(chain, &MTLS{Subjects: c.MTLS.Subjects})
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("auth config enables no authenticators")
+	}
+	return chain, nil
+}
+
+// ServerTLS returns the TLS config the API must be served with for mTLS, or nil without mTLS.
+// Client certificates are optional at the TLS layer so token and JWT callers can still connect;
+// the certificate and CA files are reloaded when they change.
+func (c *Config) ServerTLS() (*tls.Config, error) {
+	if c.MTLS == nil {
+		return nil, nil
+	}
+	m := c.MTLS
+	if m.CertFile == "" || m.KeyFile == "" || m.ClientCAFile == "" {
+		return nil, errors.New("mtls: cert_file, key_file and client_ca_file are required")
+	}
+
+	cert := secure.WatchFiles(func() (*tls.Certificate, error) {
+		pair, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load server certificate: %w", err)
+		}
+		return &pair, nil
+	}, m.CertFile, m.KeyFile)
+	clientCAs := secure.WatchFiles(func() (*x509.CertPool, error) {
+		pem, err := os.ReadFile(m.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", m.ClientCAFile)
+		}
+		return pool, nil
+	}, m.ClientCAFile)
+	if _, err := cert(); err != nil {
+		return nil, fmt.Errorf("mtls: %w", err)
+	}
+	if _, err := clientCAs(); err != nil {
+		return nil, fmt.Errorf("mtls: %w", err)
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert()
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			pair, err := cert()
+			if err != nil {
+				return nil, err
+			}
+			pool, err := clientCAs()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*pair},
+				ClientCAs:    pool,
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+			}, nil
+		},
+	}, nil
+}
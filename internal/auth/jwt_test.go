@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signer holds the test signing keys, published under the kids "rsa" and "ec"
+type signer struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newSigner(t *testing.T) *signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{rsa: rsaKey, ec: ecKey}
+}
+
+func (s *signer) keys() (map[string]crypto.PublicKey, error) {
+	return map[string]crypto.PublicKey{"rsa": &s.rsa.PublicKey, "ec": &s.ec.PublicKey}, nil
+}
+
+func segment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// sign returns a compact JWT of claims signed with alg by the key kid names. The algorithm is
+// applied as asked, whatever the key, so mismatches can be tested.
+func (s *signer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	signed := segment(t, map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "none":
+	case "HS256":
+		// The classic confusion attack: the public key used as an HMAC secret
+		pub, _ := x509.MarshalPKIXPublicKey(&s.rsa.PublicKey)
+		mac := hmac.New(sha256.New, pub)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, s.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, s.ec, digest[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			ss.FillBytes(sig[32:])
+		}
+	default:
+		t.Fatalf("unsupported test algorithm %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	s := newSigner(t)
+	now := time.Unix(1_700_000_000, 0)
+	j := &JWT{Issuer: "https://idp.example", Audience: "generator", Keys: s.keys}
+	claims := func(edit func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":  "https://idp.example",
+			"aud":  "generator",
+			"sub":  "alice",
+			"role": "viewer",
+			"exp":  now.Add(time.Hour).Unix(),
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr string
+	}{
+		{"RS256", func() string { return s.sign(t, "RS256", "rsa", claims(nil)) }, ""},
+		{"PS256", func() string { return s.sign(t, "PS256", "rsa", claims(nil)) }, ""},
+		{"ES256", func() string { return s.sign(t, "ES256", "ec", claims(nil)) }, ""},
+		{"RSA algorithm with an EC key", func() string { return s.sign(t, "RS256", "ec", claims(nil)) }, "does not match its signing key"},
+		{"EC algorithm with an RSA key", func() string { return s.sign(t, "ES256", "rsa", claims(nil)) }, "does not match its signing key"},
+		{"EC algorithm with the wrong curve", func() string {
+			token := s.sign(t, "ES256", "ec", claims(nil))
+			parts := strings.Split(token, ".")
+			parts[0] = segment(t, map[string]string{"alg": "ES384", "kid": "ec"})
+			return strings.Join(parts, ".")
+		}, "does not match its signing key"},
+		{"alg none", func() string { return s.sign(t, "none", "rsa", claims(nil)) }, `unsupported token algorithm "none"`},
+		{"HS256 keyed with the public key", func() string { return s.sign(t, "HS256", "rsa", claims(nil)) }, `unsupported token algorithm "HS256"`},
+		{"unknown kid", func() string { return s.sign(t, "RS256", "retired", claims(nil)) }, `unknown signing key "retired"`},
+		{"tampered signature", func() string {
+			token := s.sign(t, "RS256", "rsa", claims(nil))
+			sig, _ := base64.RawURLEncoding.DecodeString(token[strings.LastIndex(token, ".")+1:])
+			sig[0] ^= 0xff
+			return token[:strings.LastIndex(token, ".")+1] + base64.RawURLEncoding.EncodeToString(sig)
+		}, "invalid token signature"},
+		{"tampered claims", func() string {
+			parts := strings.Split(s.sign(t, "ES256", "ec", claims(nil)), ".")
+			parts[1] = segment(t, claims(func(c map[string]interface{}) { c["role"] = "operator" }))
+			return strings.Join(parts, ".")
+		}, "invalid token signature"},
+		{"malformed signature", func() string { return s.sign(t, "RS256", "rsa", claims(nil)) + "!" }, "invalid token signature"},
+		{"no expiry", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { delete(c, "exp") }))
+		}, "no expiry"},
+		{"expired within the leeway", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-jwtLeeway + time.Second).Unix() }))
+		}, ""},
+		{"expired beyond the leeway", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-jwtLeeway - time.Second).Unix() }))
+		}, "expired"},
+		{"not yet valid within the leeway", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(jwtLeeway - time.Second).Unix() }))
+		}, ""},
+		{"not yet valid beyond the leeway", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(jwtLeeway + time.Second).Unix() }))
+		}, "not valid yet"},
+		{"wrong issuer", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" }))
+		}, "unexpected token issuer"},
+		{"no issuer", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { delete(c, "iss") }))
+		}, "unexpected token issuer"},
+		{"wrong audience", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["aud"] = "billing" }))
+		}, "not for this audience"},
+		{"audience list", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["aud"] = []string{"billing", "generator"} }))
+		}, ""},
+		{"audience list without ours", func() string {
+			return s.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) { c["aud"] = []string{"billing"} }))
+		}, "not for this audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := j.verify(tt.token(), now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTRoles(t *testing.T) {
+	s := newSigner(t)
+	tests := []struct {
+		name      string
+		roleClaim string
+		roles     map[string]Role
+		claims    map[string]interface{}
+		want      Role
+		wantErr   string
+	}{
+		{name: "role name", claims: map[string]interface{}{"role": "operator"}, want: RoleOperator},
+		{name: "mapped value", roles: map[string]Role{"sre": RoleOperator}, claims: map[string]interface{}{"role": "sre"}, want: RoleOperator},
+		{
+			name:      "highest of a custom array claim",
+			roleClaim: "groups",
+			roles:     map[string]Role{"devs": RoleViewer, "oncall": RoleOperator},
+			claims:    map[string]interface{}{"groups": []interface{}{"devs", "everyone", "oncall"}},
+			want:      RoleOperator,
+		},
+		{
+			name:      "mapping may demote a role name",
+			roleClaim: "groups",
+			roles:     map[string]Role{"operator": RoleViewer},
+			claims:    map[string]interface{}{"groups": []interface{}{"operator"}},
+			want:      RoleViewer,
+		},
+		{name: "default claim ignored with a custom one", roleClaim: "groups", claims: map[string]interface{}{"role": "operator"}, wantErr: "grants no role"},
+		{name: "unknown value", claims: map[string]interface{}{"role": "admin"}, wantErr: "grants no role"},
+		{name: "no role", claims: map[string]interface{}{}, wantErr: "grants no role"},
+		{name: "non-string values", claims: map[string]interface{}{"role": []interface{}{1, true}}, wantErr: "grants no role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &JWT{RoleClaim: tt.roleClaim, Roles: tt.roles, Keys: s.keys}
+			tt.claims["sub"] = "alice"
+			tt.claims["exp"] = time.Now().Add(time.Hour).Unix()
+			r := httptest.NewRequest("GET", "/api/v1/status", nil)
+			r.Header.Set("Authorization", "Bearer "+s.sign(t, "ES256", "ec", tt.claims))
+			id, err := j.Authenticate(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Authenticate() = %+v, %v, want an error containing %q", id, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() failed: %v", err)
+			}
+			if *id != (Identity{Subject: "alice", Role: tt.want, Method: "jwt"}) {
+				t.Errorf("Authenticate() = %+v, want alice as %s", id, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTNoCredentials(t *testing.T) {
+	j := &JWT{Keys: newSigner(t).keys}
+	for _, header := range []string{"", "Bearer opaque-token", "Basic YWxpY2U6c2VjcmV0"} {
+		r := httptest.NewRequest("GET", "/api/v1/status", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		if _, err := j.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+			t.Errorf("Authenticate() with %q = %v, want ErrNoCredentials", header, err)
+		}
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	s := newSigner(t)
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	rsaJWK := map[string]string{
+		"kid": "rsa", "kty": "RSA", "use": "sig",
+		"n": b64(s.rsa.N.Bytes()), "e": b64(big.NewInt(int64(s.rsa.E)).Bytes()),
+	}
+	ecJWK := map[string]string{
+		"kid": "ec", "kty": "EC", "crv": "P-256",
+		"x": b64(s.ec.X.FillBytes(make([]byte, 32))), "y": b64(s.ec.Y.FillBytes(make([]byte, 32))),
+	}
+	with := func(k map[string]string, field, value string) map[string]string {
+		c := make(map[string]string, len(k))
+		for f, v := range k {
+			c[f] = v
+		}
+		c[field] = value
+		return c
+	}
+	tests := []struct {
+		name     string
+		keys     []map[string]string
+		wantKids []string
+		wantErr  string
+	}{
+		{name: "RSA and EC", keys: []map[string]string{rsaJWK, ecJWK}, wantKids: []string{"ec", "rsa"}},
+		{name: "encryption keys skipped", keys: []map[string]string{rsaJWK, with(ecJWK, "use", "enc")}, wantKids: []string{"rsa"}},
+		{name: "only encryption keys", keys: []map[string]string{with(rsaJWK, "use", "enc")}, wantErr: "no signing keys"},
+		{name: "unsupported curve", keys: []map[string]string{with(ecJWK, "crv", "P-192")}, wantErr: "unsupported curve"},
+		{name: "point off the curve", keys: []map[string]string{with(ecJWK, "y", b64([]byte{1}))}, wantErr: "not on the curve"},
+		{name: "unsupported key type", keys: []map[string]string{with(ecJWK, "kty", "oct")}, wantErr: "unsupported key type"},
+		{name: "bad base64", keys: []map[string]string{with(rsaJWK, "n", "not base64!")}, wantErr: "invalid base64url"},
+		{name: "exponent out of range", keys: []map[string]string{with(rsaJWK, "e", b64([]byte{1, 0, 0, 0, 0}))}, wantErr: "exponent out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := json.Marshal(map[string]interface{}{"keys": tt.keys})
+			keys, err := parseJWKS(data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseJWKS() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJWKS() failed: %v", err)
+			}
+			if len(keys) != len(tt.wantKids) {
+				t.Fatalf("parsed %d keys, want %v", len(keys), tt.wantKids)
+			}
+			for _, kid := range tt.wantKids {
+				if _, ok := keys[kid]; !ok {
+					t.Errorf("key %q missing", kid)
+				}
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{rsaJWK}})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := JWKSFile(path)
+	if err != nil {
+		t.Fatalf("JWKSFile() failed: %v", err)
+	}
+	token := s.sign(t, "RS256", "rsa", map[string]interface{}{"role": "viewer", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := (&JWT{Keys: keys}).verify(token, time.Now()); err != nil {
+		t.Errorf("token signed with a key from the JWKS file failed to verify: %v", err)
+	}
+	if _, err := JWKSFile(filepath.Join(t.TempDir(), "none.json")); err == nil {
+		t.Error("JWKSFile() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+)
+
+// Middleware authenticates each request and checks the caller's role against the one
+// required(r) returns, recording every decision in audit
+func Middleware(authn Authenticator, audit *AuditLog, required func(r *http.Request) Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := required(r)
+		entry := AuditEntry{
+			Time:     time.Now().UTC(),
+			Required: need,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Remote:   r.RemoteAddr,
+		}
+
+		id, err := authn.Authenticate(r)
+		if err != nil {
+			entry.Decision = "deny"
+			entry.Reason = err.Error()
+			if errors.Is(err, ErrNoCredentials) {
+				entry.Reason = "no credentials"
+			}
+			audit.Record(entry)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="generator"`)
+			api.WriteError(w, http.StatusUnauthorized, api.CodeUnauthorized, "Unauthorized")
+			return
+		}
+
+		entry.Subject, entry.Role, entry.AuthBy = id.Subject, id.Role, id.Method
+		if !id.Role.Allows(need) {
+			entry.Decision = "deny"
+			entry.Reason = "role " + string(id.Role) + " does not grant " + string(need)
+			audit.Record(entry)
+			api.WriteError(w, http.StatusForbidden, api.CodeForbidden, "Role "+string(id.Role)+" does not grant "+string(need))
+			return
+		}
+
+		entry.Decision = "allow"
+		audit.Record(entry)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
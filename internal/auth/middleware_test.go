@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+)
+
+// readOnly requires viewers for reads and operators for anything else, like the generator
+func readOnly(r *http.Request) Role {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return RoleViewer
+	}
+	return RoleOperator
+}
+
+func TestMiddleware(t *testing.T) {
+	authn := Chain{Tokens{
+		staticToken("dashboard", RoleViewer, "viewer-secret"),
+		staticToken("deployer", RoleOperator, "operator-secret"),
+	}}
+	routes := []struct {
+		method, path string
+	}{
+		{"GET", "/api/v1/status"},
+		{"GET", "/api/v1/metrics"},
+		{"GET", "/api/v1/runs"},
+		{"GET", "/api/v1/stream"},
+		{"GET", "/api/v1/consumers"},
+		{"GET", "/api/v1/jobs"},
+		{"POST", "/api/v1/start"},
+		{"POST", "/api/v1/stop"},
+		{"POST", "/api/v1/runs/run-1/stop"},
+		{"DELETE", "/api/v1/consumers/consumer-1"},
+		{"POST", "/api/v1/jobs"},
+		{"PATCH", "/api/v1/jobs/job-1"},
+		{"DELETE", "/api/v1/jobs/job-1"},
+	}
+	callers := []struct {
+		name   string
+		header string
+		role   Role
+	}{
+		{"anonymous", "", ""},
+		{"bad token", "Bearer guess", ""},
+		{"viewer", "Bearer viewer-secret", RoleViewer},
+		{"operator", "Bearer operator-secret", RoleOperator},
+	}
+
+	for _, route := range routes {
+		for _, caller := range callers {
+			t.Run(caller.name+" "+route.method+" "+route.path, func(t *testing.T) {
+				var buf bytes.Buffer
+				audit := &AuditLog{w: &buf, reads: true}
+				var seen *Identity
+				next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					seen, _ = FromContext(r.Context())
+				})
+				r := httptest.NewRequest(route.method, route.path, nil)
+				if caller.header != "" {
+					r.Header.Set("Authorization", caller.header)
+				}
+				w := httptest.NewRecorder()
+				Middleware(authn, audit, readOnly, next).ServeHTTP(w, r)
+
+				need := readOnly(r)
+				want := http.StatusOK
+				switch {
+				case caller.role == "":
+					want = http.StatusUnauthorized
+				case !caller.role.Allows(need):
+					want = http.StatusForbidden
+				}
+				if w.Code != want {
+					t.Fatalf("status %d, want %d", w.Code, want)
+				}
+
+				var entry AuditEntry
+				if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+					t.Fatalf("failed to decode audit entry %q: %v", buf.String(), err)
+				}
+				if entry.Required != need || entry.Method != route.method || entry.Path != route.path {
+					t.Errorf("audit entry %+v does not describe the request", entry)
+				}
+
+				if want == http.StatusOK {
+					if seen == nil || seen.Role != caller.role {
+						t.Errorf("handler saw identity %+v, want role %s", seen, caller.role)
+					}
+					if entry.Decision != "allow" || entry.Role != caller.role || entry.AuthBy != "token" {
+						t.Errorf("audit entry %+v, want an allow for %s", entry, caller.role)
+					}
+					return
+				}
+				if seen != nil {
+					t.Error("handler called for a denied request")
+				}
+				if entry.Decision != "deny" || entry.Reason == "" {
+					t.Errorf("audit entry %+v, want a deny with its reason", entry)
+				}
+				var apiErr api.Error
+				if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil {
+					t.Fatalf("failed to decode error body %q: %v", w.Body.String(), err)
+				}
+				if want == http.StatusUnauthorized {
+					if apiErr.Code != api.CodeUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+						t.Errorf("got %+v with WWW-Authenticate %q, want an unauthorized challenge", apiErr, w.Header().Get("WWW-Authenticate"))
+					}
+				} else if apiErr.Code != api.CodeForbidden {
+					t.Errorf("got %+v, want forbidden", apiErr)
+				}
+			})
+		}
+	}
+}
+
+func TestAuditLogSkipsReads(t *testing.T) {
+	var buf bytes.Buffer
+	audit := &AuditLog{w: &buf}
+	audit.Record(AuditEntry{Decision: "allow", Required: RoleViewer})
+	if buf.Len() != 0 {
+		t.Errorf("allowed read recorded without audit_reads: %s", buf.String())
+	}
+	audit.Record(AuditEntry{Decision: "deny", Required: RoleViewer})
+	audit.Record(AuditEntry{Decision: "allow", Required: RoleOperator})
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Errorf("recorded %d entries, want the denied read and the allowed write", n)
+	}
+	var nilLog *AuditLog
+	nilLog.Record(AuditEntry{Decision: "deny"})
+}
+
+func TestChain(t *testing.T) {
+	jwt := &JWT{Keys: newSigner(t).keys}
+	chain := Chain{Tokens{staticToken("deployer", RoleOperator, "operator-secret")}, jwt}
+	tests := []struct {
+		name    string
+		header  string
+		wantErr string
+	}{
+		{"token", "Bearer operator-secret", ""},
+		{"unknown opaque token", "Bearer guess", "unknown bearer token"},
+		{"JWT falls through to its validator", "Bearer a.b.c", "invalid token"},
+		{"nothing", "", "no credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/status", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			_, err := chain.Authenticate(r)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Authenticate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Authenticate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, required Role
+		want           bool
+	}{
+		{RoleOperator, RoleOperator, true},
+		{RoleOperator, RoleViewer, true},
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{"admin", RoleViewer, false},
+		{"", RoleViewer, false},
+		{RoleOperator, "admin", false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Allows(tt.required); got != tt.want {
+			t.Errorf("%q.Allows(%q) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// MTLS authenticates callers by the verified TLS client certificate they present.
+// The certificate's common name is mapped to a role through Subjects; "*" matches any name.
+type MTLS struct {
+	Subjects map[string]Role
+}
+
+// Authenticate implements Authenticator
+func (m *MTLS) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	role, ok := m.Subjects[subject]
+	if !ok {
+		role, ok = m.Subjects["*"]
+	}
+	if !ok {
+		return nil, fmt.Errorf("client certificate %q grants no role", subject)
+	}
+	return &Identity{Subject: subject, Role: role, Method: "mtls"}, nil
+}
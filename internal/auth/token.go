@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenQueryParam carries a bearer token for clients that cannot set headers, such as EventSource
+const TokenQueryParam = "access_token"
+
+type queryTokenKey struct{}
+
+// AllowQueryToken returns r with its TokenQueryParam accepted as a bearer token. Query strings end
+// up in access logs and browser history, so only routes EventSource connects to should allow it.
+func AllowQueryToken(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), queryTokenKey{}, true))
+}
+
+// StaticToken grants a role to the holder of a fixed bearer token
+type StaticToken struct {
+	Subject string
+	Role    Role
+	Token   func() (string, error) // current token, so rotated token files apply immediately
+}
+
+// Tokens authenticates static bearer tokens
+type Tokens []StaticToken
+
+// Authenticate implements Authenticator
+func (t Tokens) Authenticate(r *http.Request) (*Identity, error) {
+	presented, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	// Compare digests so the comparison is constant time regardless of token length
+	sum := sha256.Sum256([]byte(presented))
+	for _, st := range t {
+		token, err := st.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load token for %s: %w", st.Subject, err)
+		}
+		want := sha256.Sum256([]byte(token))
+		if token != "" && subtle.ConstantTimeCompare(sum[:], want[:]) == 1 {
+			return &Identity{Subject: st.Subject, Role: st.Role, Method: "token"}, nil
+		}
+	}
+	if looksLikeJWT(presented) {
+		// Leave it to the JWT validator
+		return nil, ErrNoCredentials
+	}
+	return nil, fmt.Errorf("unknown bearer token")
+}
+
+// bearerToken returns the token from the Authorization header, or from the access_token query
+// parameter where AllowQueryToken permits it
+func bearerToken(r *http.Request) (string, bool) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		scheme, token, ok := strings.Cut(h, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", false
+		}
+		return strings.TrimSpace(token), true
+	}
+	if allowed, _ := r.Context().Value(queryTokenKey{}).(bool); !allowed {
+		return "", false
+	}
+	if token := r.URL.Query().Get(TokenQueryParam); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// looksLikeJWT reports whether a bearer token has the three dot-separated parts of a JWT
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func staticToken(subject string, role Role, token string) StaticToken {
+	return StaticToken{Subject: subject, Role: role, Token: func() (string, error) { return token, nil }}
+}
+
+func TestTokens(t *testing.T) {
+	tokens := Tokens{
+		staticToken("dashboard", RoleViewer, "viewer-secret"),
+		staticToken("deployer", RoleOperator, "operator-secret"),
+		staticToken("unset", RoleOperator, ""),
+	}
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		stream  bool // the route accepts the query parameter
+		want    *Identity
+		wantErr string // ErrNoCredentials when "none"
+	}{
+		{name: "viewer", header: "Bearer viewer-secret", want: &Identity{Subject: "dashboard", Role: RoleViewer, Method: "token"}},
+		{name: "operator", header: "Bearer operator-secret", want: &Identity{Subject: "deployer", Role: RoleOperator, Method: "token"}},
+		{name: "scheme is case insensitive", header: "bearer viewer-secret", want: &Identity{Subject: "dashboard", Role: RoleViewer, Method: "token"}},
+		{name: "query parameter", query: "?access_token=operator-secret", stream: true, want: &Identity{Subject: "deployer", Role: RoleOperator, Method: "token"}},
+		{name: "query parameter where the route does not allow it", query: "?access_token=operator-secret", wantErr: "none"},
+		{name: "header wins over the query", header: "Bearer viewer-secret", query: "?access_token=operator-secret", stream: true, want: &Identity{Subject: "dashboard", Role: RoleViewer, Method: "token"}},
+		{name: "unknown token", header: "Bearer guess", wantErr: "unknown bearer token"},
+		{name: "prefix of a token", header: "Bearer viewer", wantErr: "unknown bearer token"},
+		{name: "empty token never matches an unset one", query: "?access_token=", stream: true, wantErr: "none"},
+		{name: "no credentials", wantErr: "none"},
+		{name: "other scheme", header: "Basic ZGFzaGJvYXJkOnNlY3JldA==", wantErr: "none"},
+		{name: "scheme without a token", header: "Bearer", wantErr: "none"},
+		{name: "JWT left to the JWT validator", header: "Bearer a.b.c", wantErr: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/stream"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.stream {
+				r = AllowQueryToken(r)
+			}
+			id, err := tokens.Authenticate(r)
+			switch {
+			case tt.wantErr == "none":
+				if !errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("Authenticate() = %+v, %v, want ErrNoCredentials", id, err)
+				}
+			case tt.wantErr != "":
+				if err == nil || errors.Is(err, ErrNoCredentials) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Authenticate() = %+v, %v, want an error containing %q", id, err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("Authenticate() failed: %v", err)
+			case *id != *tt.want:
+				t.Errorf("Authenticate() = %+v, want %+v", id, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokensLoadError(t *testing.T) {
+	tokens := Tokens{{Subject: "broken", Role: RoleViewer, Token: func() (string, error) { return "", errors.New("unreadable") }}}
+	r := httptest.NewRequest("GET", "/api/v1/status", nil)
+	r.Header.Set("Authorization", "Bearer anything")
+	if _, err := tokens.Authenticate(r); err == nil || !strings.Contains(err.Error(), "failed to load token for broken") {
+		t.Errorf("Authenticate() = %v, want the load failure", err)
+	}
+}
@@ -0,0 +1,159 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/nats"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+)
+
+// ErrInjected is returned by wrapped clients when a fault fires
+var ErrInjected = errors.New("chaos: injected fault")
+
+// Target executes scheduled faults against the running system
+type Target interface {
+	DisconnectRedis(ctx context.Context) error
+	DisconnectNATS() error
+	KillConsumer(index int) error
+}
+
+// Injector decides when faults fire and counts how often each one did
+type Injector struct {
+	faults []Fault
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	counts map[string]int64
+}
+
+// NewInjector creates an injector for faults using a deterministic seed
+func NewInjector(faults []Fault, seed int64) *Injector {
+	return &Injector{
+		faults: faults,
+		rnd:    rand.New(rand.NewSource(seed)),
+		counts: make(map[string]int64),
+	}
+}
+
+// Counts returns how many times each fault type fired
+func (i *Injector) Counts() map[string]int64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	counts := make(map[string]int64, len(i.counts))
+	for k, v := range i.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+// fire rolls for a per-call fault of the given type and returns it if triggered
+func (i *Injector) fire(faultType string) (Fault, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, f := range i.faults {
+		if f.Type != faultType {
+			continue
+		}
+		if i.rnd.Float64() < f.Probability {
+			i.counts[faultType]++
+			return f, true
+		}
+	}
+	return Fault{}, false
+}
+
+func (i *Injector) record(faultType string) {
+	i.mu.Lock()
+	i.counts[faultType]++
+	i.mu.Unlock()
+}
+
+// Deduplicator wraps next with drop_pubsub, delay_setnx and fail_setnx faults
+func (i *Injector) Deduplicator(next pipeline.Deduplicator) pipeline.Deduplicator {
+	return &faultyDeduplicator{next: next, inj: i}
+}
+
+// Bus wraps next with fail_publish faults
+func (i *Injector) Bus(next pipeline.Bus) pipeline.Bus {
+	return &faultyBus{next: next, inj: i}
+}
+
+// Run executes the scheduled faults relative to start until ctx is cancelled
+func (i *Injector) Run(ctx context.Context, start time.Time, target Target) {
+	var scheduled []Fault
+	for _, f := range i.faults {
+		if f.Scheduled() {
+			scheduled = append(scheduled, f)
+		}
+	}
+	sort.Slice(scheduled, func(a, b int) bool { return scheduled[a].At < scheduled[b].At })
+
+	for _, f := range scheduled {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(start.Add(time.Duration(f.At)))):
+		}
+
+		var err error
+		switch f.Type {
+		case FaultDisconnectRedis:
+			err = target.DisconnectRedis(ctx)
+		case FaultDisconnectNATS:
+			err = target.DisconnectNATS()
+		case FaultKillConsumer:
+			err = target.KillConsumer(f.Consumer)
+		}
+		if err != nil {
+			log.Printf("Chaos: failed to inject %s: %v", f.Type, err)
+			continue
+		}
+		log.Printf("Chaos: injected %s at %v", f.Type, time.Duration(f.At))
+		i.record(f.Type)
+	}
+}
+
+type faultyDeduplicator struct {
+	next pipeline.Deduplicator
+	inj  *Injector
+}
+
+func (d *faultyDeduplicator) CreateDedupKey(ctx context.Context, originalKey string, ttl time.Duration) (bool, error) {
+	// A dropped notification looks to the pipeline like another consumer won the claim
+	if _, ok := d.inj.fire(FaultDropPubSub); ok {
+		return false, nil
+	}
+	if f, ok := d.inj.fire(FaultDelaySetNX); ok {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(time.Duration(f.Delay)):
+		}
+	}
+	if _, ok := d.inj.fire(FaultFailSetNX); ok {
+		return false, ErrInjected
+	}
+	return d.next.CreateDedupKey(ctx, originalKey, ttl)
+}
+
+type faultyBus struct {
+	next pipeline.Bus
+	inj  *Injector
+}
+
+func (b *faultyBus) PublishExpiredKey(ctx context.Context, key string) error {
+	if _, ok := b.inj.fire(FaultFailPublish); ok {
+		return ErrInjected
+	}
+	return b.next.PublishExpiredKey(ctx, key)
+}
+
+func (b *faultyBus) SubscribeExpiredKeys(ctx context.Context, handler func(d nats.Delivery) error) error {
+	return b.next.SubscribeExpiredKeys(ctx, handler)
+}
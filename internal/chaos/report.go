@@ -0,0 +1,84 @@
+package chaos
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Result is the outcome of a single scenario
+type Result struct {
+	Scenario   string           `json:"scenario"`
+	Faults     map[string]int64 `json:"faults"` // injections per fault type
+	Generated  int64            `json:"generated"`
+	Consumed   int64            `json:"consumed"`   // distinct keys delivered at least once
+	Duplicated int64            `json:"duplicated"` // extra deliveries beyond the first
+	Lost       int64            `json:"lost"`       // generated keys never delivered
+}
+
+// Tally compares the generated keys against delivery counts per key
+func Tally(scenario string, generated []string, deliveries map[string]int, faults map[string]int64) Result {
+	r := Result{
+		Scenario:  scenario,
+		Faults:    faults,
+		Generated: int64(len(generated)),
+	}
+	for _, key := range generated {
+		n := deliveries[key]
+		switch {
+		case n == 0:
+			r.Lost++
+		case n > 1:
+			r.Consumed++
+			r.Duplicated += int64(n - 1)
+		default:
+			r.Consumed++
+		}
+	}
+	return r
+}
+
+// Check returns an error describing how r violates expect, if at all
+func (r Result) Check(expect Expect) error {
+	var problems []string
+	if expect.MaxDuplicated != nil && r.Duplicated > *expect.MaxDuplicated {
+		problems = append(problems, fmt.Sprintf("duplicated %d > %d", r.Duplicated, *expect.MaxDuplicated))
+	}
+	if expect.MaxLost != nil && r.Lost > *expect.MaxLost {
+		problems = append(problems, fmt.Sprintf("lost %d > %d", r.Lost, *expect.MaxLost))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %s", r.Scenario, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// WriteTable writes one row per scenario with the injected fault counts
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tFAULTS\tGENERATED\tCONSUMED\tDUPLICATED\tLOST")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n",
+			r.Scenario, formatFaults(r.Faults), r.Generated, r.Consumed, r.Duplicated, r.Lost)
+	}
+	return tw.Flush()
+}
+
+func formatFaults(faults map[string]int64) string {
+	if len(faults) == 0 {
+		return "none"
+	}
+	types := make([]string, 0, len(faults))
+	for t := range faults {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	parts := make([]string, len(types))
+	for i, t := range types {
+		parts[i] = fmt.Sprintf("%s=%d", t, faults[t])
+	}
+	return strings.Join(parts, ",")
+}
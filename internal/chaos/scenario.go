@@ -0,0 +1,136 @@
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+)
+
+// Fault types
+const (
+	// Per-call faults, triggered with Probability
+	FaultDropPubSub  = "drop_pubsub"  // consumer never sees the expiration notification
+	FaultDelaySetNX  = "delay_setnx"  // dedup SETNX is delayed by Delay
+	FaultFailSetNX   = "fail_setnx"   // dedup SETNX returns an error
+	FaultFailPublish = "fail_publish" // NATS publish returns an error
+
+	// Scheduled faults, triggered once At after the run starts
+	FaultDisconnectRedis = "disconnect_redis" // drop Redis connections, Pub/Sub included
+	FaultDisconnectNATS  = "disconnect_nats"  // force every consumer to reconnect to NATS
+	FaultKillConsumer    = "kill_consumer"    // shut down consumer instance Consumer
+)
+
+// Duration is a time.Duration that unmarshals from strings such as "250ms"
+type Duration time.Duration
+
+// UnmarshalJSON parses a Go duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration as a Go duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Fault is a single fault to inject during a scenario
+type Fault struct {
+	Type        string   `json:"type"`
+	Probability float64  `json:"probability,omitempty"` // per-call faults
+	Delay       Duration `json:"delay,omitempty"`       // delay_setnx
+	At          Duration `json:"at,omitempty"`          // scheduled faults
+	Consumer    int      `json:"consumer,omitempty"`    // kill_consumer
+}
+
+// Scheduled reports whether the fault fires once at a point in time rather than per call
+func (f Fault) Scheduled() bool {
+	switch f.Type {
+	case FaultDisconnectRedis, FaultDisconnectNATS, FaultKillConsumer:
+		return true
+	}
+	return false
+}
+
+// Expect bounds the acceptable outcome of a scenario. Nil fields are not checked.
+type Expect struct {
+	MaxDuplicated *int64 `json:"max_duplicated,omitempty"`
+	MaxLost       *int64 `json:"max_lost,omitempty"`
+}
+
+// Scenario describes one fault-injection run
+type Scenario struct {
+	Name      string                    `json:"name"`
+	Seed      int64                     `json:"seed"`
+	Consumers int                       `json:"consumers"`
+	NumKeys   int64                     `json:"num_keys"`
+	KeyDelay  Duration                  `json:"key_delay"`
+	KeyTTL    Duration                  `json:"key_ttl"`
+	Profile   *pipeline.LoadProfile     `json:"profile,omitempty"` // overrides KeyDelay, e.g. burst trains
+	TTL       *pipeline.TTLDistribution `json:"ttl,omitempty"`     // overrides KeyTTL, e.g. a thundering herd
+	DedupTTL  Duration                  `json:"dedup_ttl"`
+	Settle    Duration                  `json:"settle"` // how long to wait for consumption after generation
+	Faults    []Fault                   `json:"faults"`
+	Expect    Expect                    `json:"expect"`
+}
+
+// File is the top-level scenario file format
+type File struct {
+	Scenarios []Scenario `json:"scenarios"`
+}
+
+// LoadScenarios reads and validates a scenario file
+func LoadScenarios(path string) ([]Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario file: %w", err)
+	}
+
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario file %s: %w", path, err)
+	}
+
+	for i := range f.Scenarios {
+		if err := f.Scenarios[i].validate(); err != nil {
+			return nil, fmt.Errorf("scenario %q: %w", f.Scenarios[i].Name, err)
+		}
+	}
+	return f.Scenarios, nil
+}
+
+func (s *Scenario) validate() error {
+	if s.Consumers <= 0 {
+		return fmt.Errorf("consumers must be positive")
+	}
+	if s.NumKeys <= 0 {
+		return fmt.Errorf("num_keys must be positive")
+	}
+	for _, f := range s.Faults {
+		switch f.Type {
+		case FaultDropPubSub, FaultDelaySetNX, FaultFailSetNX, FaultFailPublish:
+			if f.Probability < 0 || f.Probability > 1 {
+				return fmt.Errorf("%s probability must be between 0 and 1", f.Type)
+			}
+		case FaultDisconnectRedis, FaultDisconnectNATS:
+		case FaultKillConsumer:
+			if f.Consumer < 0 || f.Consumer >= s.Consumers {
+				return fmt.Errorf("kill_consumer target %d out of range", f.Consumer)
+			}
+		default:
+			return fmt.Errorf("unknown fault type %q", f.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/secure"
+)
+
+const defaultTimeout = 30 * time.Second
+
+// Client calls the generator's v1 HTTP API. Failed requests return an *api.Error.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	token   func() (string, error)
+}
+
+// Options configures a Client
+type Options struct {
+	URL     string        // generator address, e.g. http://localhost:8080
+	Token   secure.Secret // bearer token or JWT, if the API requires one
+	TLS     secure.TLSConfig
+	Timeout time.Duration // per request, default 30s
+}
+
+// OptionsFromEnv returns options for url with a token read from GENERATOR_TOKEN (or
+// GENERATOR_TOKEN_FILE) and TLS from GENERATOR_TLS_*
+func OptionsFromEnv(url string) Options {
+	return Options{
+		URL:   url,
+		Token: secure.SecretFromEnv("GENERATOR_TOKEN"),
+		TLS:   secure.TLSFromEnv("GENERATOR"),
+	}
+}
+
+// NewClient creates a client for the generator at url
+func NewClient(url string) (*Client, error) {
+	return NewClientWithOptions(Options{URL: url})
+}
+
+// NewClientWithOptions creates a client with authentication and TLS. A token file is re-read
+// when it changes, and a client certificate in opts.TLS is presented for mTLS.
+func NewClientWithOptions(opts Options) (*Client, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("generator URL is required")
+	}
+	tlsConfig, err := opts.TLS.Build(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generator TLS config: %w", err)
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c := &Client{
+		baseURL: strings.TrimSuffix(opts.URL, "/") + api.Prefix,
+		http:    &http.Client{Transport: transport, Timeout: timeout},
+	}
+	if opts.Token.IsSet() {
+		c.token = opts.Token.Source()
+	}
+	return c, nil
+}
+
+// Start starts a run and returns its ID
+func (c *Client) Start(ctx context.Context, config TestConfig) (string, error) {
+	var resp startResponse
+	if err := c.do(ctx, http.MethodPost, "/start", nil, config, &resp); err != nil {
+		return "", err
+	}
+	return resp.RunID, nil
+}
+
+// Stop stops a run started by the generator, or every run still generating if runID is empty
+func (c *Client) Stop(ctx context.Context, runID string) error {
+	if runID == "" {
+		return c.do(ctx, http.MethodPost, "/stop", nil, nil, nil)
+	}
+	return c.do(ctx, http.MethodPost, "/runs/"+url.PathEscape(runID)+"/stop", nil, nil, nil)
+}
+
+// Status reports a run's progress, defaulting to the most recently started run if runID is empty
+func (c *Client) Status(ctx context.Context, runID string) (*TestStatus, error) {
+	var status TestStatus
+	if err := c.do(ctx, http.MethodGet, "/status", runQuery(runID), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Metrics reports a run's counts, defaulting to the most recently started run if runID is empty
+func (c *Client) Metrics(ctx context.Context, runID string) (*TestMetrics, error) {
+	var metrics TestMetrics
+	if err := c.do(ctx, http.MethodGet, "/metrics", runQuery(runID), nil, &metrics); err != nil {
+		return nil, err
+	}
+	return &metrics, nil
+}
+
+// Runs lists up to limit past runs, most recent first; limit 0 uses the server's default
+func (c *Client) Runs(ctx context.Context, limit int) ([]redis.RunRecord, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var runs []redis.RunRecord
+	if err := c.do(ctx, http.MethodGet, "/runs", query, nil, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// Run returns a run record; "current" names the most recently started run
+func (c *Client) Run(ctx context.Context, runID string) (*redis.RunRecord, error) {
+	var run redis.RunRecord
+	if err := c.do(ctx, http.MethodGet, "/runs/"+url.PathEscape(runID), nil, nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// Compare compares the config and metrics of two runs
+func (c *Client) Compare(ctx context.Context, base, other string) (*RunComparison, error) {
+	var cmp RunComparison
+	path := "/runs/" + url.PathEscape(base) + "/compare/" + url.PathEscape(other)
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &cmp); err != nil {
+		return nil, err
+	}
+	return &cmp, nil
+}
+
+// Verify reports missing and duplicate sequence numbers for a run
+func (c *Client) Verify(ctx context.Context, runID string) (*redis.Verification, error) {
+	var v redis.Verification
+	if err := c.do(ctx, http.MethodGet, "/runs/"+url.PathEscape(runID)+"/verify", nil, nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Latency returns a run's latency summaries by stage
+func (c *Client) Latency(ctx context.Context, runID string) (map[string]redis.LatencySummary, error) {
+	var latency map[string]redis.LatencySummary
+	if err := c.do(ctx, http.MethodGet, "/runs/"+url.PathEscape(runID)+"/latency", nil, nil, &latency); err != nil {
+		return nil, err
+	}
+	return latency, nil
+}
+
+// Consumers lists registered consumers
+func (c *Client) Consumers(ctx context.Context) ([]redis.ConsumerInfo, error) {
+	var consumers []redis.ConsumerInfo
+	if err := c.do(ctx, http.MethodGet, "/consumers", nil, nil, &consumers); err != nil {
+		return nil, err
+	}
+	return consumers, nil
+}
+
+// PruneConsumers removes consumers without a recent heartbeat and returns their IDs
+func (c *Client) PruneConsumers(ctx context.Context) ([]string, error) {
+	var resp pruneResponse
+	if err := c.do(ctx, http.MethodDelete, "/consumers", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Removed, nil
+}
+
+// RemoveConsumer removes one consumer from the registry
+func (c *Client) RemoveConsumer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/consumers/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// Tenants lists each tenant's settings and usage counters
+func (c *Client) Tenants(ctx context.Context) ([]redis.TenantUsage, error) {
+	var tenants []redis.TenantUsage
+	if err := c.do(ctx, http.MethodGet, "/tenants", nil, nil, &tenants); err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
+
+// ScheduleJob schedules a job to fire at at with payload, generating an ID if id is empty
+func (c *Client) ScheduleJob(ctx context.Context, id, payload string, at time.Time) (*redis.Job, error) {
+	var job redis.Job
+	if err := c.do(ctx, http.MethodPost, "/jobs", nil, jobRequest{ID: id, Payload: payload, At: &at}, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// RescheduleJob moves a scheduled job to fire at at instead
+func (c *Client) RescheduleJob(ctx context.Context, id string, at time.Time) error {
+	return c.do(ctx, http.MethodPatch, "/jobs/"+url.PathEscape(id), nil, jobRequest{At: &at}, nil)
+}
+
+// CancelJob cancels a scheduled job
+func (c *Client) CancelJob(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// Jobs lists up to limit jobs due between from and to, soonest first. Zero times leave that end
+// open, and limit 0 uses the server's default.
+func (c *Client) Jobs(ctx context.Context, from, to time.Time, limit int) ([]redis.Job, error) {
+	query := url.Values{}
+	if !from.IsZero() {
+		query.Set("from", from.Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.Format(time.RFC3339Nano))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var jobs []redis.Job
+	if err := c.do(ctx, http.MethodGet, "/jobs", query, nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func runQuery(runID string) url.Values {
+	if runID == "" {
+		return nil
+	}
+	return url.Values{"run_id": {runID}}
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response into out, if given
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != nil {
+		token, err := c.token()
+		if err != nil {
+			return fmt.Errorf("failed to load generator token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// decodeError turns a failed response into an *api.Error, falling back to the raw body for
+// errors that did not come from the API, e.g. a proxy in between
+func decodeError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	apiErr := &api.Error{}
+	if err := json.Unmarshal(data, apiErr); err != nil || apiErr.Code == "" {
+		apiErr = &api.Error{Code: api.CodeInternal, Message: strings.TrimSpace(string(data))}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	apiErr.Status = resp.StatusCode
+	return apiErr
+}
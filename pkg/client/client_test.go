@@ -0,0 +1,288 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/api"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/secure"
+)
+
+// recorded is a request as the server saw it
+type recorded struct {
+	Method, Path, Query, Body string
+	ContentType, Accept, Auth string
+}
+
+// newServer answers every request with status and body, recording the requests on the returned slice
+func newServer(t *testing.T, status int, body string) (*httptest.Server, *[]recorded) {
+	t.Helper()
+	var reqs []recorded
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		reqs = append(reqs, recorded{
+			Method:      r.Method,
+			Path:        r.URL.EscapedPath(),
+			Query:       r.URL.RawQuery,
+			Body:        string(data),
+			ContentType: r.Header.Get("Content-Type"),
+			Accept:      r.Header.Get("Accept"),
+			Auth:        r.Header.Get("Authorization"),
+		})
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &reqs
+}
+
+func TestRequests(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		response string
+		call     func(c *Client) (interface{}, error)
+		want     recorded
+		wantOut  interface{}
+	}{
+		{
+			name:     "start",
+			response: `{"run_id": "run-1"}`,
+			call: func(c *Client) (interface{}, error) {
+				return c.Start(ctx, TestConfig{NumKeys: 100, KeyTTL: 500, Index: true})
+			},
+			want:    recorded{Method: "POST", Path: "/api/v1/start", Body: `{"num_keys":100,"key_delay":0,"key_ttl":500,"dedup_window":0,"index":true}`},
+			wantOut: "run-1",
+		},
+		{
+			name: "stop every run",
+			call: func(c *Client) (interface{}, error) { return nil, c.Stop(ctx, "") },
+			want: recorded{Method: "POST", Path: "/api/v1/stop"},
+		},
+		{
+			name: "stop one run",
+			call: func(c *Client) (interface{}, error) { return nil, c.Stop(ctx, "team a/run 1") },
+			want: recorded{Method: "POST", Path: "/api/v1/runs/team%20a%2Frun%201/stop"},
+		},
+		{
+			name:     "status of the latest run",
+			response: `{"run_id": "run-1", "is_running": true, "generated": 10, "state": "generating"}`,
+			call:     func(c *Client) (interface{}, error) { return c.Status(ctx, "") },
+			want:     recorded{Method: "GET", Path: "/api/v1/status"},
+			wantOut:  &TestStatus{RunID: "run-1", IsRunning: true, Generated: 10, State: "generating"},
+		},
+		{
+			name:     "metrics of a run",
+			response: `{"run_id": "run-1", "generated": 10, "consumed": 9, "consumers": {"c1": 9}}`,
+			call:     func(c *Client) (interface{}, error) { return c.Metrics(ctx, "run-1") },
+			want:     recorded{Method: "GET", Path: "/api/v1/metrics", Query: "run_id=run-1"},
+			wantOut:  &TestMetrics{RunID: "run-1", Generated: 10, Consumed: 9, Consumers: map[string]int64{"c1": 9}},
+		},
+		{
+			name:     "runs",
+			response: `[{"id": "run-2"}, {"id": "run-1"}]`,
+			call:     func(c *Client) (interface{}, error) { return c.Runs(ctx, 2) },
+			want:     recorded{Method: "GET", Path: "/api/v1/runs", Query: "limit=2"},
+			wantOut:  []redis.RunRecord{{ID: "run-2"}, {ID: "run-1"}},
+		},
+		{
+			name:     "compare",
+			response: `{"delta": {"generated": 5}}`,
+			call:     func(c *Client) (interface{}, error) { return c.Compare(ctx, "run-1", "run-2") },
+			want:     recorded{Method: "GET", Path: "/api/v1/runs/run-1/compare/run-2"},
+			wantOut:  &RunComparison{Delta: MetricsDelta{Generated: 5}},
+		},
+		{
+			name:     "prune consumers",
+			response: `{"removed": ["c1"]}`,
+			call:     func(c *Client) (interface{}, error) { return c.PruneConsumers(ctx) },
+			want:     recorded{Method: "DELETE", Path: "/api/v1/consumers"},
+			wantOut:  []string{"c1"},
+		},
+		{
+			name:     "schedule a job",
+			response: `{"id": "invoice-1", "at": "2030-01-02T15:04:05Z", "payload": "p"}`,
+			call:     func(c *Client) (interface{}, error) { return c.ScheduleJob(ctx, "invoice-1", "p", at) },
+			want:     recorded{Method: "POST", Path: "/api/v1/jobs", Body: `{"id":"invoice-1","payload":"p","at":"2030-01-02T15:04:05Z"}`},
+			wantOut:  &redis.Job{ID: "invoice-1", At: at, Payload: "p"},
+		},
+		{
+			name: "reschedule a job",
+			call: func(c *Client) (interface{}, error) { return nil, c.RescheduleJob(ctx, "invoice-1", at) },
+			want: recorded{Method: "PATCH", Path: "/api/v1/jobs/invoice-1", Body: `{"at":"2030-01-02T15:04:05Z"}`},
+		},
+		{
+			name:     "jobs in a window",
+			response: `[]`,
+			call:     func(c *Client) (interface{}, error) { return c.Jobs(ctx, at, at.Add(time.Hour), 10) },
+			want:     recorded{Method: "GET", Path: "/api/v1/jobs", Query: "from=2030-01-02T15%3A04%3A05Z&limit=10&to=2030-01-02T16%3A04%3A05Z"},
+			wantOut:  []redis.Job{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, reqs := newServer(t, http.StatusOK, tt.response)
+			c, err := NewClient(srv.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := tt.call(c)
+			if err != nil {
+				t.Fatalf("call failed: %v", err)
+			}
+			if len(*reqs) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(*reqs))
+			}
+			got := (*reqs)[0]
+			if got.Accept != "application/json" {
+				t.Errorf("Accept %q, want application/json", got.Accept)
+			}
+			if (got.Body != "") != (got.ContentType == "application/json") {
+				t.Errorf("Content-Type %q with body %q", got.ContentType, got.Body)
+			}
+			got.Accept, got.ContentType = "", ""
+			if got != tt.want {
+				t.Errorf("sent %+v, want %+v", got, tt.want)
+			}
+			if tt.wantOut != nil && !reflect.DeepEqual(out, tt.wantOut) {
+				t.Errorf("returned %#v, want %#v", out, tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   api.Error
+	}{
+		{
+			name:   "API error",
+			status: http.StatusNotFound,
+			body:   `{"code": "not_found", "message": "Run run-9 not found"}`,
+			want:   api.Error{Status: 404, Code: api.CodeNotFound, Message: "Run run-9 not found"},
+		},
+		{
+			name:   "API error with details",
+			status: http.StatusBadRequest,
+			body:   `{"code": "invalid_config", "message": "Invalid config", "details": [{"field": "num_keys"}]}`,
+			want: api.Error{Status: 400, Code: api.CodeInvalidConfig, Message: "Invalid config",
+				Details: []interface{}{map[string]interface{}{"field": "num_keys"}}},
+		},
+		{
+			name:   "plain text from a proxy",
+			status: http.StatusBadGateway,
+			body:   "upstream connect error\n",
+			want:   api.Error{Status: 502, Code: api.CodeInternal, Message: "upstream connect error"},
+		},
+		{
+			name:   "JSON without a code",
+			status: http.StatusInternalServerError,
+			body:   `{"error": "boom"}`,
+			want:   api.Error{Status: 500, Code: api.CodeInternal, Message: `{"error": "boom"}`},
+		},
+		{
+			name:   "empty body",
+			status: http.StatusServiceUnavailable,
+			want:   api.Error{Status: 503, Code: api.CodeInternal, Message: "Service Unavailable"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newServer(t, tt.status, tt.body)
+			c, err := NewClient(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.Status(context.Background(), "")
+			var apiErr *api.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Status() = %v, want an *api.Error", err)
+			}
+			if !reflect.DeepEqual(*apiErr, tt.want) {
+				t.Errorf("Status() = %#v, want %#v", *apiErr, tt.want)
+			}
+		})
+	}
+
+	srv, _ := newServer(t, http.StatusOK, "not json")
+	c, _ := NewClient(srv.URL)
+	if _, err := c.Status(context.Background(), ""); err == nil || !strings.Contains(err.Error(), "failed to decode GET /status response") {
+		t.Errorf("Status() of a malformed response = %v, want a decode error", err)
+	}
+	if _, err := NewClient(""); err == nil {
+		t.Error("NewClient(\"\") succeeded")
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	srv, reqs := newServer(t, http.StatusOK, `{}`)
+	ctx := context.Background()
+
+	c, _ := NewClient(srv.URL)
+	c.Status(ctx, "")
+	c2, _ := NewClientWithOptions(Options{URL: srv.URL, Token: secure.Secret{Value: "inline-token"}})
+	c2.Status(ctx, "")
+
+	path := filepath.Join(t.TempDir(), "token")
+	now := time.Now()
+	write := func(token string, at time.Time) {
+		if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first", now)
+	c3, _ := NewClientWithOptions(Options{URL: srv.URL, Token: secure.Secret{File: path}})
+	c3.Status(ctx, "")
+	write("second", now.Add(time.Second))
+	c3.Status(ctx, "")
+
+	var got []string
+	for _, r := range *reqs {
+		got = append(got, r.Auth)
+	}
+	want := []string{"", "Bearer inline-token", "Bearer first", "Bearer second"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent Authorization %q, want %q", got, want)
+	}
+
+	missing, _ := NewClientWithOptions(Options{URL: srv.URL, Token: secure.Secret{File: filepath.Join(t.TempDir(), "none")}})
+	if _, err := missing.Status(ctx, ""); err == nil || !strings.Contains(err.Error(), "failed to load generator token") {
+		t.Errorf("Status() with a missing token file = %v, want a load error", err)
+	}
+	if len(*reqs) != len(want) {
+		t.Errorf("a request was sent without its token")
+	}
+}
+
+// The API's JSON errors decode into the same fields the server writes
+func TestErrorRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.WriteError(w, http.StatusNotFound, api.CodeNotFound, "Run run-1 not found")
+	}))
+	defer srv.Close()
+	c, _ := NewClient(srv.URL)
+	_, err := c.Run(context.Background(), "run-1")
+	var apiErr *api.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound || apiErr.Code != api.CodeNotFound {
+		data, _ := json.Marshal(apiErr)
+		t.Errorf("Run() = %v (%s), want a 404 not found", err, data)
+	}
+}
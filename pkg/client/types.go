@@ -0,0 +1,83 @@
+package client
+
+import (
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// TestConfig configures a run started with Client.Start. Durations are milliseconds.
+type TestConfig struct {
+	NumKeys      int64                     `json:"num_keys"`
+	KeyDelay     int64                     `json:"key_delay"`
+	KeyTTL       int64                     `json:"key_ttl"`
+	DedupWindow  int64                     `json:"dedup_window"`
+	QuietPeriod  int64                     `json:"quiet_period,omitempty"`
+	DrainTimeout int64                     `json:"drain_timeout,omitempty"`
+	Profile      *pipeline.LoadProfile     `json:"profile,omitempty"`
+	TTL          *pipeline.TTLDistribution `json:"ttl_distribution,omitempty"`
+	Duplicates   *pipeline.DuplicateConfig `json:"duplicates,omitempty"`
+	BatchSize    int                       `json:"batch_size,omitempty"`
+	Workers      int                       `json:"workers,omitempty"`
+	Tenant       string                    `json:"tenant,omitempty"` // prefixes the run ID
+	Shadow       bool                      `json:"shadow,omitempty"` // records each key's value for capture
+	Index        bool                      `json:"index,omitempty"`  // adds each key to the deadline index for polling
+}
+
+// TestStatus is a run's progress and state
+type TestStatus struct {
+	RunID      string            `json:"run_id"`
+	IsRunning  bool              `json:"is_running"`
+	Generated  int64             `json:"generated"`
+	Consumed   int64             `json:"consumed"`
+	ActiveRuns []string          `json:"active_runs"`
+	State      string            `json:"state"`
+	Outcome    *redis.RunOutcome `json:"outcome,omitempty"`
+}
+
+// TestMetrics is a run's generated, consumed and per-consumer counts
+type TestMetrics struct {
+	RunID     string           `json:"run_id"`
+	Generated int64            `json:"generated"`
+	Consumed  int64            `json:"consumed"`
+	Consumers map[string]int64 `json:"consumers"`
+	Stale     []string         `json:"stale_consumers"`
+}
+
+// ConfigChange is a test parameter that differs between two runs
+type ConfigChange struct {
+	Field string      `json:"field"`
+	Base  interface{} `json:"base"`
+	Other interface{} `json:"other"`
+}
+
+// MetricsDelta is the difference between two runs' metrics (other minus base)
+type MetricsDelta struct {
+	Generated     int64   `json:"generated"`
+	Consumed      int64   `json:"consumed"`
+	ConsumedRatio float64 `json:"consumed_ratio"`
+	Consumers     int     `json:"consumers"`
+}
+
+// RunComparison compares the config and metrics of two runs
+type RunComparison struct {
+	Base          *redis.RunRecord `json:"base"`
+	Other         *redis.RunRecord `json:"other"`
+	ConfigChanges []ConfigChange   `json:"config_changes"`
+	Delta         MetricsDelta     `json:"delta"`
+}
+
+type startResponse struct {
+	RunID string `json:"run_id"`
+}
+
+type pruneResponse struct {
+	Removed []string `json:"removed"`
+}
+
+type jobRequest struct {
+	ID      string     `json:"id,omitempty"`
+	Payload string     `json:"payload,omitempty"`
+	At      *time.Time `json:"at,omitempty"`
+}
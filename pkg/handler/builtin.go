@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// MetricsRecorder records consumption metrics for processed events
+type MetricsRecorder interface {
+	IncrementConsumerMetric(ctx context.Context, runID, consumerID string) error
+	IncrementConsumed(ctx context.Context, runID string) error
+}
+
+// LedgerRecorder records each consumed key for exactly-once verification
+type LedgerRecorder interface {
+	RecordConsumption(ctx context.Context, key, consumerID string) (bool, error)
+}
+
+// LatencyRecorder records latency samples for a pipeline stage
+type LatencyRecorder interface {
+	RecordLatency(ctx context.Context, runID, stage string, d time.Duration) error
+}
+
+// Log returns a handler that logs each event
+func Log() Handler {
+	return HandlerFunc(func(ctx context.Context, evt *Event) error {
+		log.Printf("Consumer %s processing deduplicated key: %s", evt.ConsumerID, evt.Key)
+		return nil
+	})
+}
+
+// Metrics returns a handler that increments the consumed and per-consumer metrics of the event's run.
+// Metric failures are logged but do not trigger redelivery, matching counters being best effort.
+func Metrics(recorder MetricsRecorder) Handler {
+	return HandlerFunc(func(ctx context.Context, evt *Event) error {
+		// Increment consumer-specific metric
+		if err := recorder.IncrementConsumerMetric(ctx, evt.RunID, evt.ConsumerID); err != nil {
+			log.Printf("Failed to increment consumer metric: %v", err)
+		}
+		// Increment consumed metric
+		if err := recorder.IncrementConsumed(ctx, evt.RunID); err != nil {
+			log.Printf("Failed to increment consumed metric: %v", err)
+		}
+		return nil
+	})
+}
+
+// Ledger returns a handler that records each consumed key in the run's verification ledger.
+// Duplicates are logged and counted in the ledger but still acknowledged.
+func Ledger(recorder LedgerRecorder) Handler {
+	return HandlerFunc(func(ctx context.Context, evt *Event) error {
+		duplicate, err := recorder.RecordConsumption(ctx, evt.Key, evt.ConsumerID)
+		if err != nil {
+			log.Printf("Failed to record consumption of %s: %v", evt.Key, err)
+			return nil
+		}
+		if duplicate {
+			log.Printf("Consumer %s received duplicate delivery of key %s", evt.ConsumerID, evt.Key)
+		}
+		return nil
+	})
+}
+
+// Latency returns a handler that records queue latency, from NATS publish to handler receipt
+func Latency(recorder LatencyRecorder, stage string) Handler {
+	return HandlerFunc(func(ctx context.Context, evt *Event) error {
+		if evt.Published.IsZero() {
+			return nil
+		}
+		if err := recorder.RecordLatency(ctx, evt.RunID, stage, evt.ReceivedAt.Sub(evt.Published)); err != nil {
+			log.Printf("Failed to record %s latency: %v", stage, err)
+		}
+		return nil
+	})
+}
+
+// HTTPForward returns a handler that POSTs the event as JSON to url.
+// Any non-2xx response is treated as a failure.
+func HTTPForward(url string, timeout time.Duration) Handler {
+	client := &http.Client{Timeout: timeout}
+	return HandlerFunc(func(ctx context.Context, evt *Event) error {
+		body, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to forward event: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("forward to %s returned status %d", url, resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+// Exec returns a handler that runs command for each event.
+// The event is passed as JSON on stdin and as EVENT_* environment variables.
+// A non-zero exit status is treated as a failure.
+func Exec(command []string, timeout time.Duration) Handler {
+	return HandlerFunc(func(ctx context.Context, evt *Event) error {
+		if len(command) == 0 {
+			return fmt.Errorf("exec handler has no command")
+		}
+
+		body, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"EVENT_KEY="+evt.Key,
+			"EVENT_VALUE="+evt.Value,
+			"EVENT_RUN_ID="+evt.RunID,
+			"EVENT_TENANT="+evt.Tenant,
+			"EVENT_SUBJECT="+evt.Subject,
+			"EVENT_CONSUMER_ID="+evt.ConsumerID,
+			"EVENT_NUM_DELIVERED="+strconv.FormatUint(evt.NumDelivered, 10),
+		)
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("command %s failed: %w (output: %s)", command[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	})
+}
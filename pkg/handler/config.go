@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	TypeLog     = "log"
+	TypeMetrics = "metrics"
+	TypeLedger  = "ledger"
+	TypeLatency = "latency"
+	TypeHTTP    = "http"
+	TypeExec    = "exec"
+
+	defaultHandlerTimeout = 5 * time.Second
+)
+
+// Spec describes a single handler in the consumer configuration
+type Spec struct {
+	Type    string   `json:"type"`
+	Pattern string   `json:"pattern"`
+	URL     string   `json:"url,omitempty"`     // http
+	Command []string `json:"command,omitempty"` // exec
+	Timeout string   `json:"timeout,omitempty"` // http, exec (e.g. "5s")
+}
+
+// Config lists the handlers a consumer composes, in execution order
+type Config struct {
+	Handlers []Spec `json:"handlers"`
+}
+
+// Recorder is the store used by the metrics, ledger and latency handlers
+type Recorder interface {
+	MetricsRecorder
+	LedgerRecorder
+	LatencyRecorder
+}
+
+// WithMetrics returns recorder with its metrics recorded through metrics instead,
+// e.g. a local aggregator that batches increments
+func WithMetrics(recorder Recorder, metrics MetricsRecorder) Recorder {
+	return metricsOverride{Recorder: recorder, metrics: metrics}
+}
+
+type metricsOverride struct {
+	Recorder
+	metrics MetricsRecorder
+}
+
+func (m metricsOverride) IncrementConsumerMetric(ctx context.Context, runID, consumerID string) error {
+	return m.metrics.IncrementConsumerMetric(ctx, runID, consumerID)
+}
+
+func (m metricsOverride) IncrementConsumed(ctx context.Context, runID string) error {
+	return m.metrics.IncrementConsumed(ctx, runID)
+}
+
+// DefaultConfig returns the built-in log, metrics, ledger and latency handlers for all keys
+func DefaultConfig() *Config {
+	return &Config{
+		Handlers: []Spec{
+			{Type: TypeLog, Pattern: "*"},
+			{Type: TypeMetrics, Pattern: "*"},
+			{Type: TypeLedger, Pattern: "*"},
+			{Type: TypeLatency, Pattern: "*"},
+		},
+	}
+}
+
+// LoadConfig reads a JSON handler configuration from path
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handler config: %w", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse handler config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Build creates a registry with the configured handlers
+func (c *Config) Build(recorder Recorder) (*Registry, error) {
+	reg := NewRegistry()
+	for i, spec := range c.Handlers {
+		h, err := spec.build(recorder)
+		if err != nil {
+			return nil, fmt.Errorf("handler %d: %w", i, err)
+		}
+
+		pattern := spec.Pattern
+		if pattern == "" {
+			pattern = "*"
+		}
+		if err := reg.Register(pattern, spec.Type, h); err != nil {
+			return nil, fmt.Errorf("handler %d: %w", i, err)
+		}
+	}
+	return reg, nil
+}
+
+func (s Spec) build(recorder Recorder) (Handler, error) {
+	timeout := defaultHandlerTimeout
+	if s.Timeout != "" {
+		d, err := time.ParseDuration(s.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %w", s.Timeout, err)
+		}
+		timeout = d
+	}
+
+	switch s.Type {
+	case TypeLog:
+		return Log(), nil
+	case TypeMetrics:
+		if recorder == nil {
+			return nil, fmt.Errorf("metrics handler requires a metrics recorder")
+		}
+		return Metrics(recorder), nil
+	case TypeLedger:
+		if recorder == nil {
+			return nil, fmt.Errorf("ledger handler requires a recorder")
+		}
+		return Ledger(recorder), nil
+	case TypeLatency:
+		if recorder == nil {
+			return nil, fmt.Errorf("latency handler requires a recorder")
+		}
+		return Latency(recorder, redis.StageQueue), nil
+	case TypeHTTP:
+		if s.URL == "" {
+			return nil, fmt.Errorf("http handler requires a url")
+		}
+		return HTTPForward(s.URL, timeout), nil
+	case TypeExec:
+		if len(s.Command) == 0 {
+			return nil, fmt.Errorf("exec handler requires a command")
+		}
+		return Exec(s.Command, timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown handler type %q", s.Type)
+	}
+}
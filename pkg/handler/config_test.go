@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// countingRecorder counts the metrics a chain records and the keys and latency stages it records
+type countingRecorder struct {
+	consumed  map[string]int // by run
+	consumers map[string]int
+	ledger    []string
+	stages    []string
+}
+
+func (r *countingRecorder) IncrementConsumerMetric(ctx context.Context, runID, consumerID string) error {
+	if r.consumers == nil {
+		r.consumers = make(map[string]int)
+	}
+	r.consumers[consumerID]++
+	return nil
+}
+
+func (r *countingRecorder) IncrementConsumed(ctx context.Context, runID string) error {
+	if r.consumed == nil {
+		r.consumed = make(map[string]int)
+	}
+	r.consumed[runID]++
+	return nil
+}
+
+func (r *countingRecorder) RecordConsumption(ctx context.Context, key, consumerID string) (bool, error) {
+	r.ledger = append(r.ledger, key)
+	return false, nil
+}
+
+func (r *countingRecorder) RecordLatency(ctx context.Context, runID, stage string, d time.Duration) error {
+	r.stages = append(r.stages, stage)
+	return nil
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		data    string
+		want    *Config
+		wantErr string
+	}{
+		{
+			name: "handlers in order",
+			data: `{"handlers": [
+				{"type": "log", "pattern": "gen-key:*"},
+				{"type": "http", "pattern": "*", "url": "http://localhost:9000/events", "timeout": "2s"},
+				{"type": "exec", "command": ["./notify.sh", "-v"]}
+			]}`,
+			want: &Config{Handlers: []Spec{
+				{Type: TypeLog, Pattern: "gen-key:*"},
+				{Type: TypeHTTP, Pattern: "*", URL: "http://localhost:9000/events", Timeout: "2s"},
+				{Type: TypeExec, Command: []string{"./notify.sh", "-v"}},
+			}},
+		},
+		{name: "no handlers", data: `{}`, want: &Config{}},
+		{name: "malformed", data: `{"handlers": [`, wantErr: "failed to parse handler config"},
+		{name: "missing file", wantErr: "failed to read handler config"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "missing.json")
+			if tt.data != "" {
+				path = filepath.Join(dir, strings.Repeat("c", i+1)+".json")
+				if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg, err := LoadConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() failed: %v", err)
+			}
+			if !reflect.DeepEqual(cfg, tt.want) {
+				t.Errorf("LoadConfig() = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		specs    []Spec
+		recorder Recorder
+		wantLen  int
+		wantErr  string
+	}{
+		{name: "default chain", specs: DefaultConfig().Handlers, recorder: &countingRecorder{}, wantLen: 4},
+		{name: "empty pattern matches every key", specs: []Spec{{Type: TypeLog}}, wantLen: 1},
+		{name: "http", specs: []Spec{{Type: TypeHTTP, URL: "http://localhost:9000", Timeout: "250ms"}}, wantLen: 1},
+		{name: "exec", specs: []Spec{{Type: TypeExec, Command: []string{"true"}}}, wantLen: 1},
+		{name: "unknown type", specs: []Spec{{Type: TypeLog}, {Type: "kafka"}}, wantErr: `handler 1: unknown handler type "kafka"`},
+		{name: "missing type", specs: []Spec{{Pattern: "*"}}, wantErr: `unknown handler type ""`},
+		{name: "http without a url", specs: []Spec{{Type: TypeHTTP}}, wantErr: "http handler requires a url"},
+		{name: "exec without a command", specs: []Spec{{Type: TypeExec}}, wantErr: "exec handler requires a command"},
+		{name: "metrics without a recorder", specs: []Spec{{Type: TypeMetrics}}, wantErr: "metrics handler requires a metrics recorder"},
+		{name: "ledger without a recorder", specs: []Spec{{Type: TypeLedger}}, wantErr: "ledger handler requires a recorder"},
+		{name: "latency without a recorder", specs: []Spec{{Type: TypeLatency}}, wantErr: "latency handler requires a recorder"},
+		{name: "invalid timeout", specs: []Spec{{Type: TypeHTTP, URL: "http://localhost:9000", Timeout: "soon"}}, wantErr: `invalid timeout "soon"`},
+		{name: "invalid pattern", specs: []Spec{{Type: TypeLog, Pattern: "gen-key:["}}, wantErr: `invalid key pattern "gen-key:["`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, err := (&Config{Handlers: tt.specs}).Build(tt.recorder)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Build() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() failed: %v", err)
+			}
+			if reg.Len() != tt.wantLen {
+				t.Errorf("Build() registered %d handlers, want %d", reg.Len(), tt.wantLen)
+			}
+		})
+	}
+}
+
+// The default chain logs, counts and records every event, and times the queue stage of published ones
+func TestDefaultChain(t *testing.T) {
+	recorder := &countingRecorder{}
+	reg, err := DefaultConfig().Build(recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []*Event{
+		{Key: "gen-key:run-1:1", RunID: "run-1", ConsumerID: "consumer-1", Published: time.Now()},
+		{Key: "other", RunID: "run-1", ConsumerID: "consumer-1"},
+	}
+	for _, evt := range events {
+		if err := reg.Dispatch(context.Background(), evt); err != nil {
+			t.Fatalf("Dispatch(%s) failed: %v", evt.Key, err)
+		}
+	}
+	if recorder.consumed["run-1"] != 2 || recorder.consumers["consumer-1"] != 2 {
+		t.Errorf("recorded %v consumed and %v per consumer, want 2 each", recorder.consumed, recorder.consumers)
+	}
+	if want := []string{"gen-key:run-1:1", "other"}; !reflect.DeepEqual(recorder.ledger, want) {
+		t.Errorf("ledger recorded %v, want %v", recorder.ledger, want)
+	}
+	if want := []string{redis.StageQueue}; !reflect.DeepEqual(recorder.stages, want) {
+		t.Errorf("recorded latency for %v, want %v", recorder.stages, want)
+	}
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// Event is the envelope passed to handlers for each deduplicated expiration event
+type Event struct {
+	Key          string            `json:"key"`
+	Value        string            `json:"value,omitempty"`  // captured from the key's shadow, if values are captured
+	Fields       map[string]string `json:"fields,omitempty"` // the shadow's other fields
+	RunID        string            `json:"run_id,omitempty"` // test run the key belongs to, if any
+	Tenant       string            `json:"tenant,omitempty"` // tenant the key was resolved to
+	Subject      string            `json:"subject"`
+	ConsumerID   string            `json:"consumer_id"`
+	NumDelivered uint64            `json:"num_delivered"`
+	Published    time.Time         `json:"published"`
+	ReceivedAt   time.Time         `json:"received_at"`
+}
+
+// Handler processes a single event. A non-nil error causes the event to be redelivered.
+type Handler interface {
+	Handle(ctx context.Context, evt *Event) error
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(ctx context.Context, evt *Event) error
+
+// Handle calls f(ctx, evt)
+func (f HandlerFunc) Handle(ctx context.Context, evt *Event) error {
+	return f(ctx, evt)
+}
+
+type route struct {
+	pattern string
+	name    string
+	handler Handler
+}
+
+// Registry routes events to handlers registered by key pattern.
+// Patterns use path.Match syntax, e.g. "gen-key:*" or "*".
+type Registry struct {
+	mu     sync.RWMutex
+	routes []route
+}
+
+// NewRegistry creates an empty handler registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a handler for keys matching pattern. Handlers run in registration order.
+func (r *Registry) Register(pattern, name string, h Handler) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append(r.routes, route{pattern: pattern, name: name, handler: h})
+	return nil
+}
+
+// Dispatch runs every handler whose pattern matches the event key.
+// It stops at the first handler error so the whole chain is retried on redelivery.
+func (r *Registry) Dispatch(ctx context.Context, evt *Event) error {
+	r.mu.RLock()
+	routes := r.routes
+	r.mu.RUnlock()
+
+	for _, rt := range routes {
+		if ok, _ := path.Match(rt.pattern, evt.Key); !ok {
+			continue
+		}
+		if err := rt.handler.Handle(ctx, evt); err != nil {
+			return fmt.Errorf("handler %s failed for key %s: %w", rt.name, evt.Key, err)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of registered handlers
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.routes)
+}
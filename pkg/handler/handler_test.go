@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDispatch(t *testing.T) {
+	var ran []string
+	handle := func(name string, err error) Handler {
+		return HandlerFunc(func(ctx context.Context, evt *Event) error {
+			ran = append(ran, name)
+			return err
+		})
+	}
+	reg := NewRegistry()
+	reg.Register("*", "all", handle("all", nil))
+	reg.Register("gen-key:*", "generated", handle("generated", nil))
+	reg.Register("job:*", "failing", handle("failing", errors.New("unavailable")))
+	reg.Register("*", "last", handle("last", nil))
+
+	tests := []struct {
+		key     string
+		want    []string
+		wantErr string
+	}{
+		{key: "gen-key:run-1:1", want: []string{"all", "generated", "last"}},
+		{key: "other", want: []string{"all", "last"}},
+		{key: "job:invoice-1", want: []string{"all", "failing"}, wantErr: "handler failing failed for key job:invoice-1: unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			ran = nil
+			err := reg.Dispatch(context.Background(), &Event{Key: tt.key})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Dispatch() failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Dispatch() = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(ran, tt.want) {
+				t.Errorf("ran %v, want %v", ran, tt.want)
+			}
+		})
+	}
+}
@@ -2,10 +2,17 @@ package nats
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/secure"
 )
 
 const (
@@ -19,18 +26,51 @@ type Client struct {
 	js nats.JetStreamContext
 }
 
-// initStream creates the stream if it doesn't exist
+// Delivery describes a single expired key event delivered from the stream
+type Delivery struct {
+	Key          string
+	Value        string            // captured from the key's shadow, empty if it had none
+	Fields       map[string]string // the shadow's other fields
+	Subject      string
+	NumDelivered uint64
+	Published    time.Time
+}
+
+// ExpiredEvent is the body of an event carrying a value captured from the key's shadow.
+// Events without one carry only the key name.
+type ExpiredEvent struct {
+	Key    string            `json:"key"`
+	Value  string            `json:"value"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// contentTypeJSON marks a message whose body is an ExpiredEvent
+const contentTypeJSON = "application/json"
+
+// TenantSubjects matches every per-tenant subject, which the stream also captures
+const TenantSubjects = Subject + ".>"
+
+// initStream creates the stream if it doesn't exist, and adds the tenant subjects to a
+// stream created before tenants existed
 func (c *Client) initStream() error {
 	// Check if stream exists
 	stream, err := c.js.StreamInfo(StreamName)
 	if err == nil && stream != nil {
-		return nil // Stream already exists
+		if slices.Contains(stream.Config.Subjects, TenantSubjects) {
+			return nil // Stream already exists
+		}
+		cfg := stream.Config
+		cfg.Subjects = append(cfg.Subjects, TenantSubjects)
+		if _, err := c.js.UpdateStream(&cfg); err != nil {
+			return fmt.Errorf("failed to add tenant subjects to stream: %w", err)
+		}
+		return nil
 	}
 
 	// Create stream with WorkQueue retention
 	_, err = c.js.AddStream(&nats.StreamConfig{
 		Name:      StreamName,
-		Subjects:  []string{Subject},
+		Subjects:  []string{Subject, TenantSubjects},
 		Retention: nats.WorkQueuePolicy,
 		Storage:   nats.MemoryStorage,
 		MaxAge:    24 * time.Hour,
@@ -42,9 +82,91 @@ func (c *Client) initStream() error {
 	return nil
 }
 
+// Options configures the connection to NATS. Credentials files and secrets are re-read on
+// every (re)connect, so rotated files take effect without a restart.
+type Options struct {
+	URL          string
+	User         secure.Secret
+	Password     secure.Secret
+	Token        secure.Secret
+	CredsFile    string // JWT + NKey chained credentials file
+	NKeySeedFile string // NKey seed file, signed on each connect
+	TLS          secure.TLSConfig
+}
+
+// OptionsFromEnv returns options for url with credentials and TLS read from NATS_USER,
+// NATS_PASSWORD, NATS_TOKEN (or their _FILE variants), NATS_CREDS_FILE, NATS_NKEY_SEED_FILE and NATS_TLS_*
+func OptionsFromEnv(url string) Options {
+	return Options{
+		URL:          url,
+		User:         secure.SecretFromEnv("NATS_USER"),
+		Password:     secure.SecretFromEnv("NATS_PASSWORD"),
+		Token:        secure.SecretFromEnv("NATS_TOKEN"),
+		CredsFile:    os.Getenv("NATS_CREDS_FILE"),
+		NKeySeedFile: os.Getenv("NATS_NKEY_SEED_FILE"),
+		TLS:          secure.TLSFromEnv("NATS"),
+	}
+}
+
+// connectOptions translates opts into nats.go connect options
+func (o Options) connectOptions() ([]nats.Option, error) {
+	var natsOpts []nats.Option
+
+	tlsConfig, err := o.TLS.Build(o.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS TLS config: %w", err)
+	}
+	if tlsConfig != nil {
+		natsOpts = append(natsOpts, nats.Secure(tlsConfig))
+	}
+
+	switch {
+	case o.CredsFile != "":
+		natsOpts = append(natsOpts, nats.UserCredentials(o.CredsFile))
+	case o.NKeySeedFile != "":
+		opt, err := nats.NkeyOptionFromSeed(o.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load NKey seed: %w", err)
+		}
+		natsOpts = append(natsOpts, opt)
+	case o.Token.IsSet():
+		token := o.Token.Source()
+		natsOpts = append(natsOpts, nats.TokenHandler(func() string {
+			t, err := token()
+			if err != nil {
+				log.Printf("Failed to load NATS token: %v", err)
+			}
+			return t
+		}))
+	case o.User.IsSet() || o.Password.IsSet():
+		user, password := o.User.Source(), o.Password.Source()
+		natsOpts = append(natsOpts, nats.UserInfoHandler(func() (string, string) {
+			u, err := user()
+			if err != nil {
+				log.Printf("Failed to load NATS user: %v", err)
+			}
+			p, err := password()
+			if err != nil {
+				log.Printf("Failed to load NATS password: %v", err)
+			}
+			return u, p
+		}))
+	}
+	return natsOpts, nil
+}
+
 // NewClient creates a new NATS client with JetStream enabled
 func NewClient(url string) (*Client, error) {
-	nc, err := nats.Connect(url)
+	return NewClientWithOptions(Options{URL: url})
+}
+
+// NewClientWithOptions creates a new NATS client with JetStream enabled, authentication and TLS
+func NewClientWithOptions(opts Options) (*Client, error) {
+	natsOpts, err := opts.connectOptions()
+	if err != nil {
+		return nil, err
+	}
+	nc, err := nats.Connect(opts.URL, natsOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
 	}
@@ -71,11 +193,30 @@ func NewClient(url string) (*Client, error) {
 
 // PublishExpiredKey publishes an expired key event to the stream
 func (c *Client) PublishExpiredKey(ctx context.Context, key string) error {
-	msg := &nats.Msg{
-		Subject: Subject,
+	return c.PublishExpiredKeyTo(ctx, Subject, key)
+}
+
+// PublishExpiredKeyTo publishes an expired key event on a tenant subject of the stream
+func (c *Client) PublishExpiredKeyTo(ctx context.Context, subject, key string) error {
+	return c.publish(ctx, &nats.Msg{
+		Subject: subject,
 		Data:    []byte(key),
+	})
+}
+
+// PublishExpiredEvent publishes an expired key event with its captured value on a subject of the stream
+func (c *Client) PublishExpiredEvent(ctx context.Context, subject string, evt ExpiredEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("failed to encode event for %s: %w", evt.Key, err)
 	}
+	msg := nats.NewMsg(subject)
+	msg.Header.Set("Content-Type", contentTypeJSON)
+	msg.Data = data
+	return c.publish(ctx, msg)
+}
 
+func (c *Client) publish(ctx context.Context, msg *nats.Msg) error {
 	// Publish with context for timeout control
 	select {
 	case <-ctx.Done():
@@ -89,15 +230,45 @@ func (c *Client) PublishExpiredKey(ctx context.Context, key string) error {
 	}
 }
 
-// SubscribeExpiredKeys subscribes to expired key events using queue groups for even distribution
-func (c *Client) SubscribeExpiredKeys(ctx context.Context, handler func(key string)) error {
+// SubscribeExpiredKeys subscribes to expired key events using queue groups for even distribution.
+// A nil error from the handler acknowledges the message, any other error requests redelivery.
+func (c *Client) SubscribeExpiredKeys(ctx context.Context, handler func(d Delivery) error) error {
+	return c.SubscribeSubject(ctx, Subject, handler)
+}
+
+// SubscribeSubject subscribes to expired key events on one subject of the stream. Each subject
+// has its own queue group, so a backlog on one tenant's subject does not delay the others.
+func (c *Client) SubscribeSubject(ctx context.Context, subject string, handler func(d Delivery) error) error {
 	// Create a consumer with queue group for even distribution
 	_, err := c.js.QueueSubscribe(
-		Subject,
-		QueueGroup,
+		subject,
+		queueGroup(subject),
 		func(msg *nats.Msg) {
+			d := Delivery{
+				Key:     string(msg.Data),
+				Subject: msg.Subject,
+			}
+			if msg.Header.Get("Content-Type") == contentTypeJSON {
+				var evt ExpiredEvent
+				if err := json.Unmarshal(msg.Data, &evt); err != nil {
+					// Redelivery cannot fix a malformed body
+					log.Printf("Discarding malformed event on %s: %v", msg.Subject, err)
+					msg.Term()
+					return
+				}
+				d.Key, d.Value, d.Fields = evt.Key, evt.Value, evt.Fields
+			}
+			if meta, err := msg.Metadata(); err == nil {
+				d.NumDelivered = meta.NumDelivered
+				d.Published = meta.Timestamp
+			}
+
 			// Process the message
-			handler(string(msg.Data))
+			if err := handler(d); err != nil {
+				// Negative acknowledgment triggers redelivery up to MaxDeliver
+				msg.Nak()
+				return
+			}
 			// Acknowledge successful processing
 			msg.Ack()
 		},
@@ -121,6 +292,23 @@ func (c *Client) SubscribeExpiredKeys(ctx context.Context, handler func(key stri
 	return nil
 }
 
+// queueGroup names the queue group, and so the durable consumer, of a subject.
+// Durable names cannot contain dots.
+func queueGroup(subject string) string {
+	if subject == Subject {
+		return QueueGroup
+	}
+	return QueueGroup + "_" + strings.ReplaceAll(strings.TrimPrefix(subject, Subject+"."), ".", "_")
+}
+
+// ForceReconnect drops the current server connection and reconnects
+func (c *Client) ForceReconnect() error {
+	if err := c.nc.ForceReconnect(); err != nil {
+		return fmt.Errorf("failed to force reconnect: %w", err)
+	}
+	return nil
+}
+
 // Close closes the NATS connection
 func (c *Client) Close() {
 	if c.nc != nil {
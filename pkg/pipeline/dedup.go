@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultDedupBatchSize = 64
+	DefaultDedupBatchWait = time.Millisecond
+)
+
+// BatchDeduplicator claims several expired keys in one round trip. A Deduplicator that also
+// implements it has concurrent claims micro-batched by the pipeline.
+type BatchDeduplicator interface {
+	CreateDedupKeys(ctx context.Context, originalKeys []string, ttl time.Duration) ([]bool, error)
+}
+
+type dedupResult struct {
+	created bool
+	err     error
+}
+
+type dedupRequest struct {
+	ctx    context.Context
+	key    string
+	ttl    time.Duration
+	result chan dedupResult
+}
+
+// dedupBatcher collects concurrent claims for up to wait, or until size are queued,
+// and sends them to Redis as one pipelined batch
+type dedupBatcher struct {
+	dedup    BatchDeduplicator
+	size     int
+	wait     time.Duration
+	requests chan dedupRequest
+}
+
+func newDedupBatcher(dedup BatchDeduplicator, size int, wait time.Duration) *dedupBatcher {
+	return &dedupBatcher{
+		dedup:    dedup,
+		size:     size,
+		wait:     wait,
+		requests: make(chan dedupRequest, size),
+	}
+}
+
+// CreateDedupKey queues a claim and waits for its batch to be written
+func (b *dedupBatcher) CreateDedupKey(ctx context.Context, originalKey string, ttl time.Duration) (bool, error) {
+	req := dedupRequest{ctx: ctx, key: originalKey, ttl: ttl, result: make(chan dedupResult, 1)}
+	select {
+	case b.requests <- req:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	select {
+	case res := <-req.result:
+		return res.created, res.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// run batches claims until stop is closed. Callers must not queue claims after that.
+func (b *dedupBatcher) run(stop <-chan struct{}) {
+	timer := time.NewTimer(b.wait)
+	timer.Stop()
+	for {
+		var batch []dedupRequest
+		select {
+		case req := <-b.requests:
+			batch = append(batch, req)
+		case <-stop:
+			return
+		}
+
+		timer.Reset(b.wait)
+	collect:
+		for len(batch) < b.size {
+			select {
+			case req := <-b.requests:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		b.flush(batch)
+	}
+}
+
+// flush writes a batch, one round trip per distinct TTL
+func (b *dedupBatcher) flush(batch []dedupRequest) {
+	byTTL := make(map[time.Duration][]dedupRequest)
+	for _, req := range batch {
+		byTTL[req.ttl] = append(byTTL[req.ttl], req)
+	}
+	for ttl, reqs := range byTTL {
+		keys := make([]string, len(reqs))
+		for i, req := range reqs {
+			keys[i] = req.key
+		}
+		// Claims are detached from cancellation like the rest of in-flight expiry handling
+		created, err := b.dedup.CreateDedupKeys(context.WithoutCancel(reqs[0].ctx), keys, ttl)
+		if err == nil && len(created) != len(reqs) {
+			err = fmt.Errorf("dedup batch returned %d results for %d keys", len(created), len(reqs))
+		}
+		for i, req := range reqs {
+			if err != nil {
+				req.result <- dedupResult{err: err}
+			} else {
+				req.result <- dedupResult{created: created[i]}
+			}
+		}
+	}
+}
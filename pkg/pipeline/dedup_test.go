@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBatchDedup claims keys in memory and records every batch it is sent
+type fakeBatchDedup struct {
+	mu      sync.Mutex
+	claimed map[string]bool
+	batches [][]string
+	fail    map[time.Duration]error // batches with this TTL fail
+	short   bool                    // return one result too few
+}
+
+func (f *fakeBatchDedup) CreateDedupKeys(ctx context.Context, keys []string, ttl time.Duration) ([]bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, append([]string(nil), keys...))
+	if err := f.fail[ttl]; err != nil {
+		return nil, err
+	}
+	if f.claimed == nil {
+		f.claimed = make(map[string]bool)
+	}
+	created := make([]bool, len(keys))
+	for i, key := range keys {
+		created[i] = !f.claimed[key]
+		f.claimed[key] = true
+	}
+	if f.short {
+		created = created[1:]
+	}
+	return created, nil
+}
+
+func (f *fakeBatchDedup) batchSizes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sizes := make([]int, len(f.batches))
+	for i, batch := range f.batches {
+		sizes[i] = len(batch)
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+type claim struct {
+	key string
+	ttl time.Duration
+}
+
+type claimResult struct {
+	created bool
+	err     error
+}
+
+// startBatcher runs a batcher until the test ends
+func startBatcher(t *testing.T, dedup BatchDeduplicator, size int, wait time.Duration) *dedupBatcher {
+	t.Helper()
+	b := newDedupBatcher(dedup, size, wait)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.run(stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return b
+}
+
+// claimAll makes the claims concurrently and returns their results in order
+func claimAll(b *dedupBatcher, claims []claim) []claimResult {
+	results := make([]claimResult, len(claims))
+	var wg sync.WaitGroup
+	for i, c := range claims {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			created, err := b.CreateDedupKey(context.Background(), c.key, c.ttl)
+			results[i] = claimResult{created, err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func TestDedupBatcherFlush(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wait      time.Duration
+		claims    []claim
+		wantSizes []int
+	}{
+		{
+			name:      "full batch is sent without waiting",
+			size:      4,
+			wait:      time.Hour,
+			claims:    []claim{{"a", time.Second}, {"b", time.Second}, {"c", time.Second}, {"d", time.Second}},
+			wantSizes: []int{4},
+		},
+		{
+			name:      "partial batch is sent after the wait",
+			size:      64,
+			wait:      10 * time.Millisecond,
+			claims:    []claim{{"a", time.Second}},
+			wantSizes: []int{1},
+		},
+		{
+			name:      "one round trip per TTL",
+			size:      3,
+			wait:      time.Hour,
+			claims:    []claim{{"a", time.Second}, {"b", 2 * time.Second}, {"c", time.Second}},
+			wantSizes: []int{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dedup := &fakeBatchDedup{}
+			b := startBatcher(t, dedup, tt.size, tt.wait)
+			for i, res := range claimAll(b, tt.claims) {
+				if res.err != nil || !res.created {
+					t.Errorf("claim %s = %v, %v; want created", tt.claims[i].key, res.created, res.err)
+				}
+			}
+			if got := dedup.batchSizes(); fmt.Sprint(got) != fmt.Sprint(tt.wantSizes) {
+				t.Errorf("batch sizes %v, want %v", got, tt.wantSizes)
+			}
+		})
+	}
+}
+
+func TestDedupBatcherDuplicateClaims(t *testing.T) {
+	b := startBatcher(t, &fakeBatchDedup{}, 3, time.Hour)
+	created := 0
+	for _, res := range claimAll(b, []claim{{"a", time.Second}, {"a", time.Second}, {"b", time.Second}}) {
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.created {
+			created++
+		}
+	}
+	if created != 2 {
+		t.Errorf("%d claims created, want one for each distinct key", created)
+	}
+}
+
+func TestDedupBatcherFailure(t *testing.T) {
+	// The 1s claims fail while the 2s claims of the same batch go through
+	failure := errors.New("connection reset")
+	b := startBatcher(t, &fakeBatchDedup{fail: map[time.Duration]error{time.Second: failure}}, 4, time.Hour)
+	claims := []claim{{"a", time.Second}, {"b", 2 * time.Second}, {"c", time.Second}, {"d", 2 * time.Second}}
+	for i, res := range claimAll(b, claims) {
+		if claims[i].ttl == time.Second {
+			if !errors.Is(res.err, failure) || res.created {
+				t.Errorf("claim %s = %v, %v; want the batch error", claims[i].key, res.created, res.err)
+			}
+		} else if res.err != nil || !res.created {
+			t.Errorf("claim %s = %v, %v; want created", claims[i].key, res.created, res.err)
+		}
+	}
+
+	// A batch answered with the wrong number of results fails as a whole
+	b = startBatcher(t, &fakeBatchDedup{short: true}, 2, time.Hour)
+	for _, res := range claimAll(b, []claim{{"a", time.Second}, {"b", time.Second}}) {
+		if res.err == nil || !strings.Contains(res.err.Error(), "returned 1 results for 2 keys") {
+			t.Errorf("claim = %v, %v; want a result count error", res.created, res.err)
+		}
+	}
+}
+
+func TestDedupBatcherShutdown(t *testing.T) {
+	dedup := &fakeBatchDedup{}
+	b := newDedupBatcher(dedup, 64, 20*time.Millisecond)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.run(stop)
+	}()
+
+	// A batch still collecting when the stop arrives is flushed
+	req := dedupRequest{ctx: context.Background(), key: "a", ttl: time.Second, result: make(chan dedupResult, 1)}
+	b.requests <- req
+	for len(b.requests) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	select {
+	case res := <-req.result:
+		if res.err != nil || !res.created {
+			t.Errorf("claim = %v, %v; want created", res.created, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch collecting at the stop was not flushed")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batcher did not stop")
+	}
+
+	// Once stopped, a claim waits only as long as its context allows
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.CreateDedupKey(ctx, "b", time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("claim after stop returned %v, want the context's deadline", err)
+	}
+}
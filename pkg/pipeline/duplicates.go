@@ -0,0 +1,170 @@
+package pipeline
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// defaultDuplicateMargin is how close to the dedup window a duplicate counts as a boundary case
+const defaultDuplicateMargin = 500 * time.Millisecond
+
+// DuplicateConfig re-creates generated keys after they expire so the same key expires twice.
+// Durations are in milliseconds.
+type DuplicateConfig struct {
+	Probability float64 `json:"probability"`         // chance each key is re-created
+	MinDelay    int64   `json:"min_delay"`           // gap between the first and second expiry
+	MaxDelay    int64   `json:"max_delay,omitempty"` // upper bound of a uniform gap, defaults to MinDelay
+	// Window is the consumers' dedup window: gaps inside it must be suppressed and gaps beyond it
+	// delivered again. Gaps within Margin of the window are not judged either way.
+	Window int64 `json:"window,omitempty"`
+	Margin int64 `json:"margin,omitempty"`
+	Seed   int64 `json:"seed,omitempty"` // random seed, 0 picks one
+}
+
+// Validate checks the duplicate injection parameters
+func (d *DuplicateConfig) Validate() error {
+	_, err := d.planner()
+	return err
+}
+
+// MaxGap returns the longest gap between a key's first and second expiry
+func (d *DuplicateConfig) MaxGap() time.Duration {
+	return time.Duration(max(d.MinDelay, d.MaxDelay)) * time.Millisecond
+}
+
+// pendingDuplicate is a key waiting to be re-created
+type pendingDuplicate struct {
+	at  time.Time
+	dup redis.InjectedDuplicate
+}
+
+// duplicatePlanner decides whether a key is duplicated, and when and how
+type duplicatePlanner func(key redis.KeyExpiry, now time.Time) (pendingDuplicate, bool)
+
+func (d *DuplicateConfig) planner() (duplicatePlanner, error) {
+	if d.Probability < 0 || d.Probability > 1 {
+		return nil, errors.New("duplicate probability must be between 0 and 1")
+	}
+	if d.MinDelay < 2 || (d.MaxDelay != 0 && d.MaxDelay < d.MinDelay) {
+		return nil, errors.New("duplicate min_delay must be at least 2ms and no more than max_delay")
+	}
+	if d.Window <= 0 || d.Margin < 0 {
+		return nil, errors.New("duplicate injection needs a positive dedup window and non-negative margin")
+	}
+	seed := d.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	minGap := time.Duration(d.MinDelay) * time.Millisecond
+	maxGap := d.MaxGap()
+	window := time.Duration(d.Window) * time.Millisecond
+	margin := defaultDuplicateMargin
+	if d.Margin > 0 {
+		margin = time.Duration(d.Margin) * time.Millisecond
+	}
+
+	return func(key redis.KeyExpiry, now time.Time) (pendingDuplicate, bool) {
+		if rng.Float64() >= d.Probability {
+			return pendingDuplicate{}, false
+		}
+		gap := minGap
+		if maxGap > minGap {
+			gap += time.Duration(rng.Int63n(int64(maxGap - minGap)))
+		}
+
+		class := redis.DuplicateBoundary
+		switch {
+		case gap < window-margin:
+			class = redis.DuplicateWithin
+		case gap > window+margin:
+			class = redis.DuplicateOutside
+		}
+
+		first := key.Deadline
+		if first.IsZero() {
+			first = now.Add(key.TTL)
+		}
+		// Re-create halfway between the two expiries so the first one has certainly happened
+		return pendingDuplicate{
+			at:  first.Add(gap / 2),
+			dup: redis.InjectedDuplicate{Seq: key.Seq, Deadline: first.Add(gap), Class: class, Index: key.Index},
+		}, true
+	}, nil
+}
+
+// injectDuplicates re-creates keys from in as they fall due until in is closed and drained.
+// Duplicates still pending when ctx is cancelled are dropped. It returns the number re-created.
+func (g *Generator) injectDuplicates(ctx context.Context, runID string, in <-chan pendingDuplicate, batchSize int) int64 {
+	var pending duplicateQueue
+	var injected int64
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		var batch []redis.InjectedDuplicate
+		for len(pending) > 0 && !pending[0].at.After(time.Now()) {
+			batch = append(batch, heap.Pop(&pending).(pendingDuplicate).dup)
+			if len(batch) == batchSize {
+				injected += g.recreate(ctx, runID, batch)
+				batch = nil
+			}
+		}
+		injected += g.recreate(ctx, runID, batch)
+
+		if in == nil && len(pending) == 0 {
+			return injected
+		}
+		var due <-chan time.Time
+		if len(pending) > 0 {
+			timer.Reset(time.Until(pending[0].at))
+			due = timer.C
+		}
+		select {
+		case d, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			heap.Push(&pending, d)
+		case <-due:
+		case <-ctx.Done():
+			log.Printf("Run %s stopped with %d duplicates pending", runID, len(pending))
+			return injected
+		}
+	}
+}
+
+func (g *Generator) recreate(ctx context.Context, runID string, batch []redis.InjectedDuplicate) int64 {
+	if len(batch) == 0 {
+		return 0
+	}
+	opCtx, cancel := context.WithTimeout(ctx, defaultRedisTimeout)
+	defer cancel()
+	n, err := g.redis.RecreateKeys(opCtx, runID, batch)
+	if err != nil {
+		log.Printf("Failed to inject duplicates: %v", err)
+	}
+	return n
+}
+
+// duplicateQueue is a min-heap of pending duplicates ordered by re-creation time
+type duplicateQueue []pendingDuplicate
+
+func (q duplicateQueue) Len() int           { return len(q) }
+func (q duplicateQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q duplicateQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *duplicateQueue) Push(x any)        { *q = append(*q, x.(pendingDuplicate)) }
+func (q *duplicateQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
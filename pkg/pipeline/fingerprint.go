@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/nats"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// claim creates the dedup key of one expiration in the tenant's window, reporting whether this
+// consumer won it
+func (p *Pipeline) claim(ctx context.Context, tenant Tenant, key string) (bool, error) {
+	id := key
+	if len(tenant.Fingerprint) > 0 {
+		values, err := p.opts.Shadows.GetShadowFields(ctx, key, tenant.Fingerprint)
+		if err != nil {
+			return false, fmt.Errorf("failed to fingerprint %s: %w", key, err)
+		}
+		id = fingerprint(key, tenant.Fingerprint, values)
+	}
+	if tenant.DedupWindow == DedupSliding {
+		return p.opts.Deduplicator.(SlidingDeduplicator).CreateSlidingDedupKey(ctx, id, tenant.DedupTTL)
+	}
+	return p.deduplicator().CreateDedupKey(ctx, id, tenant.DedupTTL)
+}
+
+// capture takes the shadow of a claimed key, returning the event to publish in place of the bare key,
+// or nil if values are not captured or the key has no shadow. Scheduled jobs are captured whenever the
+// bus can publish values, since a job is useless without its payload. The shadow of a fingerprinted key
+// is kept for the dedup window, since the consumers that lost the claim may still be reading it.
+func (p *Pipeline) capture(ctx context.Context, tenant Tenant, key string) *nats.ExpiredEvent {
+	if !p.opts.CaptureValues {
+		if _, ok := p.opts.Bus.(ValueBus); !ok || !strings.HasPrefix(key, redis.JobPrefix) {
+			return nil
+		}
+	}
+	var keep time.Duration
+	if len(tenant.Fingerprint) > 0 {
+		keep = tenant.DedupTTL
+	}
+	fields, err := p.opts.Shadows.TakeShadow(ctx, key, keep)
+	if err != nil {
+		log.Printf("Failed to capture value of %s, publishing the key alone: %v", key, err)
+		return nil
+	}
+	if fields == nil {
+		return nil
+	}
+	evt := &nats.ExpiredEvent{Key: key, Value: fields[redis.ShadowValue]}
+	delete(fields, redis.ShadowValue)
+	if len(fields) > 0 {
+		evt.Fields = fields
+	}
+	return evt
+}
+
+// fingerprint identifies an expiration by key name and the given shadow fields, as
+// <key>#<hash>. A missing field hashes differently from an empty one.
+func fingerprint(key string, fields []string, values map[string]string) string {
+	h := sha256.New()
+	h.Write([]byte(key))
+	for _, field := range fields {
+		h.Write([]byte{0})
+		h.Write([]byte(field))
+		if v, ok := values[field]; ok {
+			h.Write([]byte{'='})
+			h.Write([]byte(v))
+		}
+	}
+	return key + "#" + hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,222 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	defaultRedisTimeout = 2 * time.Second
+
+	// DefaultBatchSize is the maximum number of keys written per pipelined round trip
+	DefaultBatchSize = 256
+	// DefaultWorkers is the number of batches written in parallel
+	DefaultWorkers = 8
+
+	progressInterval = 10000
+)
+
+// GeneratorConfig configures a key generation run
+type GeneratorConfig struct {
+	// RunID namespaces the generated keys and metrics; empty uses the legacy global keys
+	RunID    string
+	NumKeys  int64
+	KeyDelay time.Duration // used as a constant rate when Profile is nil
+	KeyTTL   time.Duration // used as a fixed TTL when TTL is nil
+	// TTL distributes key lifetimes
+	TTL *TTLDistribution
+	// Profile schedules when each key is generated
+	Profile *LoadProfile
+	// Duplicates re-creates some keys after they expire so they expire twice
+	Duplicates *DuplicateConfig
+	// Shadow also records each key's value in its shadow, for consumers that capture values
+	Shadow bool
+	// Index also adds each key to redis.DeadlineIndex, for consumers polling it
+	Index     bool
+	BatchSize int
+	Workers   int
+}
+
+// Generator writes expiring keys that feed the pipeline
+type Generator struct {
+	redis *redis.Client
+}
+
+// NewGenerator creates a generator writing to redisClient
+func NewGenerator(redisClient *redis.Client) *Generator {
+	return &Generator{redis: redisClient}
+}
+
+// Run generates config.NumKeys keys on the profile's schedule, stopping early if ctx is cancelled
+// or the profile runs out of keys. Keys due at the same time are batched into pipelined writes
+// spread across parallel workers. It returns the number of keys attempted.
+func (g *Generator) Run(ctx context.Context, config GeneratorConfig) (int64, error) {
+	profile := config.Profile
+	if profile == nil {
+		profile = ConstantRate(config.KeyDelay)
+	}
+	arrivals, err := profile.Arrivals()
+	if err != nil {
+		return 0, fmt.Errorf("invalid load profile: %w", err)
+	}
+	expire := ttlSampler(func(seq int64, _ time.Time) redis.KeyExpiry {
+		return redis.KeyExpiry{Seq: seq, TTL: config.KeyTTL}
+	})
+	if config.TTL != nil {
+		if expire, err = config.TTL.sampler(time.Now()); err != nil {
+			return 0, fmt.Errorf("invalid ttl distribution: %w", err)
+		}
+	}
+	if config.Shadow || config.Index {
+		sample := expire
+		expire = func(seq int64, now time.Time) redis.KeyExpiry {
+			key := sample(seq, now)
+			key.Shadow = config.Shadow
+			key.Index = config.Index
+			return key
+		}
+	}
+	var plan duplicatePlanner
+	if config.Duplicates != nil {
+		if plan, err = config.Duplicates.planner(); err != nil {
+			return 0, fmt.Errorf("invalid duplicate injection: %w", err)
+		}
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	workers := config.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	log.Printf("Starting key generation for run %s: total keys=%d, profile=%s, batch=%d, workers=%d",
+		config.RunID, config.NumKeys, profile.Type, batchSize, workers)
+
+	batches := make(chan []redis.KeyExpiry, workers)
+	var written atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				// Writes already scheduled are not cut short by a stop
+				opCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), defaultRedisTimeout)
+				if err := g.redis.GenerateKeys(opCtx, config.RunID, batch); err != nil {
+					log.Printf("Failed to generate keys %d-%d: %v", batch[0].Seq, batch[len(batch)-1].Seq, err)
+				}
+				cancel()
+
+				n := written.Add(int64(len(batch)))
+				if n/progressInterval != (n-int64(len(batch)))/progressInterval {
+					log.Printf("Generated %d keys", n)
+				}
+			}
+		}()
+	}
+
+	next := func(seq int64) redis.KeyExpiry {
+		return expire(seq, time.Now())
+	}
+	var dupCh chan pendingDuplicate
+	var injected int64
+	dupDone := make(chan struct{})
+	if plan != nil {
+		dupCh = make(chan pendingDuplicate, batchSize)
+		go func() {
+			defer close(dupDone)
+			injected = g.injectDuplicates(ctx, config.RunID, dupCh, batchSize)
+		}()
+		next = func(seq int64) redis.KeyExpiry {
+			now := time.Now()
+			key := expire(seq, now)
+			if d, ok := plan(key, now); ok {
+				select {
+				case dupCh <- d:
+				case <-ctx.Done():
+				}
+			}
+			return key
+		}
+	} else {
+		close(dupDone)
+	}
+
+	i := g.dispatch(ctx, config.NumKeys, arrivals, next, batchSize, batches)
+	close(batches)
+	wg.Wait()
+	// Wait for the last keys to expire and be re-created
+	if dupCh != nil {
+		close(dupCh)
+	}
+	<-dupDone
+	if plan != nil {
+		log.Printf("Run %s injected %d duplicates", config.RunID, injected)
+	}
+
+	if ctx.Err() != nil {
+		log.Printf("Run %s stopped at key %d", config.RunID, i)
+	} else {
+		log.Printf("Key generation complete for run %s: generated %d keys", config.RunID, i)
+	}
+	return i, nil
+}
+
+// dispatch hands keys to the workers in batches as they fall due and returns the number dispatched
+func (g *Generator) dispatch(ctx context.Context, numKeys int64, arrivals Arrivals, next func(seq int64) redis.KeyExpiry, batchSize int, batches chan<- []redis.KeyExpiry) int64 {
+	start := time.Now()
+	batch := make([]redis.KeyExpiry, 0, batchSize)
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		select {
+		case batches <- batch:
+			batch = make([]redis.KeyExpiry, 0, batchSize)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var i int64
+	for ; i < numKeys; i++ {
+		offset, ok := arrivals.Next()
+		if !ok {
+			break
+		}
+
+		if wait := time.Until(start.Add(offset)); wait > 0 {
+			// Send what is due before sleeping until the next key
+			if !flush() {
+				return i - int64(len(batch))
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return i
+			}
+		} else if ctx.Err() != nil {
+			return i - int64(len(batch))
+		}
+
+		batch = append(batch, next(i))
+		if len(batch) == batchSize && !flush() {
+			return i + 1 - int64(len(batch))
+		}
+	}
+	if !flush() {
+		return i - int64(len(batch))
+	}
+	return i
+}
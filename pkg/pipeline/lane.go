@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+)
+
+// expiration is a key expiration waiting in a tenant's lane
+type expiration struct {
+	key        string
+	receivedAt time.Time
+	done       func() // acks the key to its EventSource once handled; nil if it needs no ack
+}
+
+// lane queues one tenant's expirations for its own workers and rate limit, so a storm of
+// one tenant's keys cannot hold the concurrency every other tenant needs
+type lane struct {
+	tenant  Tenant
+	workers int
+	queue   chan expiration
+	limiter *tokenBucket // nil without a rate limit
+}
+
+func newLane(t Tenant, workers int) *lane {
+	l := &lane{
+		tenant:  t,
+		workers: workers,
+		queue:   make(chan expiration, t.QueueSize),
+	}
+	if t.RateLimit > 0 {
+		l.limiter = newTokenBucket(t.RateLimit, t.Burst)
+	}
+	return l
+}
+
+// matches reports whether key belongs to this lane's tenant
+func (l *lane) matches(key string) bool {
+	ok, _ := path.Match(l.tenant.Pattern, key)
+	return ok
+}
+
+// offer queues an expiration, returning false if the lane is full
+func (l *lane) offer(e expiration) bool {
+	select {
+	case l.queue <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// tokenBucket allows rate events per second with bursts of up to burst events
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(max(burst, 1))
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// wait takes a token, sleeping until one is available. It reports whether it had to wait.
+func (b *tokenBucket) wait(ctx context.Context) (bool, error) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return false, nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		// Return the token that was reserved but not used
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return true, ctx.Err()
+	}
+}
@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	DefaultMetricsFlushInterval = 250 * time.Millisecond
+	DefaultMetricsBatchSize     = 512
+	metricsFlushTimeout         = 5 * time.Second
+)
+
+// MetricsStore applies batched consumption counts
+type MetricsStore interface {
+	AddMetrics(ctx context.Context, batch redis.MetricsBatch) error
+}
+
+// MetricsAggregator counts consumption locally and flushes the totals through a single
+// pipelined round trip on an interval, or sooner once batchSize increments are pending.
+// It implements handler.MetricsRecorder, so the metrics handler can record into it.
+type MetricsAggregator struct {
+	store     MetricsStore
+	interval  time.Duration
+	batchSize int
+
+	mu      sync.Mutex
+	batch   redis.MetricsBatch
+	pending int
+
+	full      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMetricsAggregator starts an aggregator flushing to store. Zero interval and
+// batchSize select the defaults. Close flushes what is left and stops it.
+func NewMetricsAggregator(store MetricsStore, interval time.Duration, batchSize int) *MetricsAggregator {
+	if interval <= 0 {
+		interval = DefaultMetricsFlushInterval
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultMetricsBatchSize
+	}
+	a := &MetricsAggregator{
+		store:     store,
+		interval:  interval,
+		batchSize: batchSize,
+		batch:     newMetricsBatch(),
+		full:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func newMetricsBatch() redis.MetricsBatch {
+	return redis.MetricsBatch{
+		Consumed:  make(map[string]int64),
+		Consumers: make(map[redis.ConsumerCount]int64),
+		Tenants:   make(map[redis.TenantCount]int64),
+	}
+}
+
+// IncrementConsumerMetric counts an event processed by consumerID in a run
+func (a *MetricsAggregator) IncrementConsumerMetric(ctx context.Context, runID, consumerID string) error {
+	a.mu.Lock()
+	a.batch.Consumers[redis.ConsumerCount{RunID: runID, ConsumerID: consumerID}]++
+	a.added()
+	a.mu.Unlock()
+	return nil
+}
+
+// IncrementConsumed counts an event consumed in a run
+func (a *MetricsAggregator) IncrementConsumed(ctx context.Context, runID string) error {
+	a.mu.Lock()
+	a.batch.Consumed[runID]++
+	a.added()
+	a.mu.Unlock()
+	return nil
+}
+
+// IncrementTenantMetric counts one tenant usage event
+func (a *MetricsAggregator) IncrementTenantMetric(ctx context.Context, tenant, field string) error {
+	a.mu.Lock()
+	a.batch.Tenants[redis.TenantCount{Tenant: tenant, Field: field}]++
+	a.added()
+	a.mu.Unlock()
+	return nil
+}
+
+// added wakes the flusher once the batch is full. Callers hold a.mu.
+func (a *MetricsAggregator) added() {
+	a.pending++
+	if a.pending == a.batchSize {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (a *MetricsAggregator) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.full:
+		case <-a.stop:
+			return
+		}
+		a.flush(context.Background())
+	}
+}
+
+// flush writes the pending counts. Counts that fail to write are dropped and logged,
+// since a partially applied pipeline cannot safely be retried.
+func (a *MetricsAggregator) flush(ctx context.Context) {
+	a.mu.Lock()
+	if a.pending == 0 {
+		a.mu.Unlock()
+		return
+	}
+	batch := a.batch
+	a.batch = newMetricsBatch()
+	a.pending = 0
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, metricsFlushTimeout)
+	defer cancel()
+	if err := a.store.AddMetrics(ctx, batch); err != nil {
+		log.Printf("Failed to flush metrics: %v", err)
+	}
+}
+
+// Close stops the periodic flush and writes the remaining counts
+func (a *MetricsAggregator) Close(ctx context.Context) {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+		a.flush(ctx)
+	})
+}
@@ -0,0 +1,621 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/handler"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/nats"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	// DefaultDedupTTL is also the generator's default dedup_window, which duplicate injection judges against
+	DefaultDedupTTL       = 3 * time.Second
+	DefaultConcurrency    = 64
+	DefaultReconnectDelay = 5 * time.Second
+	// DefaultHeartbeatInterval is how often a consumer refreshes its registry entry
+	DefaultHeartbeatInterval = 5 * time.Second
+)
+
+// ErrShutdownTimeout is returned by Run when Shutdown's deadline passed before in-flight
+// expirations were drained; their events may not have been published
+var ErrShutdownTimeout = errors.New("pipeline: shutdown timed out with expirations in flight")
+
+// Bus publishes deduplicated events and delivers them to subscribed handlers
+type Bus interface {
+	PublishExpiredKey(ctx context.Context, key string) error
+	SubscribeExpiredKeys(ctx context.Context, handler func(d nats.Delivery) error) error
+}
+
+// SubjectBus is a Bus that can also publish to and consume from a tenant's own subject
+type SubjectBus interface {
+	Bus
+	PublishExpiredKeyTo(ctx context.Context, subject, key string) error
+	SubscribeSubject(ctx context.Context, subject string, handler func(d nats.Delivery) error) error
+}
+
+// Deduplicator claims an expired key so only one consumer publishes it
+type Deduplicator interface {
+	CreateDedupKey(ctx context.Context, originalKey string, ttl time.Duration) (bool, error)
+}
+
+// SlidingDeduplicator claims an expired key like Deduplicator, but restarts the window of a key
+// that is already claimed
+type SlidingDeduplicator interface {
+	CreateSlidingDedupKey(ctx context.Context, originalKey string, ttl time.Duration) (bool, error)
+}
+
+// ValueBus is a Bus that can also publish the value captured from a key's shadow
+type ValueBus interface {
+	Bus
+	PublishExpiredEvent(ctx context.Context, subject string, evt nats.ExpiredEvent) error
+}
+
+// ShadowStore reads and takes the shadow record a writer keeps next to a key, which outlives the key
+type ShadowStore interface {
+	GetShadowFields(ctx context.Context, key string, fields []string) (map[string]string, error)
+	TakeShadow(ctx context.Context, key string, keep time.Duration) (map[string]string, error)
+}
+
+// LatencyRecorder records per-stage latency samples for the current run
+type LatencyRecorder interface {
+	GetKeyDeadline(ctx context.Context, key string) (time.Time, error)
+	RecordLatency(ctx context.Context, runID, stage string, d time.Duration) error
+}
+
+// ConsumerRegistry tracks which consumers are alive
+type ConsumerRegistry interface {
+	Heartbeat(ctx context.Context, consumerID string) error
+	RemoveConsumer(ctx context.Context, consumerID string) (bool, error)
+}
+
+// TenantRecorder counts per-tenant usage
+type TenantRecorder interface {
+	IncrementTenantMetric(ctx context.Context, tenant, field string) error
+}
+
+// TenantRegistry publishes tenant settings so they can be shown next to usage
+type TenantRegistry interface {
+	RegisterTenant(ctx context.Context, name string, settings redis.TenantSettings) error
+}
+
+// Options configures a Pipeline
+type Options struct {
+	// ConsumerID identifies this instance in metrics and logs
+	ConsumerID string
+	// Redis backs every store left unset, and delivers key expiration notifications
+	Redis *redis.Client
+	// Bus distributes deduplicated events across consumers
+	Bus Bus
+	// Deduplicator defaults to Redis when nil
+	Deduplicator Deduplicator
+	// Shadows supplies the fields of tenants' fingerprints and captured values. Defaults to Redis.
+	Shadows ShadowStore
+	// CaptureValues takes the shadow of each key this instance claims and publishes its value with
+	// the event. The bus must be a ValueBus. Scheduled jobs' payloads are captured regardless when it is.
+	CaptureValues bool
+	// Handlers processes events received from the bus. When nil the pipeline
+	// only deduplicates and publishes, without consuming.
+	Handlers *handler.Registry
+	// Latency, when set, records notification and dedup+publish latency for
+	// keys this instance wins
+	Latency LatencyRecorder
+	// Concurrency bounds the number of expiry events processed at once, shared between
+	// tenants by their Share
+	Concurrency int
+	// DedupTTL is the deduplication window of tenants without their own
+	DedupTTL time.Duration
+	// Tenants are matched against each expired key in order; keys no tenant matches belong
+	// to DefaultTenant. Without tenants every key shares the default tenant's lane.
+	Tenants []Tenant
+	// TenantUsage counts per-tenant usage. Defaults to Metrics, or Redis without it.
+	TenantUsage TenantRecorder
+	// TenantRegistry records tenant settings when Run starts. Defaults to Redis.
+	TenantRegistry TenantRegistry
+	// Policies shape the expirations of matching keys in place of the dedup window,
+	// the first match applying
+	Policies []Policy
+	// Shaper evaluates Policies. Defaults to Redis.
+	Shaper Shaper
+	// ShapePollInterval is how often deferred emissions are checked for
+	ShapePollInterval time.Duration
+	// Source delivers expired keys. Defaults to keyspace notifications from Redis.
+	Source EventSource
+	// ReconnectDelay is the wait before resubscribing after a Pub/Sub error, for the default Source
+	ReconnectDelay time.Duration
+	// Registry records a heartbeat for this consumer while it runs and removes it on
+	// shutdown. Defaults to Redis when nil.
+	Registry ConsumerRegistry
+	// HeartbeatInterval is how often the heartbeat is refreshed
+	HeartbeatInterval time.Duration
+	// DedupBatchSize caps how many concurrent dedup claims are pipelined together when the
+	// deduplicator implements BatchDeduplicator. 1 disables batching.
+	DedupBatchSize int
+	// DedupBatchWait is how long a claim may wait for others to join its batch
+	DedupBatchWait time.Duration
+	// Metrics, when set, is flushed once the pipeline has stopped
+	Metrics *MetricsAggregator
+}
+
+// Pipeline turns Redis key expirations into deduplicated, load-balanced events
+type Pipeline struct {
+	opts Options
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	abandon chan struct{} // closed when Shutdown gives up waiting for in-flight work
+	dedup   Deduplicator  // batching wrapper around opts.Deduplicator while running
+
+	inflight sync.WaitGroup
+	lanes    []*lane // configured tenants, in match order
+	fallback *lane   // DefaultTenant
+}
+
+// New creates a pipeline, applying defaults for unset options
+func New(opts Options) (*Pipeline, error) {
+	if opts.Redis == nil {
+		return nil, errors.New("pipeline: Redis client is required")
+	}
+	if opts.Bus == nil {
+		return nil, errors.New("pipeline: bus is required")
+	}
+	if opts.ConsumerID == "" {
+		opts.ConsumerID = "unknown"
+	}
+	if opts.Deduplicator == nil {
+		opts.Deduplicator = opts.Redis
+	}
+	if opts.Shadows == nil {
+		opts.Shadows = opts.Redis
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.DedupTTL <= 0 {
+		opts.DedupTTL = DefaultDedupTTL
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = DefaultReconnectDelay
+	}
+	if opts.Source == nil {
+		opts.Source = NewNotificationSource(opts.Redis, opts.ReconnectDelay)
+	}
+	if opts.Registry == nil {
+		opts.Registry = opts.Redis
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if opts.DedupBatchSize <= 0 {
+		opts.DedupBatchSize = DefaultDedupBatchSize
+	}
+	if opts.DedupBatchWait <= 0 {
+		opts.DedupBatchWait = DefaultDedupBatchWait
+	}
+	if opts.TenantUsage == nil {
+		opts.TenantUsage = opts.Redis
+		if opts.Metrics != nil {
+			opts.TenantUsage = opts.Metrics
+		}
+	}
+	if opts.TenantRegistry == nil {
+		opts.TenantRegistry = opts.Redis
+	}
+	if opts.Shaper == nil {
+		opts.Shaper = opts.Redis
+	}
+	if opts.ShapePollInterval <= 0 {
+		opts.ShapePollInterval = DefaultShapePollInterval
+	}
+
+	if _, ok := opts.Bus.(ValueBus); opts.CaptureValues && !ok {
+		return nil, errors.New("pipeline: capturing values needs a bus that can publish them")
+	}
+
+	lanes, fallback, err := buildLanes(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Pipeline{
+		opts:     opts,
+		lanes:    lanes,
+		fallback: fallback,
+	}, nil
+}
+
+// Run subscribes to the bus and processes Redis expirations until ctx is
+// cancelled or Shutdown is called. It returns ErrShutdownTimeout if Shutdown
+// gave up before in-flight expirations were drained.
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.mu.Lock()
+	if p.done != nil {
+		p.mu.Unlock()
+		return errors.New("pipeline: already running")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	p.abandon = make(chan struct{})
+	done, abandon := p.done, p.abandon
+	p.mu.Unlock()
+
+	defer close(done)
+	defer cancel()
+
+	// The bus subscription outlives ctx until in-flight expirations have been
+	// published, since cancelling it closes the NATS connection
+	busCtx, busCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer busCancel()
+
+	// Subscribe to NATS stream for deduplicated events, on every tenant's subject
+	if p.opts.Handlers != nil {
+		for _, l := range p.allLanes() {
+			var err error
+			if l.tenant.Subject == "" {
+				err = p.opts.Bus.SubscribeExpiredKeys(busCtx, p.consume(busCtx))
+			} else {
+				err = p.opts.Bus.(SubjectBus).SubscribeSubject(busCtx, l.tenant.Subject, p.consume(busCtx))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to subscribe to NATS stream for tenant %s: %w", l.tenant.Name, err)
+			}
+		}
+	}
+	p.registerTenants(ctx)
+
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		p.heartbeat(ctx)
+	}()
+
+	// Micro-batch dedup claims from concurrent expirations into pipelined SETNX
+	if batch, ok := p.opts.Deduplicator.(BatchDeduplicator); ok && p.opts.DedupBatchSize > 1 {
+		batcher := newDedupBatcher(batch, p.opts.DedupBatchSize, p.opts.DedupBatchWait)
+		stopBatcher := make(chan struct{})
+		batcherDone := make(chan struct{})
+		go func() {
+			defer close(batcherDone)
+			batcher.run(stopBatcher)
+		}()
+		p.mu.Lock()
+		p.dedup = batcher
+		p.mu.Unlock()
+		defer func() {
+			p.mu.Lock()
+			p.dedup = nil
+			p.mu.Unlock()
+			close(stopBatcher)
+			select {
+			case <-batcherDone:
+			case <-abandon:
+			}
+		}()
+	}
+
+	for _, l := range p.allLanes() {
+		for range l.workers {
+			p.inflight.Add(1)
+			go func() {
+				defer p.inflight.Done()
+				p.work(ctx, l)
+			}()
+		}
+	}
+
+	// Trailing-edge and debounced emissions are published by whichever consumer claims them
+	for _, pol := range p.opts.Policies {
+		if pol.defers() {
+			p.inflight.Add(1)
+			go func() {
+				defer p.inflight.Done()
+				p.emitDeferred(ctx)
+			}()
+			break
+		}
+	}
+
+	p.receiveExpirations(ctx)
+	drained := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-abandon:
+		busCancel()
+		return ErrShutdownTimeout
+	}
+	if f, ok := p.opts.Source.(ackFlusher); ok {
+		f.Flush(context.WithoutCancel(ctx))
+	}
+	<-heartbeatDone
+	for _, l := range p.allLanes() {
+		if n := len(l.queue); n > 0 {
+			log.Printf("Consumer %s discarded %d queued expirations of tenant %s on shutdown", p.opts.ConsumerID, n, l.tenant.Name)
+		}
+	}
+
+	// Stop consuming before the final metrics flush so no count lands after it
+	busCancel()
+	if p.opts.Metrics != nil {
+		flushCtx, flushCancel := context.WithTimeout(context.WithoutCancel(ctx), metricsFlushTimeout)
+		defer flushCancel()
+		p.opts.Metrics.Close(flushCtx)
+	}
+	return nil
+}
+
+// heartbeat keeps this consumer registered until ctx is cancelled, then deregisters it
+func (p *Pipeline) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := p.opts.Registry.Heartbeat(ctx, p.opts.ConsumerID); err != nil && ctx.Err() == nil {
+			log.Printf("Consumer %s failed to send heartbeat: %v", p.opts.ConsumerID, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			removeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.opts.HeartbeatInterval)
+			defer cancel()
+			if _, err := p.opts.Registry.RemoveConsumer(removeCtx, p.opts.ConsumerID); err != nil {
+				log.Printf("Consumer %s failed to deregister: %v", p.opts.ConsumerID, err)
+			}
+			return
+		}
+	}
+}
+
+// Shutdown stops receiving events and waits for in-flight work to finish or ctx to expire.
+// Once ctx expires, Run stops waiting too and returns ErrShutdownTimeout.
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	cancel, done, abandon := p.cancel, p.done, p.abandon
+	p.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		select {
+		case <-abandon:
+		default:
+			close(abandon)
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// consume adapts bus deliveries to the handler registry
+func (p *Pipeline) consume(ctx context.Context) func(d nats.Delivery) error {
+	return func(d nats.Delivery) error {
+		runID, _, _ := redis.ParseKey(d.Key)
+		tenant := p.laneFor(d.Key).tenant.Name
+		evt := &handler.Event{
+			Key:          d.Key,
+			Value:        d.Value,
+			Fields:       d.Fields,
+			RunID:        runID,
+			Tenant:       tenant,
+			Subject:      d.Subject,
+			ConsumerID:   p.opts.ConsumerID,
+			NumDelivered: d.NumDelivered,
+			Published:    d.Published,
+			ReceivedAt:   time.Now(),
+		}
+		if err := p.opts.Handlers.Dispatch(ctx, evt); err != nil {
+			log.Printf("Consumer %s failed to process key %s (delivery %d): %v", p.opts.ConsumerID, d.Key, d.NumDelivered, err)
+			return err
+		}
+		p.countTenant(ctx, tenant, redis.TenantConsumed)
+		return nil
+	}
+}
+
+// receiveExpirations queues keys from the event source on their tenants' lanes until ctx is cancelled
+func (p *Pipeline) receiveExpirations(ctx context.Context) {
+	p.opts.Source.Receive(ctx, func(key string, done func()) {
+		// Ignore dedup keys and other bookkeeping
+		if redis.IsInternalKey(key) {
+			if done != nil {
+				done()
+			}
+			return
+		}
+
+		// Each tenant's lane is bounded on its own, so the receive loop never waits on a busy
+		// tenant. Another consumer also received a notification and may still claim it, and a
+		// polled key is not acked, so it is claimed again once its lease ends.
+		l := p.laneFor(key)
+		if !l.offer(expiration{key: key, receivedAt: time.Now(), done: done}) {
+			log.Printf("Consumer %s dropped key %s: tenant %s queue is full", p.opts.ConsumerID, key, l.tenant.Name)
+			p.countTenant(ctx, l.tenant.Name, redis.TenantDropped)
+		}
+	})
+}
+
+// work processes a lane's expirations until ctx is cancelled
+func (p *Pipeline) work(ctx context.Context, l *lane) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-l.queue:
+			if l.limiter != nil {
+				throttled, err := l.limiter.wait(ctx)
+				if err != nil {
+					return
+				}
+				if throttled {
+					p.countTenant(ctx, l.tenant.Name, redis.TenantThrottled)
+				}
+			}
+			// Claimed work is detached from cancellation so Shutdown drains rather than
+			// aborts a claimed key between SETNX and publish, which would lose the event
+			p.handleExpiredKey(context.WithoutCancel(ctx), l, e.key, e.receivedAt)
+			if e.done != nil {
+				e.done()
+			}
+		}
+	}
+}
+
+// HandleExpiredKey deduplicates a Redis expiration event and publishes it to the bus,
+// waiting for its tenant's rate limit
+func (p *Pipeline) HandleExpiredKey(ctx context.Context, key string) {
+	l := p.laneFor(key)
+	if l.limiter != nil {
+		if _, err := l.limiter.wait(ctx); err != nil {
+			return
+		}
+	}
+	p.handleExpiredKey(ctx, l, key, time.Now())
+}
+
+func (p *Pipeline) handleExpiredKey(ctx context.Context, l *lane, key string, receivedAt time.Time) {
+	consumerID := p.opts.ConsumerID
+	log.Printf("Consumer %s received Redis expired key: %s", consumerID, key)
+
+	// Ignore dedup keys and other bookkeeping
+	if redis.IsInternalKey(key) {
+		log.Printf("Ignoring internal key: %s", key)
+		return
+	}
+
+	tenant := l.tenant
+	if pol := p.policyFor(key); pol != nil {
+		decision, err := pol.shape(ctx, p.opts.Shaper, key)
+		if err != nil {
+			log.Printf("Failed to shape %s: %v", key, err)
+			p.countTenant(ctx, tenant.Name, redis.TenantFailed)
+			return
+		}
+		switch decision {
+		case redis.ShapeEmit:
+			if p.publish(ctx, l, key) && p.opts.Latency != nil {
+				p.recordLatency(ctx, key, receivedAt, time.Now())
+			}
+		case redis.ShapeDuplicate:
+			p.countTenant(ctx, tenant.Name, redis.TenantDuplicates)
+		default:
+			log.Printf("Policy %s on %s: %s key %s", pol.Type, pol.Pattern, decision, key)
+			p.countTenant(ctx, tenant.Name, redis.TenantShaped)
+		}
+		return
+	}
+
+	// Try to create dedup key
+	ok, err := p.claim(ctx, tenant, key)
+	if err != nil {
+		log.Printf("Failed to create dedup key for %s: %v", key, err)
+		p.countTenant(ctx, tenant.Name, redis.TenantFailed)
+		return
+	}
+
+	// If dedup key already exists, ignore this event
+	if !ok {
+		log.Printf("Dedup key already exists for %s, ignoring", key)
+		p.countTenant(ctx, tenant.Name, redis.TenantDuplicates)
+		return
+	}
+
+	if p.publish(ctx, l, key) && p.opts.Latency != nil {
+		p.recordLatency(ctx, key, receivedAt, time.Now())
+	}
+}
+
+// publish sends a claimed key to NATS, on its tenant's own subject if it has one
+func (p *Pipeline) publish(ctx context.Context, l *lane, key string) bool {
+	var err error
+	if evt := p.capture(ctx, l.tenant, key); evt != nil {
+		subject := l.tenant.Subject
+		if subject == "" {
+			subject = nats.Subject
+		}
+		err = p.opts.Bus.(ValueBus).PublishExpiredEvent(ctx, subject, *evt)
+	} else if l.tenant.Subject == "" {
+		err = p.opts.Bus.PublishExpiredKey(ctx, key)
+	} else {
+		err = p.opts.Bus.(SubjectBus).PublishExpiredKeyTo(ctx, l.tenant.Subject, key)
+	}
+	if err != nil {
+		log.Printf("Failed to publish key %s to NATS: %v", key, err)
+		p.countTenant(ctx, l.tenant.Name, redis.TenantFailed)
+		return false
+	}
+	log.Printf("Successfully published key %s to NATS", key)
+	p.countTenant(ctx, l.tenant.Name, redis.TenantPublished)
+	return true
+}
+
+// laneFor returns the lane of the first tenant matching key, or the default tenant's
+func (p *Pipeline) laneFor(key string) *lane {
+	for _, l := range p.lanes {
+		if l.matches(key) {
+			return l
+		}
+	}
+	return p.fallback
+}
+
+// allLanes returns every tenant's lane, the default tenant's last
+func (p *Pipeline) allLanes() []*lane {
+	return append(p.lanes[:len(p.lanes):len(p.lanes)], p.fallback)
+}
+
+// registerTenants publishes each tenant's settings. Failures are logged, since usage is
+// still counted without them.
+func (p *Pipeline) registerTenants(ctx context.Context) {
+	for _, l := range p.allLanes() {
+		if err := p.opts.TenantRegistry.RegisterTenant(ctx, l.tenant.Name, l.tenant.settings(l.workers)); err != nil {
+			log.Printf("Failed to register tenant %s: %v", l.tenant.Name, err)
+		}
+	}
+}
+
+func (p *Pipeline) countTenant(ctx context.Context, tenant, field string) {
+	if err := p.opts.TenantUsage.IncrementTenantMetric(ctx, tenant, field); err != nil {
+		log.Printf("Failed to count %s for tenant %s: %v", field, tenant, err)
+	}
+}
+
+// deduplicator returns the batching deduplicator while Run is active, otherwise the configured one
+func (p *Pipeline) deduplicator() Deduplicator {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dedup != nil {
+		return p.dedup
+	}
+	return p.opts.Deduplicator
+}
+
+// recordLatency records how late the notification arrived and how long dedup and publish took
+func (p *Pipeline) recordLatency(ctx context.Context, key string, receivedAt, publishedAt time.Time) {
+	runID, _, ok := redis.ParseKey(key)
+	if !ok || runID == "" {
+		return
+	}
+	if deadline, err := p.opts.Latency.GetKeyDeadline(ctx, key); err == nil {
+		if err := p.opts.Latency.RecordLatency(ctx, runID, redis.StageNotification, receivedAt.Sub(deadline)); err != nil {
+			log.Printf("Failed to record notification latency: %v", err)
+		}
+	}
+	if err := p.opts.Latency.RecordLatency(ctx, runID, redis.StageDedupPublish, publishedAt.Sub(receivedAt)); err != nil {
+		log.Printf("Failed to record dedup+publish latency: %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package pipeline
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Load profile types
+const (
+	ProfileConstant = "constant" // token bucket at Rate keys/s with BucketSize burst capacity
+	ProfileRamp     = "ramp"     // linear ramp from StartRate to EndRate over Duration, then EndRate
+	ProfileStep     = "step"     // piecewise constant rates from Steps; the last step continues
+	ProfileBurst    = "burst"    // BurstSize keys at once every BurstInterval
+	ProfilePoisson  = "poisson"  // exponentially distributed gaps averaging Rate keys/s
+	ProfileReplay   = "replay"   // offsets from a CSV timeline
+)
+
+// Step is one segment of a step profile
+type Step struct {
+	Rate     float64 `json:"rate"`     // keys per second
+	Duration int64   `json:"duration"` // milliseconds
+}
+
+// LoadProfile describes when each key of a run is generated
+type LoadProfile struct {
+	Type          string  `json:"type"`
+	Rate          float64 `json:"rate,omitempty"`           // keys per second (constant, poisson)
+	BucketSize    int64   `json:"bucket_size,omitempty"`    // token bucket capacity (constant)
+	StartRate     float64 `json:"start_rate,omitempty"`     // keys per second (ramp)
+	EndRate       float64 `json:"end_rate,omitempty"`       // keys per second (ramp)
+	Duration      int64   `json:"duration,omitempty"`       // milliseconds (ramp)
+	Steps         []Step  `json:"steps,omitempty"`          // (step)
+	BurstSize     int64   `json:"burst_size,omitempty"`     // keys per burst (burst)
+	BurstInterval int64   `json:"burst_interval,omitempty"` // milliseconds (burst)
+	Seed          int64   `json:"seed,omitempty"`           // random seed, 0 picks one (poisson)
+	Timeline      string  `json:"timeline,omitempty"`       // inline CSV of "offset_ms[,count]" rows (replay)
+	TimelineFile  string  `json:"timeline_file,omitempty"`  // path to a CSV timeline on the generator host (replay)
+}
+
+// Arrivals yields the scheduled offset from the start of the run for each successive key.
+// ok is false once the profile has no more keys.
+type Arrivals interface {
+	Next() (offset time.Duration, ok bool)
+}
+
+// ConstantRate returns the profile equivalent to sleeping delay between keys; zero delay is unthrottled
+func ConstantRate(delay time.Duration) *LoadProfile {
+	if delay <= 0 {
+		return &LoadProfile{Type: ProfileConstant}
+	}
+	return &LoadProfile{Type: ProfileConstant, Rate: float64(time.Second) / float64(delay)}
+}
+
+// Validate checks the profile parameters, loading the replay timeline if needed
+func (p *LoadProfile) Validate() error {
+	_, err := p.Arrivals()
+	return err
+}
+
+// KeyCount returns the number of keys a replay timeline holds, or 0 for unbounded profiles
+func (p *LoadProfile) KeyCount() (int64, error) {
+	if p.Type != ProfileReplay {
+		return 0, nil
+	}
+	offsets, err := p.timeline()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(offsets)), nil
+}
+
+// Arrivals returns a fresh arrival schedule for the profile
+func (p *LoadProfile) Arrivals() (Arrivals, error) {
+	switch p.Type {
+	case ProfileConstant, "":
+		if p.Rate < 0 || p.BucketSize < 0 {
+			return nil, errors.New("constant profile needs a non-negative rate and bucket_size")
+		}
+		bucket := max(p.BucketSize, 1)
+		return &funcArrivals{at: func(i int64) (time.Duration, bool) {
+			if p.Rate == 0 || i < bucket {
+				return 0, true
+			}
+			return seconds(float64(i-bucket+1) / p.Rate), true
+		}}, nil
+
+	case ProfileRamp:
+		if p.StartRate < 0 || p.EndRate < 0 || p.StartRate+p.EndRate == 0 || p.Duration <= 0 {
+			return nil, errors.New("ramp profile needs non-negative start_rate and end_rate, not both zero, and a positive duration")
+		}
+		return &funcArrivals{at: p.rampAt}, nil
+
+	case ProfileStep:
+		if len(p.Steps) == 0 {
+			return nil, errors.New("step profile needs at least one step")
+		}
+		for i, s := range p.Steps {
+			if s.Rate < 0 || (s.Duration <= 0 && i < len(p.Steps)-1) {
+				return nil, fmt.Errorf("step %d needs a non-negative rate and a positive duration", i)
+			}
+		}
+		return &stepArrivals{steps: p.Steps}, nil
+
+	case ProfileBurst:
+		if p.BurstSize <= 0 || p.BurstInterval <= 0 {
+			return nil, errors.New("burst profile needs a positive burst_size and burst_interval")
+		}
+		interval := time.Duration(p.BurstInterval) * time.Millisecond
+		return &funcArrivals{at: func(i int64) (time.Duration, bool) {
+			return time.Duration(i/p.BurstSize) * interval, true
+		}}, nil
+
+	case ProfilePoisson:
+		if p.Rate <= 0 {
+			return nil, errors.New("poisson profile needs a positive rate")
+		}
+		seed := p.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		return &poissonArrivals{rate: p.Rate, rng: rand.New(rand.NewSource(seed))}, nil
+
+	case ProfileReplay:
+		offsets, err := p.timeline()
+		if err != nil {
+			return nil, err
+		}
+		return &funcArrivals{at: func(i int64) (time.Duration, bool) {
+			if i >= int64(len(offsets)) {
+				return 0, false
+			}
+			return offsets[i], true
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown load profile %q", p.Type)
+	}
+}
+
+// rampAt solves N(t) = i for N(t) = r0*t + k*t²/2, the number of keys generated by t
+func (p *LoadProfile) rampAt(i int64) (time.Duration, bool) {
+	r0, r1 := p.StartRate, p.EndRate
+	T := float64(p.Duration) / 1000
+	n := float64(i)
+	k := (r1 - r0) / T
+
+	rampKeys := r0*T + k*T*T/2
+	if n >= rampKeys {
+		if r1 == 0 {
+			return 0, false
+		}
+		return seconds(T + (n-rampKeys)/r1), true
+	}
+	if k == 0 {
+		return seconds(n / r0), true
+	}
+	return seconds((math.Sqrt(r0*r0+2*k*n) - r0) / k), true
+}
+
+// timeline loads the replay offsets sorted ascending, expanding counts into one offset per key
+func (p *LoadProfile) timeline() ([]time.Duration, error) {
+	var r io.Reader
+	switch {
+	case p.Timeline != "":
+		r = strings.NewReader(p.Timeline)
+	case p.TimelineFile != "":
+		f, err := os.Open(p.TimelineFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open timeline: %w", err)
+		}
+		defer f.Close()
+		r = f
+	default:
+		return nil, errors.New("replay profile needs a timeline or timeline_file")
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timeline: %w", err)
+	}
+
+	var offsets []time.Duration
+	for i, row := range rows {
+		offset, err := strconv.ParseFloat(row[0], 64)
+		if err != nil {
+			if i == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("invalid offset on timeline row %d: %q", i+1, row[0])
+		}
+		count := int64(1)
+		if len(row) > 1 && row[1] != "" {
+			if count, err = strconv.ParseInt(row[1], 10, 64); err != nil || count < 0 {
+				return nil, fmt.Errorf("invalid count on timeline row %d: %q", i+1, row[1])
+			}
+		}
+		if offset < 0 {
+			return nil, fmt.Errorf("negative offset on timeline row %d", i+1)
+		}
+		for range count {
+			offsets = append(offsets, time.Duration(offset*float64(time.Millisecond)))
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, errors.New("timeline has no keys")
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// funcArrivals computes each offset directly from the key index
+type funcArrivals struct {
+	at func(i int64) (time.Duration, bool)
+	i  int64
+}
+
+func (a *funcArrivals) Next() (time.Duration, bool) {
+	offset, ok := a.at(a.i)
+	a.i++
+	return offset, ok
+}
+
+// stepArrivals spaces keys evenly within each step
+type stepArrivals struct {
+	steps     []Step
+	step      int
+	stepStart time.Duration
+	n         int64 // keys emitted in the current step
+}
+
+func (a *stepArrivals) Next() (time.Duration, bool) {
+	for {
+		s := a.steps[a.step]
+		last := a.step == len(a.steps)-1
+		if s.Rate > 0 {
+			offset := a.stepStart + seconds(float64(a.n)/s.Rate)
+			if last || offset < a.stepStart+time.Duration(s.Duration)*time.Millisecond {
+				a.n++
+				return offset, true
+			}
+		} else if last {
+			return 0, false
+		}
+		a.stepStart += time.Duration(s.Duration) * time.Millisecond
+		a.step++
+		a.n = 0
+	}
+}
+
+// poissonArrivals draws exponentially distributed gaps between keys
+type poissonArrivals struct {
+	rate   float64
+	rng    *rand.Rand
+	offset float64 // seconds
+}
+
+func (a *poissonArrivals) Next() (time.Duration, bool) {
+	offset := a.offset
+	a.offset += a.rng.ExpFloat64() / a.rate
+	return seconds(offset), true
+}
@@ -0,0 +1,239 @@
+package pipeline
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// offsets draws up to n arrivals, stopping early when the profile runs out
+func offsets(t *testing.T, p *LoadProfile, n int) []time.Duration {
+	t.Helper()
+	arrivals, err := p.Arrivals()
+	if err != nil {
+		t.Fatalf("Arrivals() failed: %v", err)
+	}
+	var got []time.Duration
+	for range n {
+		offset, ok := arrivals.Next()
+		if !ok {
+			break
+		}
+		got = append(got, offset)
+	}
+	return got
+}
+
+// near reports whether two offsets agree to the microsecond, absorbing float rounding
+func near(a, b time.Duration) bool {
+	d := a - b
+	return d > -time.Microsecond && d < time.Microsecond
+}
+
+func ms(v float64) time.Duration {
+	return time.Duration(v * float64(time.Millisecond))
+}
+
+func TestProfileArrivals(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile LoadProfile
+		n       int
+		want    []time.Duration
+	}{
+		{
+			name:    "unthrottled constant",
+			profile: LoadProfile{Type: ProfileConstant},
+			n:       3,
+			want:    []time.Duration{0, 0, 0},
+		},
+		{
+			name:    "empty type is constant",
+			profile: LoadProfile{Rate: 10},
+			n:       3,
+			want:    []time.Duration{0, ms(100), ms(200)},
+		},
+		{
+			name:    "constant bucket releases a burst up front",
+			profile: LoadProfile{Type: ProfileConstant, Rate: 10, BucketSize: 3},
+			n:       5,
+			want:    []time.Duration{0, 0, 0, ms(100), ms(200)},
+		},
+		{
+			name:    "ramp up from zero",
+			profile: LoadProfile{Type: ProfileRamp, StartRate: 0, EndRate: 10, Duration: 1000},
+			n:       7,
+			// N(t) = 5t², then 10 keys/s once the ramp's 5 keys are out at 1s
+			want: []time.Duration{0, seconds(math.Sqrt(0.2)), seconds(math.Sqrt(0.4)), seconds(math.Sqrt(0.6)), seconds(math.Sqrt(0.8)), ms(1000), ms(1100)},
+		},
+		{
+			name:    "flat ramp",
+			profile: LoadProfile{Type: ProfileRamp, StartRate: 4, EndRate: 4, Duration: 1000},
+			n:       6,
+			want:    []time.Duration{0, ms(250), ms(500), ms(750), ms(1000), ms(1250)},
+		},
+		{
+			name:    "ramp down to zero ends",
+			profile: LoadProfile{Type: ProfileRamp, StartRate: 10, EndRate: 0, Duration: 1000},
+			n:       10,
+			// N(t) = 10t - 5t² reaches its 5 keys at 1s
+			want: []time.Duration{0, seconds(1 - math.Sqrt(0.8)), seconds(1 - math.Sqrt(0.6)), seconds(1 - math.Sqrt(0.4)), seconds(1 - math.Sqrt(0.2))},
+		},
+		{
+			name: "steps skip idle steps and the last continues",
+			profile: LoadProfile{Type: ProfileStep, Steps: []Step{
+				{Rate: 10, Duration: 500},
+				{Rate: 0, Duration: 500},
+				{Rate: 2},
+			}},
+			n:    8,
+			want: []time.Duration{0, ms(100), ms(200), ms(300), ms(400), ms(1000), ms(1500), ms(2000)},
+		},
+		{
+			name:    "idle last step ends",
+			profile: LoadProfile{Type: ProfileStep, Steps: []Step{{Rate: 10, Duration: 200}, {Rate: 0}}},
+			n:       10,
+			want:    []time.Duration{0, ms(100)},
+		},
+		{
+			name:    "bursts",
+			profile: LoadProfile{Type: ProfileBurst, BurstSize: 3, BurstInterval: 100},
+			n:       7,
+			want:    []time.Duration{0, 0, 0, ms(100), ms(100), ms(100), ms(200)},
+		},
+		{
+			name:    "replay sorts offsets, expands counts and skips the header and comments",
+			profile: LoadProfile{Type: ProfileReplay, Timeline: "offset_ms,count\n250\n0,2\n# spike\n100,0\n50.5,1\n"},
+			n:       10,
+			want:    []time.Duration{0, 0, ms(50.5), ms(250)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := offsets(t, &tt.profile, tt.n)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d arrivals %v, want %d %v", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if !near(got[i], tt.want[i]) {
+					t.Errorf("arrival %d at %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProfilePoisson(t *testing.T) {
+	p := LoadProfile{Type: ProfilePoisson, Rate: 100, Seed: 42}
+	const n = 20000
+	a, b := offsets(t, &p, n), offsets(t, &p, n)
+	if a[0] != 0 {
+		t.Errorf("first arrival at %v, want 0", a[0])
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("arrival %d differs between runs with the same seed: %v and %v", i, a[i], b[i])
+		}
+		if i > 0 && a[i] < a[i-1] {
+			t.Fatalf("arrival %d at %v is before arrival %d at %v", i, a[i], i-1, a[i-1])
+		}
+	}
+	// The mean gap of 1/rate is within a few percent over this many draws
+	if mean := a[n-1] / (n - 1); mean < ms(9.5) || mean > ms(10.5) {
+		t.Errorf("mean gap %v, want about 10ms", mean)
+	}
+
+	other := offsets(t, &LoadProfile{Type: ProfilePoisson, Rate: 100, Seed: 43}, 2)
+	if other[1] == a[1] {
+		t.Errorf("seeds 42 and 43 drew the same gap %v", a[1])
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile LoadProfile
+		wantErr string
+	}{
+		{"negative constant rate", LoadProfile{Type: ProfileConstant, Rate: -1}, "non-negative rate"},
+		{"negative bucket", LoadProfile{Type: ProfileConstant, Rate: 1, BucketSize: -1}, "non-negative rate"},
+		{"ramp between zero rates", LoadProfile{Type: ProfileRamp, Duration: 1000}, "not both zero"},
+		{"ramp without duration", LoadProfile{Type: ProfileRamp, EndRate: 10}, "positive duration"},
+		{"negative ramp rate", LoadProfile{Type: ProfileRamp, StartRate: -1, EndRate: 10, Duration: 1000}, "non-negative"},
+		{"no steps", LoadProfile{Type: ProfileStep}, "at least one step"},
+		{"negative step rate", LoadProfile{Type: ProfileStep, Steps: []Step{{Rate: -1, Duration: 100}}}, "step 0"},
+		{"unbounded middle step", LoadProfile{Type: ProfileStep, Steps: []Step{{Rate: 1}, {Rate: 2}}}, "step 0"},
+		{"empty burst", LoadProfile{Type: ProfileBurst, BurstInterval: 100}, "positive burst_size"},
+		{"burst without interval", LoadProfile{Type: ProfileBurst, BurstSize: 10}, "positive burst_size"},
+		{"poisson without rate", LoadProfile{Type: ProfilePoisson}, "positive rate"},
+		{"replay without timeline", LoadProfile{Type: ProfileReplay}, "timeline or timeline_file"},
+		{"replay of a missing file", LoadProfile{Type: ProfileReplay, TimelineFile: "/nonexistent/timeline.csv"}, "failed to open timeline"},
+		{"replay with only a header", LoadProfile{Type: ProfileReplay, Timeline: "offset_ms\n"}, "no keys"},
+		{"replay with a bad offset", LoadProfile{Type: ProfileReplay, Timeline: "0\nsoon\n"}, "invalid offset on timeline row 2"},
+		{"replay with a bad count", LoadProfile{Type: ProfileReplay, Timeline: "0,many\n"}, "invalid count on timeline row 1"},
+		{"replay with a negative count", LoadProfile{Type: ProfileReplay, Timeline: "0,-1\n"}, "invalid count on timeline row 1"},
+		{"replay with a negative offset", LoadProfile{Type: ProfileReplay, Timeline: "0\n-5\n"}, "negative offset on timeline row 2"},
+		{"replay with a malformed row", LoadProfile{Type: ProfileReplay, Timeline: "0\n\"10\n"}, "failed to parse timeline"},
+		{"unknown type", LoadProfile{Type: "sine"}, `unknown load profile "sine"`},
+		{"valid unbounded last step", LoadProfile{Type: ProfileStep, Steps: []Step{{Rate: 1, Duration: 100}, {Rate: 2}}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.profile.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProfileKeyCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timeline.csv")
+	if err := os.WriteFile(path, []byte("offset_ms,count\n0,3\n100\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		profile LoadProfile
+		want    int64
+	}{
+		{"unbounded profile", LoadProfile{Type: ProfilePoisson, Rate: 1}, 0},
+		{"inline timeline", LoadProfile{Type: ProfileReplay, Timeline: "0,2\n5,0\n10\n"}, 3},
+		{"timeline file", LoadProfile{Type: ProfileReplay, TimelineFile: path}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.profile.KeyCount()
+			if err != nil {
+				t.Fatalf("KeyCount() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("KeyCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if _, err := (&LoadProfile{Type: ProfileReplay, Timeline: "x\ny\n"}).KeyCount(); err == nil {
+		t.Error("KeyCount() of an invalid timeline succeeded")
+	}
+}
+
+func TestConstantRate(t *testing.T) {
+	if p := ConstantRate(0); p.Type != ProfileConstant || p.Rate != 0 {
+		t.Errorf("ConstantRate(0) = %+v, want an unthrottled constant profile", p)
+	}
+	if p := ConstantRate(-time.Second); p.Rate != 0 {
+		t.Errorf("ConstantRate(-1s) = %+v, want an unthrottled constant profile", p)
+	}
+	if p := ConstantRate(100 * time.Millisecond); p.Type != ProfileConstant || p.Rate != 10 {
+		t.Errorf("ConstantRate(100ms) = %+v, want 10 keys/s", p)
+	}
+}
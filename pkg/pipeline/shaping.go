@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// Shaping policy types
+const (
+	PolicyThrottle = "throttle" // at most Limit events per key per Interval, on the leading and/or trailing edge
+	PolicyDebounce = "debounce" // one event once the key has been quiet for Quiet, or after MaxWait
+)
+
+// Edges a throttle policy emits on
+const (
+	EdgeLeading  = "leading"
+	EdgeTrailing = "trailing"
+	EdgeBoth     = "both"
+)
+
+const (
+	// DefaultShapeClaim is how long the notifications every consumer receives for one expiration
+	// are treated as the same event. Expirations of a key closer together than this are merged.
+	DefaultShapeClaim = 100 * time.Millisecond
+	// DefaultShapePollInterval is how often deferred emissions are checked for
+	DefaultShapePollInterval = 50 * time.Millisecond
+
+	shapeClaimBatch = 100
+)
+
+// Shaper evaluates shaping policies and hands out deferred emissions once they are due
+type Shaper interface {
+	Throttle(ctx context.Context, key string, claim time.Duration, limit int, interval time.Duration, leading, trailing bool) (redis.ShapeDecision, error)
+	Debounce(ctx context.Context, key string, claim, quiet, maxWait time.Duration) (redis.ShapeDecision, error)
+	ClaimDueShaped(ctx context.Context, max int) ([]string, error)
+}
+
+// Policy shapes the expirations of keys matching Pattern in place of the dedup window
+type Policy struct {
+	Pattern string // path.Match syntax
+	Type    string
+	Claim   time.Duration // defaults to DefaultShapeClaim
+
+	// throttle
+	Limit    int
+	Interval time.Duration
+	Leading  bool
+	Trailing bool
+
+	// debounce
+	Quiet   time.Duration
+	MaxWait time.Duration // 0 waits for quiet indefinitely
+}
+
+// PolicySpec describes a policy in the consumer configuration
+type PolicySpec struct {
+	Pattern  string `json:"pattern"`
+	Type     string `json:"type"`
+	Claim    string `json:"claim,omitempty"`    // e.g. "100ms"
+	Limit    int    `json:"limit,omitempty"`    // throttle, default 1
+	Interval string `json:"interval,omitempty"` // throttle
+	Edge     string `json:"edge,omitempty"`     // throttle: leading (default), trailing or both
+	Quiet    string `json:"quiet,omitempty"`    // debounce
+	MaxWait  string `json:"max_wait,omitempty"` // debounce
+}
+
+// ShapingConfig lists shaping policies; the first whose pattern matches a key applies
+type ShapingConfig struct {
+	Policies []PolicySpec `json:"policies"`
+}
+
+// LoadShapingConfig reads a JSON shaping configuration from path
+func LoadShapingConfig(path string) (*ShapingConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shaping config: %w", err)
+	}
+	var cfg ShapingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse shaping config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Build validates the specs and returns the policies for Options.Policies
+func (c *ShapingConfig) Build() ([]Policy, error) {
+	policies := make([]Policy, 0, len(c.Policies))
+	for i, spec := range c.Policies {
+		if _, err := path.Match(spec.Pattern, ""); err != nil || spec.Pattern == "" {
+			return nil, fmt.Errorf("policy %d: invalid pattern %q", i, spec.Pattern)
+		}
+		pol := Policy{Pattern: spec.Pattern, Type: spec.Type, Claim: DefaultShapeClaim}
+		duration := func(name, v string, required bool) (time.Duration, error) {
+			if v == "" {
+				if required {
+					return 0, fmt.Errorf("policy %d (%s): %s is required", i, spec.Pattern, name)
+				}
+				return 0, nil
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return 0, fmt.Errorf("policy %d (%s): invalid %s %q", i, spec.Pattern, name, v)
+			}
+			return d, nil
+		}
+		var err error
+		if spec.Claim != "" {
+			if pol.Claim, err = duration("claim", spec.Claim, true); err != nil {
+				return nil, err
+			}
+		}
+
+		switch spec.Type {
+		case PolicyThrottle:
+			if pol.Interval, err = duration("interval", spec.Interval, true); err != nil {
+				return nil, err
+			}
+			pol.Limit = spec.Limit
+			if pol.Limit == 0 {
+				pol.Limit = 1
+			}
+			if pol.Limit < 0 {
+				return nil, fmt.Errorf("policy %d (%s): limit must be positive", i, spec.Pattern)
+			}
+			switch spec.Edge {
+			case "", EdgeLeading:
+				pol.Leading = true
+			case EdgeTrailing:
+				pol.Trailing = true
+			case EdgeBoth:
+				pol.Leading, pol.Trailing = true, true
+			default:
+				return nil, fmt.Errorf("policy %d (%s): unknown edge %q", i, spec.Pattern, spec.Edge)
+			}
+		case PolicyDebounce:
+			if pol.Quiet, err = duration("quiet", spec.Quiet, true); err != nil {
+				return nil, err
+			}
+			if pol.MaxWait, err = duration("max_wait", spec.MaxWait, false); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("policy %d (%s): unknown type %q", i, spec.Pattern, spec.Type)
+		}
+		window := pol.Interval
+		if pol.Type == PolicyDebounce {
+			window = pol.Quiet
+		}
+		if pol.Claim >= window {
+			return nil, fmt.Errorf("policy %d (%s): claim must be shorter than the policy's interval or quiet period", i, spec.Pattern)
+		}
+		policies = append(policies, pol)
+	}
+	return policies, nil
+}
+
+// matches reports whether the policy applies to key
+func (pol *Policy) matches(key string) bool {
+	ok, _ := path.Match(pol.Pattern, key)
+	return ok
+}
+
+// defers reports whether the policy can schedule emissions for later
+func (pol *Policy) defers() bool {
+	return pol.Type == PolicyDebounce || pol.Trailing
+}
+
+// shape decides what to do with one expiration of key
+func (pol *Policy) shape(ctx context.Context, shaper Shaper, key string) (redis.ShapeDecision, error) {
+	if pol.Type == PolicyDebounce {
+		return shaper.Debounce(ctx, key, pol.Claim, pol.Quiet, pol.MaxWait)
+	}
+	return shaper.Throttle(ctx, key, pol.Claim, pol.Limit, pol.Interval, pol.Leading, pol.Trailing)
+}
+
+// policyFor returns the first policy matching key, or nil for the plain dedup window
+func (p *Pipeline) policyFor(key string) *Policy {
+	for i := range p.opts.Policies {
+		if p.opts.Policies[i].matches(key) {
+			return &p.opts.Policies[i]
+		}
+	}
+	return nil
+}
+
+// emitDeferred publishes trailing-edge and debounced emissions as they fall due, until ctx is
+// cancelled. Deferred emissions live in Redis, so any consumer may publish them.
+func (p *Pipeline) emitDeferred(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.ShapePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			keys, err := p.opts.Shaper.ClaimDueShaped(ctx, shapeClaimBatch)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Consumer %s failed to claim deferred events: %v", p.opts.ConsumerID, err)
+				}
+				break
+			}
+			// A claimed key is removed from Redis, so it is published even if ctx ends meanwhile
+			for _, key := range keys {
+				p.publish(context.WithoutCancel(ctx), p.laneFor(key), key)
+			}
+			if len(keys) < shapeClaimBatch {
+				break
+			}
+		}
+	}
+}
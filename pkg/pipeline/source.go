@@ -0,0 +1,166 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	// DefaultPollInterval is how often a PollingSource checks for due keys
+	DefaultPollInterval = 100 * time.Millisecond
+	// DefaultPollBatch caps the keys a PollingSource claims at once
+	DefaultPollBatch = 500
+	// DefaultPollLease is how long a claimed key may go unacked before it is due again
+	DefaultPollLease = 30 * time.Second
+)
+
+// EventSource feeds expired keys to the pipeline. Receive calls deliver for each key until ctx is
+// cancelled; done, if not nil, must be called once the key has been handled, and a key whose done is
+// never called may be delivered again.
+type EventSource interface {
+	Receive(ctx context.Context, deliver func(key string, done func()))
+}
+
+// NotificationSource receives keyspace expired notifications over Pub/Sub. Every consumer is
+// notified of every expiration, and a notification missed while disconnected is lost.
+type NotificationSource struct {
+	redis          *redis.Client
+	reconnectDelay time.Duration
+}
+
+// NewNotificationSource creates a source subscribed to redisClient's expired events. A zero
+// reconnectDelay selects DefaultReconnectDelay.
+func NewNotificationSource(redisClient *redis.Client, reconnectDelay time.Duration) *NotificationSource {
+	if reconnectDelay <= 0 {
+		reconnectDelay = DefaultReconnectDelay
+	}
+	return &NotificationSource{redis: redisClient, reconnectDelay: reconnectDelay}
+}
+
+// Receive processes Redis expired keys with automatic reconnection
+func (s *NotificationSource) Receive(ctx context.Context, deliver func(key string, done func())) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		log.Printf("Subscribing to Redis key expiration events...")
+		psc := s.redis.Subscribe(ctx, redis.ExpiredChannel)
+		// A blocked receive does not watch ctx, so closing the subscription is what ends it
+		stop := context.AfterFunc(ctx, func() { psc.Close() })
+
+		// Process messages until error or context cancellation
+		for {
+			msg, err := psc.ReceiveMessage(ctx)
+			if err != nil {
+				stop()
+				psc.Close()
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Error receiving message: %v, will reconnect in %v", err, s.reconnectDelay)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.reconnectDelay):
+				}
+				break
+			}
+			deliver(msg.Payload, nil)
+		}
+	}
+}
+
+// ackFlusher is an EventSource that batches acks, to be flushed after the last key is handled
+type ackFlusher interface {
+	Flush(ctx context.Context)
+}
+
+// DeadlineQueue hands out keys registered with their deadlines once they are due
+type DeadlineQueue interface {
+	ClaimDeadlines(ctx context.Context, max int, lease time.Duration) ([]string, error)
+	AckDeadlines(ctx context.Context, keys []string) error
+}
+
+// PollingSource claims due keys from a sorted set of deadlines, such as redis.DeadlineIndex, in
+// place of keyspace notifications. Each key goes to one consumer, and a key not handled within its
+// lease, because its consumer died or its tenant's queue was full, is claimed again.
+type PollingSource struct {
+	queue    DeadlineQueue
+	interval time.Duration
+	batch    int
+	lease    time.Duration
+
+	mu    sync.Mutex
+	acked []string
+}
+
+// NewPollingSource creates a source claiming from queue. Zero interval, batch and lease select
+// the defaults.
+func NewPollingSource(queue DeadlineQueue, interval time.Duration, batch int, lease time.Duration) *PollingSource {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	if batch <= 0 {
+		batch = DefaultPollBatch
+	}
+	if lease <= 0 {
+		lease = DefaultPollLease
+	}
+	return &PollingSource{queue: queue, interval: interval, batch: batch, lease: lease}
+}
+
+// Receive claims due keys every interval, and right away again while full batches keep coming
+func (s *PollingSource) Receive(ctx context.Context, deliver func(key string, done func())) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.Flush(ctx)
+		for {
+			keys, err := s.queue.ClaimDeadlines(ctx, s.batch, s.lease)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Failed to claim due keys: %v", err)
+				}
+				break
+			}
+			for _, key := range keys {
+				deliver(key, func() { s.ack(key) })
+			}
+			if len(keys) < s.batch {
+				break
+			}
+		}
+	}
+}
+
+// ack queues a handled key's lease to be released with the next poll
+func (s *PollingSource) ack(key string) {
+	s.mu.Lock()
+	s.acked = append(s.acked, key)
+	s.mu.Unlock()
+}
+
+// Flush releases the leases of keys handled since the last poll. The pipeline calls it once its
+// workers have drained on shutdown.
+func (s *PollingSource) Flush(ctx context.Context) {
+	s.mu.Lock()
+	keys := s.acked
+	s.acked = nil
+	s.mu.Unlock()
+	if err := s.queue.AckDeadlines(ctx, keys); err != nil {
+		// The leases run out and the keys are claimed again, to be suppressed by dedup
+		log.Printf("Failed to ack %d handled keys: %v", len(keys), err)
+	}
+}
@@ -0,0 +1,254 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/nats"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	// DefaultTenant receives every key no configured tenant matches
+	DefaultTenant = "default"
+	// DefaultTenantQueueSize bounds the expirations a tenant may have waiting for a worker
+	DefaultTenantQueueSize = 10000
+)
+
+// Dedup windows
+const (
+	DedupFixed   = "fixed"   // an expiration is suppressed for DedupTTL after the first one
+	DedupSliding = "sliding" // each suppressed expiration restarts the DedupTTL window
+)
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidTenantName reports whether name is 1-64 letters, digits, '-' or '_', which keeps it
+// usable in NATS subjects, durable names and Redis keys
+func ValidTenantName(name string) bool {
+	return tenantNamePattern.MatchString(name)
+}
+
+// Tenant isolates one group of keys, matched by Pattern, with its own dedup window, subject,
+// rate limit and share of the pipeline's concurrency
+type Tenant struct {
+	Name    string
+	Pattern string // path.Match syntax, e.g. "orders:*"
+	// DedupTTL defaults to Options.DedupTTL
+	DedupTTL time.Duration
+	// DedupWindow is DedupFixed (the default) or DedupSliding
+	DedupWindow string
+	// Fingerprint lists shadow fields hashed with the key name to identify an expiration, so the
+	// same key name written with different values is not collapsed. Empty dedups on the name alone.
+	Fingerprint []string
+	// Subject is published to and consumed from; empty uses the bus's default subject
+	Subject string
+	// RateLimit caps the expirations this consumer processes per second, 0 for no limit.
+	// Every consumer sees every expiration, so this also bounds the tenant's published rate.
+	RateLimit float64
+	Burst     int
+	// Share is the fraction of Options.Concurrency given to this tenant's workers.
+	// Tenants without one split what the others leave evenly.
+	Share     float64
+	QueueSize int
+	Labels    map[string]string
+}
+
+// TenantSpec describes a tenant in the consumer configuration
+type TenantSpec struct {
+	Name             string            `json:"name"`
+	Pattern          string            `json:"pattern"`
+	DedupTTL         string            `json:"dedup_ttl,omitempty"`    // e.g. "30s"
+	DedupWindow      string            `json:"dedup_window,omitempty"` // fixed (default) or sliding
+	Fingerprint      []string          `json:"fingerprint,omitempty"`  // shadow fields, e.g. ["policy_version"]
+	Subject          string            `json:"subject,omitempty"`      // defaults to <stream subject>.<name>
+	RateLimit        float64           `json:"rate_limit,omitempty"`
+	Burst            int               `json:"burst,omitempty"`
+	ConcurrencyShare float64           `json:"concurrency_share,omitempty"`
+	QueueSize        int               `json:"queue_size,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+}
+
+// TenantConfig lists tenants in match order. A tenant named "default" configures the
+// fallback for unmatched keys; its pattern is ignored.
+type TenantConfig struct {
+	Tenants []TenantSpec `json:"tenants"`
+}
+
+// LoadTenantConfig reads a JSON tenant configuration from path
+func LoadTenantConfig(path string) (*TenantConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant config: %w", err)
+	}
+	var cfg TenantConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Build validates the specs and returns the tenants for Options.Tenants
+func (c *TenantConfig) Build() ([]Tenant, error) {
+	tenants := make([]Tenant, 0, len(c.Tenants))
+	names := make(map[string]bool)
+	subjects := map[string]string{nats.Subject: DefaultTenant}
+	for i, spec := range c.Tenants {
+		if !ValidTenantName(spec.Name) {
+			return nil, fmt.Errorf("tenant %d: name %q must be 1-64 letters, digits, '-' or '_'", i, spec.Name)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("tenant %s is defined twice", spec.Name)
+		}
+		names[spec.Name] = true
+
+		t := Tenant{
+			Name:        spec.Name,
+			Pattern:     spec.Pattern,
+			DedupWindow: spec.DedupWindow,
+			Fingerprint: spec.Fingerprint,
+			RateLimit:   spec.RateLimit,
+			Burst:       spec.Burst,
+			Share:       spec.ConcurrencyShare,
+			QueueSize:   spec.QueueSize,
+			Labels:      spec.Labels,
+		}
+		if spec.Name != DefaultTenant {
+			if spec.Pattern == "" {
+				return nil, fmt.Errorf("tenant %s: pattern is required", spec.Name)
+			}
+			if _, err := path.Match(spec.Pattern, ""); err != nil {
+				return nil, fmt.Errorf("tenant %s: invalid pattern %q: %w", spec.Name, spec.Pattern, err)
+			}
+			t.Subject = spec.Subject
+			if t.Subject == "" {
+				t.Subject = nats.Subject + "." + spec.Name
+			}
+			if !strings.HasPrefix(t.Subject, nats.Subject+".") {
+				return nil, fmt.Errorf("tenant %s: subject %q must be under %s.", spec.Name, t.Subject, nats.Subject)
+			}
+			if other, ok := subjects[t.Subject]; ok {
+				return nil, fmt.Errorf("tenant %s: subject %s is already used by tenant %s", spec.Name, t.Subject, other)
+			}
+			subjects[t.Subject] = spec.Name
+		} else if spec.Subject != "" && spec.Subject != nats.Subject {
+			return nil, fmt.Errorf("tenant %s: the default tenant always uses %s", spec.Name, nats.Subject)
+		}
+		if spec.DedupTTL != "" {
+			d, err := time.ParseDuration(spec.DedupTTL)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("tenant %s: invalid dedup_ttl %q", spec.Name, spec.DedupTTL)
+			}
+			t.DedupTTL = d
+		}
+		if spec.DedupWindow != "" && spec.DedupWindow != DedupFixed && spec.DedupWindow != DedupSliding {
+			return nil, fmt.Errorf("tenant %s: dedup_window must be %s or %s", spec.Name, DedupFixed, DedupSliding)
+		}
+		for _, field := range spec.Fingerprint {
+			if field == "" {
+				return nil, fmt.Errorf("tenant %s: fingerprint fields must not be empty", spec.Name)
+			}
+		}
+		if spec.RateLimit < 0 || spec.Burst < 0 || spec.QueueSize < 0 {
+			return nil, fmt.Errorf("tenant %s: rate_limit, burst and queue_size must not be negative", spec.Name)
+		}
+		if spec.ConcurrencyShare < 0 || spec.ConcurrencyShare > 1 {
+			return nil, fmt.Errorf("tenant %s: concurrency_share must be between 0 and 1", spec.Name)
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// settings describes a tenant as registered for the API
+func (t Tenant) settings(workers int) redis.TenantSettings {
+	return redis.TenantSettings{
+		Pattern:     t.Pattern,
+		DedupTTLMs:  t.DedupTTL.Milliseconds(),
+		DedupWindow: t.DedupWindow,
+		Fingerprint: t.Fingerprint,
+		Subject:     t.Subject,
+		RateLimit:   t.RateLimit,
+		Burst:       t.Burst,
+		Concurrency: workers,
+		QueueSize:   t.QueueSize,
+		Labels:      t.Labels,
+	}
+}
+
+// buildLanes gives each tenant, plus the default tenant if it is not configured, a lane with
+// its share of concurrency. The default lane is returned separately since it matches last.
+func buildLanes(opts Options) (lanes []*lane, fallback *lane, err error) {
+	tenants := append([]Tenant(nil), opts.Tenants...)
+	explicit, unset := 0.0, 0
+	hasDefault := false
+	for _, t := range tenants {
+		if t.Name == DefaultTenant {
+			hasDefault = true
+		}
+		if t.Share > 0 {
+			explicit += t.Share
+		} else {
+			unset++
+		}
+	}
+	if !hasDefault {
+		tenants = append(tenants, Tenant{Name: DefaultTenant})
+		unset++
+	}
+	rest := 0.0
+	if unset > 0 {
+		rest = math.Max(0, 1-explicit) / float64(unset)
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range tenants {
+		if t.Name == "" {
+			return nil, nil, errors.New("pipeline: tenant name is required")
+		}
+		if seen[t.Name] {
+			return nil, nil, fmt.Errorf("pipeline: tenant %s is defined twice", t.Name)
+		}
+		seen[t.Name] = true
+		if t.DedupTTL <= 0 {
+			t.DedupTTL = opts.DedupTTL
+		}
+		if t.QueueSize <= 0 {
+			t.QueueSize = DefaultTenantQueueSize
+		}
+		if t.DedupWindow == "" {
+			t.DedupWindow = DedupFixed
+		}
+		if t.DedupWindow == DedupSliding {
+			if _, ok := opts.Deduplicator.(SlidingDeduplicator); !ok {
+				return nil, nil, fmt.Errorf("pipeline: tenant %s has a sliding dedup window but the deduplicator cannot slide it", t.Name)
+			}
+		} else if t.DedupWindow != DedupFixed {
+			return nil, nil, fmt.Errorf("pipeline: tenant %s has unknown dedup window %q", t.Name, t.DedupWindow)
+		}
+		share := t.Share
+		if share <= 0 {
+			share = rest
+		}
+		if t.Subject != "" {
+			if _, ok := opts.Bus.(SubjectBus); !ok {
+				return nil, nil, fmt.Errorf("pipeline: tenant %s has its own subject but the bus cannot publish to it", t.Name)
+			}
+		}
+		workers := max(1, int(math.Round(share*float64(opts.Concurrency))))
+		l := newLane(t, workers)
+		if t.Name == DefaultTenant {
+			fallback = l
+			continue
+		}
+		lanes = append(lanes, l)
+	}
+	return lanes, fallback, nil
+}
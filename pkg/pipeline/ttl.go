@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// TTL distribution types
+const (
+	TTLFixed       = "fixed"       // every key gets TTL
+	TTLUniform     = "uniform"     // uniform in [Min, Max]
+	TTLNormal      = "normal"      // normal with Mean and StdDev, clamped to [Min, Max]
+	TTLExponential = "exponential" // exponential with Mean, clamped to [Min, Max]
+	TTLHerd        = "herd"        // keys expire together At after the run starts, HerdSize at a time
+)
+
+// minTTL keeps sampled TTLs positive; Redis deletes keys with a past deadline without an expired event
+const minTTL = time.Millisecond
+
+// TTLDistribution describes how long each generated key lives. All durations are in milliseconds.
+type TTLDistribution struct {
+	Type         string `json:"type"`
+	TTL          int64  `json:"ttl,omitempty"`           // fixed
+	Min          int64  `json:"min,omitempty"`           // uniform, and lower clamp for normal/exponential
+	Max          int64  `json:"max,omitempty"`           // uniform, and upper clamp for normal/exponential
+	Mean         int64  `json:"mean,omitempty"`          // normal, exponential
+	StdDev       int64  `json:"stddev,omitempty"`        // normal
+	At           int64  `json:"at,omitempty"`            // herd: first deadline, relative to the run start
+	HerdSize     int64  `json:"herd_size,omitempty"`     // herd: keys sharing a deadline, 0 for all
+	HerdInterval int64  `json:"herd_interval,omitempty"` // herd: gap between successive deadlines
+	Seed         int64  `json:"seed,omitempty"`          // random seed, 0 picks one
+	// Absolute sets expiry with PEXPIREAT at the computed deadline instead of a relative TTL.
+	// Herds always use absolute deadlines so their keys expire on the same millisecond.
+	Absolute bool `json:"absolute,omitempty"`
+}
+
+// ttlSampler computes the expiry of key seq generated at now
+type ttlSampler func(seq int64, now time.Time) redis.KeyExpiry
+
+// Validate checks the distribution parameters
+func (d *TTLDistribution) Validate() error {
+	_, err := d.sampler(time.Now())
+	return err
+}
+
+// MaxTTL returns an upper bound on the TTL of a run of numKeys keys, used to decide when the run has settled
+func (d *TTLDistribution) MaxTTL(numKeys int64) time.Duration {
+	ms := func(v int64) time.Duration { return time.Duration(v) * time.Millisecond }
+	switch d.Type {
+	case TTLUniform:
+		return ms(d.Max)
+	case TTLNormal, TTLExponential:
+		if d.Max > 0 {
+			return ms(d.Max)
+		}
+		if d.Type == TTLNormal {
+			return ms(d.Mean + 4*d.StdDev)
+		}
+		return ms(10 * d.Mean)
+	case TTLHerd:
+		herds := int64(0)
+		if d.HerdSize > 0 && numKeys > 0 {
+			herds = (numKeys - 1) / d.HerdSize
+		}
+		return ms(d.At + herds*d.HerdInterval)
+	default:
+		return ms(d.TTL)
+	}
+}
+
+// sampler returns the per-key expiry function for a run that started at start
+func (d *TTLDistribution) sampler(start time.Time) (ttlSampler, error) {
+	if d.Min < 0 || d.Max < 0 || (d.Max > 0 && d.Min > d.Max) {
+		return nil, errors.New("ttl min and max must be non-negative with min <= max")
+	}
+	seed := d.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	ms := func(v float64) time.Duration { return time.Duration(v * float64(time.Millisecond)) }
+
+	var sample func(seq int64) time.Duration
+	switch d.Type {
+	case TTLFixed, "":
+		if d.TTL <= 0 {
+			return nil, errors.New("fixed ttl needs a positive ttl")
+		}
+		sample = func(int64) time.Duration { return ms(float64(d.TTL)) }
+
+	case TTLUniform:
+		if d.Max <= 0 {
+			return nil, errors.New("uniform ttl needs a positive max")
+		}
+		sample = func(int64) time.Duration {
+			return ms(float64(d.Min) + rng.Float64()*float64(d.Max-d.Min))
+		}
+
+	case TTLNormal:
+		if d.Mean <= 0 || d.StdDev < 0 {
+			return nil, errors.New("normal ttl needs a positive mean and non-negative stddev")
+		}
+		sample = func(int64) time.Duration {
+			return d.clamp(ms(float64(d.Mean) + rng.NormFloat64()*float64(d.StdDev)))
+		}
+
+	case TTLExponential:
+		if d.Mean <= 0 {
+			return nil, errors.New("exponential ttl needs a positive mean")
+		}
+		sample = func(int64) time.Duration {
+			return d.clamp(ms(rng.ExpFloat64() * float64(d.Mean)))
+		}
+
+	case TTLHerd:
+		if d.At <= 0 || d.HerdSize < 0 || d.HerdInterval < 0 {
+			return nil, errors.New("herd ttl needs a positive at and non-negative herd_size and herd_interval")
+		}
+		// Deadlines are truncated to the millisecond so every key in a herd shares one
+		first := start.Add(ms(float64(d.At))).Truncate(time.Millisecond)
+		return func(seq int64, now time.Time) redis.KeyExpiry {
+			deadline := first
+			if d.HerdSize > 0 {
+				deadline = deadline.Add(time.Duration(seq/d.HerdSize) * ms(float64(d.HerdInterval)))
+			}
+			if !deadline.After(now) {
+				deadline = now.Add(minTTL)
+			}
+			return redis.KeyExpiry{Seq: seq, Deadline: deadline}
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown ttl distribution %q", d.Type)
+	}
+
+	return func(seq int64, now time.Time) redis.KeyExpiry {
+		ttl := max(sample(seq), minTTL)
+		if d.Absolute {
+			return redis.KeyExpiry{Seq: seq, Deadline: now.Add(ttl)}
+		}
+		return redis.KeyExpiry{Seq: seq, TTL: ttl}
+	}, nil
+}
+
+func (d *TTLDistribution) clamp(ttl time.Duration) time.Duration {
+	ttl = max(ttl, time.Duration(d.Min)*time.Millisecond)
+	if d.Max > 0 {
+		ttl = min(ttl, time.Duration(d.Max)*time.Millisecond)
+	}
+	return ttl
+}
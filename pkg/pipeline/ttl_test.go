@@ -0,0 +1,208 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// sample draws n expiries from d for a run started at start, each generated at now
+func sample(t *testing.T, d TTLDistribution, start, now time.Time, n int64) []redis.KeyExpiry {
+	t.Helper()
+	sampler, err := d.sampler(start)
+	if err != nil {
+		t.Fatalf("sampler() failed: %v", err)
+	}
+	got := make([]redis.KeyExpiry, n)
+	for seq := range n {
+		got[seq] = sampler(seq, now)
+	}
+	return got
+}
+
+func TestTTLValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		dist    TTLDistribution
+		wantErr string
+	}{
+		{"fixed", TTLDistribution{Type: TTLFixed, TTL: 100}, ""},
+		{"empty type is fixed", TTLDistribution{TTL: 100}, ""},
+		{"fixed without ttl", TTLDistribution{Type: TTLFixed}, "positive ttl"},
+		{"negative min", TTLDistribution{Type: TTLUniform, Min: -1, Max: 10}, "min <= max"},
+		{"negative max", TTLDistribution{Type: TTLNormal, Mean: 10, Max: -1}, "min <= max"},
+		{"min above max", TTLDistribution{Type: TTLUniform, Min: 20, Max: 10}, "min <= max"},
+		{"uniform", TTLDistribution{Type: TTLUniform, Min: 10, Max: 10}, ""},
+		{"uniform without max", TTLDistribution{Type: TTLUniform, Min: 10}, "positive max"},
+		{"normal", TTLDistribution{Type: TTLNormal, Mean: 100}, ""},
+		{"normal without mean", TTLDistribution{Type: TTLNormal, StdDev: 10}, "positive mean"},
+		{"normal with negative stddev", TTLDistribution{Type: TTLNormal, Mean: 100, StdDev: -1}, "non-negative stddev"},
+		{"exponential without mean", TTLDistribution{Type: TTLExponential, Max: 100}, "positive mean"},
+		{"herd", TTLDistribution{Type: TTLHerd, At: 100}, ""},
+		{"herd without at", TTLDistribution{Type: TTLHerd, HerdSize: 10}, "positive at"},
+		{"herd with negative size", TTLDistribution{Type: TTLHerd, At: 100, HerdSize: -1}, "non-negative herd_size"},
+		{"herd with negative interval", TTLDistribution{Type: TTLHerd, At: 100, HerdInterval: -1}, "non-negative herd_size"},
+		{"unknown type", TTLDistribution{Type: "pareto", Mean: 100}, `unknown ttl distribution "pareto"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.dist.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTTLSampleBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		dist     TTLDistribution
+		min, max time.Duration
+	}{
+		{"fixed", TTLDistribution{Type: TTLFixed, TTL: 250}, ms(250), ms(250)},
+		{"uniform", TTLDistribution{Type: TTLUniform, Min: 100, Max: 200}, ms(100), ms(200)},
+		{"degenerate uniform", TTLDistribution{Type: TTLUniform, Min: 50, Max: 50}, ms(50), ms(50)},
+		{"uniform from zero is kept positive", TTLDistribution{Type: TTLUniform, Max: 1}, minTTL, ms(1)},
+		{"normal clamped", TTLDistribution{Type: TTLNormal, Mean: 100, StdDev: 100, Min: 80, Max: 120}, ms(80), ms(120)},
+		{"normal clamped to the minimum ttl", TTLDistribution{Type: TTLNormal, Mean: 1, StdDev: 1000}, minTTL, time.Hour},
+		{"normal without spread", TTLDistribution{Type: TTLNormal, Mean: 100}, ms(100), ms(100)},
+		{"exponential clamped", TTLDistribution{Type: TTLExponential, Mean: 100, Min: 50, Max: 150}, ms(50), ms(150)},
+		{"exponential clamped to the minimum ttl", TTLDistribution{Type: TTLExponential, Mean: 1}, minTTL, time.Hour},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.dist.Seed = 1
+			var sawMin, sawMax bool
+			for _, e := range sample(t, tt.dist, now, now, 5000) {
+				if !e.Deadline.IsZero() {
+					t.Fatalf("key %d has deadline %v, want a relative ttl", e.Seq, e.Deadline)
+				}
+				if e.TTL < tt.min || e.TTL > tt.max {
+					t.Fatalf("key %d has ttl %v, want within [%v, %v]", e.Seq, e.TTL, tt.min, tt.max)
+				}
+				sawMin = sawMin || e.TTL == tt.min
+				sawMax = sawMax || e.TTL == tt.max
+			}
+			// Clamped distributions pile up on their bounds
+			if tt.dist.Min > 0 && tt.dist.Type != TTLUniform && !sawMin {
+				t.Errorf("no ttl was clamped to %v", tt.min)
+			}
+			if tt.dist.Max > 0 && tt.dist.Type != TTLUniform && !sawMax {
+				t.Errorf("no ttl was clamped to %v", tt.max)
+			}
+			if tt.max == time.Hour && !sawMin {
+				t.Errorf("no ttl was raised to %v", minTTL)
+			}
+		})
+	}
+}
+
+func TestTTLSeeded(t *testing.T) {
+	now := time.Now()
+	for _, typ := range []string{TTLUniform, TTLNormal, TTLExponential} {
+		t.Run(typ, func(t *testing.T) {
+			d := TTLDistribution{Type: typ, Min: 10, Max: 1000, Mean: 200, StdDev: 50, Seed: 7}
+			a, b := sample(t, d, now, now, 100), sample(t, d, now, now, 100)
+			distinct := map[time.Duration]bool{}
+			for i := range a {
+				if a[i] != b[i] {
+					t.Fatalf("key %d differs between runs with the same seed: %+v and %+v", i, a[i], b[i])
+				}
+				distinct[a[i].TTL] = true
+			}
+			if len(distinct) < 50 {
+				t.Errorf("drew %d distinct ttls from 100 keys", len(distinct))
+			}
+			d.Seed = 8
+			if c := sample(t, d, now, now, 1); c[0] == a[0] {
+				t.Errorf("seeds 7 and 8 drew the same ttl %v", a[0].TTL)
+			}
+		})
+	}
+}
+
+func TestTTLAbsolute(t *testing.T) {
+	now := time.Now()
+	got := sample(t, TTLDistribution{Type: TTLFixed, TTL: 250, Absolute: true}, now, now, 1)[0]
+	if got.TTL != 0 || !got.Deadline.Equal(now.Add(ms(250))) {
+		t.Errorf("got %+v, want a deadline of %v", got, now.Add(ms(250)))
+	}
+}
+
+func TestTTLHerd(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	first := time.Date(2024, 1, 1, 0, 0, 1, 123000000, time.UTC) // start+1s, truncated to the millisecond
+	tests := []struct {
+		name string
+		dist TTLDistribution
+		now  time.Time
+		want []time.Time
+	}{
+		{
+			name: "one herd",
+			dist: TTLDistribution{Type: TTLHerd, At: 1000, HerdInterval: 500},
+			now:  start,
+			want: []time.Time{first, first, first},
+		},
+		{
+			name: "herds of two",
+			dist: TTLDistribution{Type: TTLHerd, At: 1000, HerdSize: 2, HerdInterval: 500},
+			now:  start,
+			want: []time.Time{first, first, first.Add(ms(500)), first.Add(ms(500)), first.Add(ms(1000))},
+		},
+		{
+			name: "past deadlines expire right away",
+			dist: TTLDistribution{Type: TTLHerd, At: 1000, HerdSize: 1, HerdInterval: 500},
+			now:  first.Add(ms(500)),
+			want: []time.Time{first.Add(ms(500) + minTTL), first.Add(ms(500) + minTTL), first.Add(ms(1000))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sample(t, tt.dist, start, tt.now, int64(len(tt.want)))
+			for i, e := range got {
+				if e.TTL != 0 || !e.Deadline.Equal(tt.want[i]) {
+					t.Errorf("key %d expires %+v, want a deadline of %v", i, e, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTTLMaxTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		dist    TTLDistribution
+		numKeys int64
+		want    time.Duration
+	}{
+		{"fixed", TTLDistribution{Type: TTLFixed, TTL: 300}, 10, ms(300)},
+		{"empty type is fixed", TTLDistribution{TTL: 300}, 10, ms(300)},
+		{"uniform", TTLDistribution{Type: TTLUniform, Min: 100, Max: 200}, 10, ms(200)},
+		{"normal with max", TTLDistribution{Type: TTLNormal, Mean: 100, StdDev: 50, Max: 150}, 10, ms(150)},
+		{"normal without max", TTLDistribution{Type: TTLNormal, Mean: 100, StdDev: 50}, 10, ms(300)},
+		{"exponential with max", TTLDistribution{Type: TTLExponential, Mean: 100, Max: 400}, 10, ms(400)},
+		{"exponential without max", TTLDistribution{Type: TTLExponential, Mean: 100}, 10, ms(1000)},
+		{"single herd", TTLDistribution{Type: TTLHerd, At: 1000, HerdInterval: 500}, 10, ms(1000)},
+		{"herds of three", TTLDistribution{Type: TTLHerd, At: 1000, HerdSize: 3, HerdInterval: 500}, 10, ms(2500)},
+		{"exactly full herds", TTLDistribution{Type: TTLHerd, At: 1000, HerdSize: 5, HerdInterval: 500}, 10, ms(1500)},
+		{"herd of an unbounded run", TTLDistribution{Type: TTLHerd, At: 1000, HerdSize: 5, HerdInterval: 500}, 0, ms(1000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dist.MaxTTL(tt.numKeys); got != tt.want {
+				t.Errorf("MaxTTL(%d) = %v, want %v", tt.numKeys, got, tt.want)
+			}
+		})
+	}
+}
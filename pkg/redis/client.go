@@ -3,35 +3,91 @@ package redis
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/secure"
 )
 
+// Keys are namespaced per run as gen-key:<run>:<seq> and metrics:<run>:<name>.
+// An empty run ID selects the legacy un-namespaced keys (gen-key:<seq>, metrics:<name>).
 const (
 	KeyPrefix        = "gen-key:"
 	DedupPrefix      = "dedup:"
-	MetricsGenerated = "metrics:generated"
-	MetricsConsumed  = "metrics:consumed"
-	MetricsConsumer  = "metrics:consumer:" // Prefix for per-consumer metrics
+	MetricsPrefix    = "metrics:"
+	MetricsGenerated = "generated"
+	MetricsConsumed  = "consumed"
+	MetricsConsumers = "consumers" // Hash of consumer ID to events processed
+	MetricsConsumer  = "consumer:" // Prefix of legacy per-consumer counter keys, see MigrateConsumerMetrics
+	ExpiredChannel   = "__keyevent@0__:expired"
 )
 
 type Client struct {
 	rdb *redis.Client
 }
 
+// Options configures the connection to Redis
+type Options struct {
+	Addr     string
+	Username secure.Secret // ACL user, empty for the default user
+	Password secure.Secret
+	TLS      secure.TLSConfig
+}
+
+// OptionsFromEnv returns options for addr with credentials and TLS read from REDIS_USERNAME,
+// REDIS_PASSWORD (or their _FILE variants) and REDIS_TLS_*
+func OptionsFromEnv(addr string) Options {
+	return Options{
+		Addr:     addr,
+		Username: secure.SecretFromEnv("REDIS_USERNAME"),
+		Password: secure.SecretFromEnv("REDIS_PASSWORD"),
+		TLS:      secure.TLSFromEnv("REDIS"),
+	}
+}
+
 // NewClient creates a new Redis client
 func NewClient(addr string) (*Client, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr: addr,
-	})
+	return NewClientWithOptions(Options{Addr: addr})
+}
+
+// NewClientWithOptions creates a new Redis client with authentication and TLS.
+// Credentials and certificates are re-read for each new connection, so rotated files take effect
+// as the pool reconnects.
+func NewClientWithOptions(opts Options) (*Client, error) {
+	tlsConfig, err := opts.TLS.Build(opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis TLS config: %w", err)
+	}
+
+	redisOpts := &redis.Options{
+		Addr:      opts.Addr,
+		TLSConfig: tlsConfig,
+	}
+	if opts.Username.IsSet() || opts.Password.IsSet() {
+		username, password := opts.Username.Source(), opts.Password.Source()
+		redisOpts.CredentialsProviderContext = func(ctx context.Context) (string, string, error) {
+			user, err := username()
+			if err != nil {
+				return "", "", fmt.Errorf("failed to load Redis username: %w", err)
+			}
+			pass, err := password()
+			if err != nil {
+				return "", "", fmt.Errorf("failed to load Redis password: %w", err)
+			}
+			return user, pass, nil
+		}
+	}
+	rdb := redis.NewClient(redisOpts)
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
@@ -43,21 +99,107 @@ func (c *Client) Subscribe(ctx context.Context, channels ...string) *redis.PubSu
 	return c.rdb.Subscribe(ctx, channels...)
 }
 
-// GenerateKey creates a new key with expiration
-func (c *Client) GenerateKey(ctx context.Context, seqNum int64, ttl time.Duration) error {
-	key := fmt.Sprintf("%s%d", KeyPrefix, seqNum)
-	if err := c.rdb.Set(ctx, key, seqNum, ttl).Err(); err != nil {
-		return fmt.Errorf("failed to set key %s: %w", key, err)
+// RunKey returns the generated key name for seqNum within a run
+func RunKey(runID string, seqNum int64) string {
+	if runID == "" {
+		return fmt.Sprintf("%s%d", KeyPrefix, seqNum)
 	}
+	return fmt.Sprintf("%s%s:%d", KeyPrefix, runID, seqNum)
+}
 
+// ParseKey splits a generated key into its run ID and sequence number
+func ParseKey(key string) (runID string, seqNum int64, ok bool) {
+	rest, ok := strings.CutPrefix(key, KeyPrefix)
+	if !ok {
+		return "", 0, false
+	}
+	if i := strings.LastIndexByte(rest, ':'); i >= 0 {
+		runID, rest = rest[:i], rest[i+1:]
+	}
+	seqNum, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil || seqNum < 0 {
+		return "", 0, false
+	}
+	return runID, seqNum, true
+}
+
+func metricsKey(runID, name string) string {
+	if runID == "" {
+		return MetricsPrefix + name
+	}
+	return MetricsPrefix + runID + ":" + name
+}
+
+// GenerateKey creates a new key with expiration, plus a side record of its intended
+// expiry time that outlives the key so consumers can measure notification latency
+func (c *Client) GenerateKey(ctx context.Context, runID string, seqNum int64, ttl time.Duration) error {
+	return c.GenerateKeys(ctx, runID, []KeyExpiry{{Seq: seqNum, TTL: ttl}})
+}
+
+// KeyExpiry is when a generated key expires: after TTL, or at Deadline via PEXPIREAT if it is set
+type KeyExpiry struct {
+	Seq      int64
+	TTL      time.Duration
+	Deadline time.Time
+	Shadow   bool // also record the key's value in its shadow, for consumers that capture values
+	Index    bool // also add the key to DeadlineIndex, for consumers polling it
+}
+
+// GenerateKeys creates a batch of run keys in a single pipelined round trip. Each key is written
+// with its expiry in one command, so it cannot be left without one.
+func (c *Client) GenerateKeys(ctx context.Context, runID string, keys []KeyExpiry) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	now := time.Now()
+
+	pipe := c.rdb.Pipeline()
+	keyCmds := make([][]redis.Cmder, len(keys))
+	for i, k := range keys {
+		key := RunKey(runID, k.Seq)
+		deadline := k.Deadline
+		var cmds []redis.Cmder
+		if deadline.IsZero() {
+			deadline = now.Add(k.TTL)
+			cmds = append(cmds, pipe.Set(ctx, key, k.Seq, k.TTL))
+		} else {
+			// SetArgs.ExpireAt would send EXAT, which drops the milliseconds
+			cmds = append(cmds, pipe.Do(ctx, "set", key, k.Seq, "pxat", deadline.UnixMilli()))
+		}
+		cmds = append(cmds, pipe.Set(ctx, ExpiryPrefix+key, deadline.UnixMilli(), deadline.Sub(now)+expiryRecordGrace))
+		if k.Index {
+			cmds = append(cmds, pipe.ZAdd(ctx, DeadlineIndex, redis.Z{Score: float64(deadline.UnixMilli()), Member: key}))
+		}
+		if k.Shadow {
+			shadow := ShadowPrefix + key
+			cmds = append(cmds, pipe.HSet(ctx, shadow, ShadowValue, k.Seq), pipe.PExpire(ctx, shadow, deadline.Sub(now)+shadowGrace))
+		}
+		keyCmds[i] = cmds
+	}
 	// Increment generated keys metric
-	if err := c.rdb.Incr(ctx, MetricsGenerated).Err(); err != nil {
+	incrCmd := pipe.IncrBy(ctx, metricsKey(runID, MetricsGenerated), int64(len(keys)))
+	pipe.Exec(ctx)
+
+	for i, cmds := range keyCmds {
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				return fmt.Errorf("failed to set key %s: %s: %w", RunKey(runID, keys[i].Seq), cmd.Name(), err)
+			}
+		}
+	}
+	if err := incrCmd.Err(); err != nil {
 		return fmt.Errorf("failed to increment generated metric: %w", err)
 	}
 
 	return nil
 }
 
+// IsInternalKey reports whether key is pipeline bookkeeping whose expiration must not be processed
+func IsInternalKey(key string) bool {
+	return strings.HasPrefix(key, DedupPrefix) || strings.HasPrefix(key, ExpiryPrefix) ||
+		strings.HasPrefix(key, ShapePrefix) || strings.HasPrefix(key, ShadowPrefix)
+}
+
 // CreateDedupKey creates a deduplication key if it doesn't exist
 func (c *Client) CreateDedupKey(ctx context.Context, originalKey string, ttl time.Duration) (bool, error) {
 	dedupKey := DedupPrefix + originalKey
@@ -71,19 +213,60 @@ func (c *Client) CreateDedupKey(ctx context.Context, originalKey string, ttl tim
 	return ok, nil
 }
 
-// IncrementConsumed increments the consumed keys metric
-func (c *Client) IncrementConsumed(ctx context.Context) error {
-	if err := c.rdb.Incr(ctx, MetricsConsumed).Err(); err != nil {
+// CreateDedupKeys creates a batch of deduplication keys with pipelined SETNX.
+// The result reports, per key, whether this call created it. If any SETNX fails, the keys
+// this call did create are deleted again, so that no key stays claimed by a failed batch.
+func (c *Client) CreateDedupKeys(ctx context.Context, originalKeys []string, ttl time.Duration) ([]bool, error) {
+	pipe := c.rdb.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(originalKeys))
+	for i, key := range originalKeys {
+		cmds[i] = pipe.SetNX(ctx, DedupPrefix+key, 1, ttl)
+	}
+	if len(cmds) > 0 {
+		pipe.Exec(ctx)
+	}
+
+	created := make([]bool, len(cmds))
+	var claimed []string
+	var failed error
+	for i, cmd := range cmds {
+		ok, err := cmd.Result()
+		if err != nil {
+			if failed == nil {
+				failed = fmt.Errorf("failed to set dedup key %s: %w", DedupPrefix+originalKeys[i], err)
+			}
+			continue
+		}
+		created[i] = ok
+		if ok {
+			claimed = append(claimed, DedupPrefix+originalKeys[i])
+		}
+	}
+	if failed == nil {
+		return created, nil
+	}
+
+	if len(claimed) > 0 {
+		if err := c.rdb.Del(ctx, claimed...).Err(); err != nil {
+			return nil, fmt.Errorf("%w (releasing %d claimed dedup keys also failed: %v)", failed, len(claimed), err)
+		}
+	}
+	return nil, failed
+}
+
+// IncrementConsumed increments the consumed keys metric of a run
+func (c *Client) IncrementConsumed(ctx context.Context, runID string) error {
+	if err := c.rdb.Incr(ctx, metricsKey(runID, MetricsConsumed)).Err(); err != nil {
 		return fmt.Errorf("failed to increment consumed metric: %w", err)
 	}
 	return nil
 }
 
-// GetMetrics returns the current metrics
-func (c *Client) GetMetrics(ctx context.Context) (generated, consumed int64, err error) {
+// GetMetrics returns the current metrics of a run
+func (c *Client) GetMetrics(ctx context.Context, runID string) (generated, consumed int64, err error) {
 	pipe := c.rdb.Pipeline()
-	genCmd := pipe.Get(ctx, MetricsGenerated)
-	consCmd := pipe.Get(ctx, MetricsConsumed)
+	genCmd := pipe.Get(ctx, metricsKey(runID, MetricsGenerated))
+	consCmd := pipe.Get(ctx, metricsKey(runID, MetricsConsumed))
 
 	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
 		return 0, 0, fmt.Errorf("failed to get metrics: %w", err)
@@ -94,23 +277,12 @@ func (c *Client) GetMetrics(ctx context.Context) (generated, consumed int64, err
 	return generated, consumed, nil
 }
 
-// ResetMetrics resets all metrics to zero
-func (c *Client) ResetMetrics(ctx context.Context) error {
-	// Get all consumer metric keys
-	pattern := MetricsConsumer + "*"
-	keys, err := c.rdb.Keys(ctx, pattern).Result()
-	if err != nil {
-		return fmt.Errorf("failed to get consumer metrics keys: %w", err)
-	}
-
+// ResetMetrics resets all metrics of a run to zero
+func (c *Client) ResetMetrics(ctx context.Context, runID string) error {
 	pipe := c.rdb.Pipeline()
-	pipe.Set(ctx, MetricsGenerated, 0, 0)
-	pipe.Set(ctx, MetricsConsumed, 0, 0)
-
-	// Delete all consumer metrics
-	if len(keys) > 0 {
-		pipe.Del(ctx, keys...)
-	}
+	pipe.Set(ctx, metricsKey(runID, MetricsGenerated), 0, 0)
+	pipe.Set(ctx, metricsKey(runID, MetricsConsumed), 0, 0)
+	pipe.Del(ctx, metricsKey(runID, MetricsConsumers))
 
 	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to reset metrics: %w", err)
@@ -123,45 +295,62 @@ func (c *Client) Close() error {
 	return c.rdb.Close()
 }
 
-// IncrementConsumerMetric increments the metric for a specific consumer
-func (c *Client) IncrementConsumerMetric(ctx context.Context, consumerID string) error {
-	key := MetricsConsumer + consumerID
-	if err := c.rdb.Incr(ctx, key).Err(); err != nil {
+// IncrementConsumerMetric increments the metric of a run for a specific consumer
+func (c *Client) IncrementConsumerMetric(ctx context.Context, runID, consumerID string) error {
+	if err := c.rdb.HIncrBy(ctx, metricsKey(runID, MetricsConsumers), consumerID, 1).Err(); err != nil {
 		return fmt.Errorf("failed to increment consumer metric for %s: %w", consumerID, err)
 	}
 	return nil
 }
 
-// GetConsumerMetrics returns a map of consumer IDs to their processed event counts
-func (c *Client) GetConsumerMetrics(ctx context.Context) (map[string]int64, error) {
-	pattern := MetricsConsumer + "*"
-	keys, err := c.rdb.Keys(ctx, pattern).Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get consumer metrics keys: %w", err)
-	}
+// ConsumerCount identifies a consumer's event counter within a run
+type ConsumerCount struct {
+	RunID      string
+	ConsumerID string
+}
 
-	metrics := make(map[string]int64)
-	if len(keys) == 0 {
-		return metrics, nil
-	}
+// MetricsBatch holds consumption counts accumulated locally since the last flush
+type MetricsBatch struct {
+	Consumed  map[string]int64        // run ID to events consumed
+	Consumers map[ConsumerCount]int64 // events consumed per consumer and run
+	Tenants   map[TenantCount]int64   // tenant usage counters
+}
 
-	// Get all values in a single pipeline
+// AddMetrics applies a batch of consumption counts in a single pipelined round trip
+func (c *Client) AddMetrics(ctx context.Context, batch MetricsBatch) error {
+	if len(batch.Consumed) == 0 && len(batch.Consumers) == 0 && len(batch.Tenants) == 0 {
+		return nil
+	}
 	pipe := c.rdb.Pipeline()
-	cmds := make(map[string]*redis.StringCmd)
-	for _, key := range keys {
-		cmds[key] = pipe.Get(ctx, key)
+	for runID, n := range batch.Consumed {
+		pipe.IncrBy(ctx, metricsKey(runID, MetricsConsumed), n)
 	}
-
-	_, err = pipe.Exec(ctx)
-	if err != nil && err != redis.Nil {
-		return nil, fmt.Errorf("failed to get consumer metrics values: %w", err)
+	for cc, n := range batch.Consumers {
+		pipe.HIncrBy(ctx, metricsKey(cc.RunID, MetricsConsumers), cc.ConsumerID, n)
+	}
+	for tc, n := range batch.Tenants {
+		pipe.HIncrBy(ctx, TenantUsagePrefix+tc.Tenant, tc.Field, n)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to add metrics: %w", err)
 	}
+	return nil
+}
 
-	for key, cmd := range cmds {
-		val, _ := cmd.Int64()
-		consumerID := strings.TrimPrefix(key, MetricsConsumer)
-		metrics[consumerID] = val
+// GetConsumerMetrics returns a map of consumer IDs to their processed event counts in a run
+func (c *Client) GetConsumerMetrics(ctx context.Context, runID string) (map[string]int64, error) {
+	fields, err := c.rdb.HGetAll(ctx, metricsKey(runID, MetricsConsumers)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get consumer metrics: %w", err)
 	}
 
+	metrics := make(map[string]int64, len(fields))
+	for consumerID, v := range fields {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid consumer metric for %s: %w", consumerID, err)
+		}
+		metrics[consumerID] = n
+	}
 	return metrics, nil
 }
@@ -0,0 +1,136 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ConsumerRegistry is a hash of consumer ID to the unix ms time of its last heartbeat
+const ConsumerRegistry = "consumers:registry"
+
+// migrateScanCount is the SCAN batch size used when migrating legacy keys
+const migrateScanCount = 500
+
+// ConsumerInfo is a registered consumer and when it was last heard from
+type ConsumerInfo struct {
+	ID       string    `json:"id"`
+	LastSeen time.Time `json:"last_seen"`
+	Stale    bool      `json:"stale"` // no heartbeat within the stale threshold
+}
+
+// Heartbeat registers a consumer as alive now
+func (c *Client) Heartbeat(ctx context.Context, consumerID string) error {
+	if err := c.rdb.HSet(ctx, ConsumerRegistry, consumerID, time.Now().UnixMilli()).Err(); err != nil {
+		return fmt.Errorf("failed to record heartbeat for %s: %w", consumerID, err)
+	}
+	return nil
+}
+
+// RemoveConsumer drops a consumer from the registry. It returns false if it was not registered.
+func (c *Client) RemoveConsumer(ctx context.Context, consumerID string) (bool, error) {
+	n, err := c.rdb.HDel(ctx, ConsumerRegistry, consumerID).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove consumer %s: %w", consumerID, err)
+	}
+	return n > 0, nil
+}
+
+// ListConsumers returns every registered consumer sorted by ID, marking those not seen within staleAfter
+func (c *Client) ListConsumers(ctx context.Context, staleAfter time.Duration) ([]ConsumerInfo, error) {
+	fields, err := c.rdb.HGetAll(ctx, ConsumerRegistry).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list consumers: %w", err)
+	}
+
+	now := time.Now()
+	consumers := make([]ConsumerInfo, 0, len(fields))
+	for id, v := range fields {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		lastSeen := time.UnixMilli(ms)
+		consumers = append(consumers, ConsumerInfo{ID: id, LastSeen: lastSeen, Stale: now.Sub(lastSeen) > staleAfter})
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].ID < consumers[j].ID })
+	return consumers, nil
+}
+
+// PruneConsumers removes consumers not seen within staleAfter and returns their IDs
+func (c *Client) PruneConsumers(ctx context.Context, staleAfter time.Duration) ([]string, error) {
+	consumers, err := c.ListConsumers(ctx, staleAfter)
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, info := range consumers {
+		if info.Stale {
+			stale = append(stale, info.ID)
+		}
+	}
+	if len(stale) == 0 {
+		return nil, nil
+	}
+	if err := c.rdb.HDel(ctx, ConsumerRegistry, stale...).Err(); err != nil {
+		return nil, fmt.Errorf("failed to prune consumers: %w", err)
+	}
+	return stale, nil
+}
+
+// migrateConsumerKeyScript folds a legacy per-consumer counter key into its run's consumer hash.
+// KEYS[1] is the legacy key and KEYS[2] the hash; ARGV[1] is the consumer ID.
+var migrateConsumerKeyScript = redis.NewScript(`
+local n = redis.call('GET', KEYS[1])
+if not n then
+	return 0
+end
+redis.call('HINCRBY', KEYS[2], ARGV[1], n)
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// MigrateConsumerMetrics folds legacy metrics:[<run>:]consumer:<id> counter keys into the per-run
+// consumer hashes, walking the keyspace with SCAN. It returns the number of keys migrated.
+func (c *Client) MigrateConsumerMetrics(ctx context.Context) (int64, error) {
+	var migrated int64
+	iter := c.rdb.Scan(ctx, 0, MetricsPrefix+"*"+MetricsConsumer+"*", migrateScanCount).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		runID, consumerID, ok := parseLegacyConsumerKey(key)
+		if !ok {
+			continue
+		}
+		n, err := migrateConsumerKeyScript.Run(ctx, c.rdb, []string{key, metricsKey(runID, MetricsConsumers)}, consumerID).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return migrated, fmt.Errorf("failed to migrate %s: %w", key, err)
+		}
+		migrated += n
+	}
+	if err := iter.Err(); err != nil {
+		return migrated, fmt.Errorf("failed to scan legacy consumer metrics: %w", err)
+	}
+	return migrated, nil
+}
+
+// parseLegacyConsumerKey splits metrics:consumer:<id> or metrics:<run>:consumer:<id>
+func parseLegacyConsumerKey(key string) (runID, consumerID string, ok bool) {
+	rest, ok := strings.CutPrefix(key, MetricsPrefix)
+	if !ok {
+		return "", "", false
+	}
+	if consumerID, ok := strings.CutPrefix(rest, MetricsConsumer); ok {
+		return "", consumerID, consumerID != ""
+	}
+	runID, consumerID, ok = strings.Cut(rest, ":"+MetricsConsumer)
+	if !ok || runID == "" || consumerID == "" || strings.Contains(runID, ":") {
+		return "", "", false
+	}
+	return runID, consumerID, true
+}
@@ -0,0 +1,65 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	DeadlineIndex  = "deadlines:due"    // sorted set of keys scored by the unix ms they are due
+	DeadlineLeases = "deadlines:leased" // sorted set of claimed keys scored by the unix ms their lease ends
+)
+
+// claimDeadlinesScript moves up to ARGV[1] due keys from index KEYS[1] to leases KEYS[2] for ARGV[2] ms
+// and returns them. Keys whose lease ran out without an ack are due again first.
+var claimDeadlinesScript = redis.NewScript(redisNowMs + `
+local max = tonumber(ARGV[1])
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now, 'LIMIT', 0, max)
+for _, key in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], key)
+	redis.call('ZADD', KEYS[1], 0, key)
+end
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, max)
+for _, key in ipairs(due) do
+	redis.call('ZREM', KEYS[1], key)
+	redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), key)
+end
+return due
+`)
+
+// RegisterDeadline adds key to the deadline index, due at at, for consumers polling it in place of
+// keyspace notifications. Registering a key again moves its deadline.
+func (c *Client) RegisterDeadline(ctx context.Context, key string, at time.Time) error {
+	if err := c.rdb.ZAdd(ctx, DeadlineIndex, redis.Z{Score: float64(at.UnixMilli()), Member: key}).Err(); err != nil {
+		return fmt.Errorf("failed to register deadline of %s: %w", key, err)
+	}
+	return nil
+}
+
+// ClaimDeadlines leases up to max due keys to the caller for lease and returns them. Each due key
+// goes to one caller, and comes due again if it is not acked before its lease ends.
+func (c *Client) ClaimDeadlines(ctx context.Context, max int, lease time.Duration) ([]string, error) {
+	keys, err := claimDeadlinesScript.Run(ctx, c.rdb, []string{DeadlineIndex, DeadlineLeases}, max, lease.Milliseconds()).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim due deadlines: %w", err)
+	}
+	return keys, nil
+}
+
+// AckDeadlines releases the leases of handled keys
+func (c *Client) AckDeadlines(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(keys))
+	for i, key := range keys {
+		members[i] = key
+	}
+	if err := c.rdb.ZRem(ctx, DeadlineLeases, members...).Err(); err != nil {
+		return fmt.Errorf("failed to ack %d deadlines: %w", len(keys), err)
+	}
+	return nil
+}
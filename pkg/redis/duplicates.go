@@ -0,0 +1,132 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Injected duplicate classes, relative to the consumers' dedup window
+const (
+	DuplicateWithin   = "within"   // expires again inside the window and must be suppressed
+	DuplicateOutside  = "outside"  // expires again after the window and must be delivered again
+	DuplicateBoundary = "boundary" // too close to the window edge to call either way
+)
+
+// InjectedDuplicate is a generated key re-created to expire a second time at Deadline
+type InjectedDuplicate struct {
+	Seq      int64
+	Deadline time.Time
+	Class    string
+	Index    bool // also add the key to DeadlineIndex again, for consumers polling it
+}
+
+// InjectionReport compares injected duplicates against what the consumers delivered
+type InjectionReport struct {
+	Injected       int64   `json:"injected"`
+	Within         int64   `json:"within"`
+	Outside        int64   `json:"outside"`
+	Boundary       int64   `json:"boundary"`
+	Suppressed     int64   `json:"suppressed"`      // within-window duplicates that were not delivered again
+	Redelivered    int64   `json:"redelivered"`     // outside-window duplicates that were delivered again
+	Unsuppressed   []int64 `json:"unsuppressed"`    // within-window duplicates delivered again
+	NotRedelivered []int64 `json:"not_redelivered"` // outside-window duplicates never delivered again
+}
+
+// recreateKeysScript re-creates expired keys with an absolute deadline and records each one injected.
+// KEYS[1] is the run's injected hash and KEYS[2] the deadline index, followed by key and expiry record
+// pairs; ARGV[1] is the expiry record grace in ms followed by seq, deadline, class and index
+// quadruples, a key with index "1" being added to the deadline index again. A key that still exists
+// is left alone so its first expiry is never overwritten. It returns the number of keys re-created.
+var recreateKeysScript = redis.NewScript(`
+local created = 0
+for i = 3, #KEYS, 2 do
+	local a = (i - 3) / 2 * 4 + 2
+	local seq, deadline, class, index = ARGV[a], ARGV[a + 1], ARGV[a + 2], ARGV[a + 3]
+	if redis.call('SET', KEYS[i], seq, 'NX', 'PXAT', deadline) then
+		redis.call('SET', KEYS[i + 1], deadline, 'PXAT', tonumber(deadline) + tonumber(ARGV[1]))
+		redis.call('HSET', KEYS[1], seq, class)
+		if index == '1' then
+			redis.call('ZADD', KEYS[2], deadline, KEYS[i])
+		end
+		created = created + 1
+	end
+end
+return created
+`)
+
+// RecreateKeys re-creates a batch of expired run keys so each expires again at its deadline.
+// It returns the number of keys re-created.
+func (c *Client) RecreateKeys(ctx context.Context, runID string, dups []InjectedDuplicate) (int64, error) {
+	if len(dups) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, 0, 2+2*len(dups))
+	args := make([]interface{}, 0, 1+4*len(dups))
+	keys = append(keys, ledgerKey(runID, "injected"), DeadlineIndex)
+	args = append(args, expiryRecordGrace.Milliseconds())
+	for _, d := range dups {
+		key := RunKey(runID, d.Seq)
+		keys = append(keys, key, ExpiryPrefix+key)
+		index := "0"
+		if d.Index {
+			index = "1"
+		}
+		args = append(args, d.Seq, d.Deadline.UnixMilli(), d.Class, index)
+	}
+
+	created, err := recreateKeysScript.Run(ctx, c.rdb, keys, args...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-create keys for run %s: %w", runID, err)
+	}
+	return created, nil
+}
+
+// verifyInjected removes the expected second deliveries of injected duplicates from dups
+// and reports how the injected duplicates were handled
+func verifyInjected(injected map[string]string, dups map[int64][]string) *InjectionReport {
+	r := &InjectionReport{Unsuppressed: []int64{}, NotRedelivered: []int64{}}
+	for field, class := range injected {
+		seq, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		r.Injected++
+		delivered := len(dups[seq]) > 0
+
+		switch class {
+		case DuplicateWithin:
+			r.Within++
+			if delivered {
+				r.Unsuppressed = append(r.Unsuppressed, seq)
+			} else {
+				r.Suppressed++
+			}
+		case DuplicateOutside:
+			r.Outside++
+			if delivered {
+				r.Redelivered++
+			} else {
+				r.NotRedelivered = append(r.NotRedelivered, seq)
+			}
+		case DuplicateBoundary:
+			r.Boundary++
+		}
+
+		// One extra delivery is expected outside the window and acceptable on its edge
+		if delivered && class != DuplicateWithin {
+			if len(dups[seq]) == 1 {
+				delete(dups, seq)
+			} else {
+				dups[seq] = dups[seq][1:]
+			}
+		}
+	}
+	sort.Slice(r.Unsuppressed, func(a, b int) bool { return r.Unsuppressed[a] < r.Unsuppressed[b] })
+	sort.Slice(r.NotRedelivered, func(a, b int) bool { return r.NotRedelivered[a] < r.NotRedelivered[b] })
+	return r
+}
@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ExpiryPrefix  = "expiry:"  // expiry:<key> holds the intended expiry time in unix milliseconds
+	LatencyPrefix = "latency:" // latency:<run>:<stage> holds a bucketed histogram
+
+	// Latency stages
+	StageNotification = "notification"  // scheduled expiry to consumer receipt of the Redis notification
+	StageDedupPublish = "dedup_publish" // notification receipt to NATS publish acknowledged
+	StageQueue        = "queue"         // NATS publish to handler receipt
+
+	// expiryRecordGrace keeps the side record around after the key itself expires
+	expiryRecordGrace = 10 * time.Minute
+)
+
+// LatencyBuckets are the histogram upper bounds in milliseconds; larger samples fall into "inf"
+var LatencyBuckets = []int64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000, 60000}
+
+// LatencySummary summarizes one latency stage of a run
+type LatencySummary struct {
+	Count   int64            `json:"count"`
+	MeanMs  float64          `json:"mean_ms"`
+	MaxMs   float64          `json:"max_ms"`
+	P50Ms   float64          `json:"p50_ms"`
+	P95Ms   float64          `json:"p95_ms"`
+	P99Ms   float64          `json:"p99_ms"`
+	Buckets map[string]int64 `json:"buckets"` // "le_<ms>" and "inf" to sample count
+}
+
+// recordLatencyScript adds a sample to a histogram hash
+var recordLatencyScript = redis.NewScript(`
+local us = tonumber(ARGV[2])
+redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+redis.call('HINCRBY', KEYS[1], 'count', 1)
+redis.call('HINCRBY', KEYS[1], 'sum_us', us)
+local max = redis.call('HGET', KEYS[1], 'max_us')
+if not max or tonumber(max) < us then
+	redis.call('HSET', KEYS[1], 'max_us', us)
+end
+return 1
+`)
+
+func bucketField(d time.Duration) string {
+	ms := d.Milliseconds()
+	for _, le := range LatencyBuckets {
+		if ms < le {
+			return "le_" + strconv.FormatInt(le, 10)
+		}
+	}
+	return "inf"
+}
+
+// GetKeyDeadline returns the intended expiry time recorded for a generated key
+func (c *Client) GetKeyDeadline(ctx context.Context, key string) (time.Time, error) {
+	ms, err := c.rdb.Get(ctx, ExpiryPrefix+key).Int64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get deadline for %s: %w", key, err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// RecordLatency adds a latency sample for stage to a run's histogram. Samples outside a run are dropped.
+func (c *Client) RecordLatency(ctx context.Context, runID, stage string, d time.Duration) error {
+	if runID == "" {
+		return nil
+	}
+	if d < 0 {
+		d = 0
+	}
+	key := LatencyPrefix + runID + ":" + stage
+	if err := recordLatencyScript.Run(ctx, c.rdb, []string{key}, bucketField(d), d.Microseconds()).Err(); err != nil {
+		return fmt.Errorf("failed to record %s latency: %w", stage, err)
+	}
+	return nil
+}
+
+// GetLatency returns the latency summaries for every stage recorded in a run
+func (c *Client) GetLatency(ctx context.Context, runID string) (map[string]LatencySummary, error) {
+	stages := []string{StageNotification, StageDedupPublish, StageQueue}
+
+	pipe := c.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(stages))
+	for i, stage := range stages {
+		cmds[i] = pipe.HGetAll(ctx, LatencyPrefix+runID+":"+stage)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get latency for run %s: %w", runID, err)
+	}
+
+	summaries := make(map[string]LatencySummary)
+	for i, stage := range stages {
+		fields := cmds[i].Val()
+		if len(fields) == 0 {
+			continue
+		}
+		summaries[stage] = summarize(fields)
+	}
+	return summaries, nil
+}
+
+func summarize(fields map[string]string) LatencySummary {
+	count, _ := strconv.ParseInt(fields["count"], 10, 64)
+	sumUs, _ := strconv.ParseInt(fields["sum_us"], 10, 64)
+	maxUs, _ := strconv.ParseInt(fields["max_us"], 10, 64)
+
+	s := LatencySummary{
+		Count:   count,
+		MaxMs:   float64(maxUs) / 1000,
+		Buckets: make(map[string]int64),
+	}
+	if count > 0 {
+		s.MeanMs = float64(sumUs) / 1000 / float64(count)
+	}
+
+	counts := make([]int64, len(LatencyBuckets)+1)
+	for field, v := range fields {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		if field == "inf" {
+			counts[len(LatencyBuckets)] = n
+			s.Buckets[field] = n
+			continue
+		}
+		le, ok := strings.CutPrefix(field, "le_")
+		if !ok {
+			continue
+		}
+		bound, _ := strconv.ParseInt(le, 10, 64)
+		for i, b := range LatencyBuckets {
+			if b == bound {
+				counts[i] = n
+			}
+		}
+		s.Buckets[field] = n
+	}
+
+	s.P50Ms = percentile(counts, count, 0.50, s.MaxMs)
+	s.P95Ms = percentile(counts, count, 0.95, s.MaxMs)
+	s.P99Ms = percentile(counts, count, 0.99, s.MaxMs)
+	return s
+}
+
+// percentile estimates the q-th quantile by linear interpolation within its bucket
+func percentile(counts []int64, total int64, q float64, maxMs float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var cumulative int64
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if float64(cumulative+n) >= rank {
+			lower := 0.0
+			if i > 0 {
+				lower = float64(LatencyBuckets[i-1])
+			}
+			upper := maxMs
+			if i < len(LatencyBuckets) && float64(LatencyBuckets[i]) < maxMs {
+				upper = float64(LatencyBuckets[i])
+			}
+			return lower + (upper-lower)*(rank-float64(cumulative))/float64(n)
+		}
+		cumulative += n
+	}
+	return maxMs
+}
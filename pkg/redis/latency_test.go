@@ -0,0 +1,119 @@
+package redis
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBucketField(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "le_1"},
+		{999 * time.Microsecond, "le_1"},
+		{time.Millisecond, "le_2"},
+		{5 * time.Millisecond, "le_10"},
+		{59999 * time.Millisecond, "le_60000"},
+		{time.Minute, "inf"},
+		{time.Hour, "inf"},
+	}
+	for _, tt := range tests {
+		if got := bucketField(tt.d); got != tt.want {
+			t.Errorf("bucketField(%v) = %s, want %s", tt.d, got, tt.want)
+		}
+	}
+}
+
+// histogram builds the hash recordLatencyScript would write for samples given in milliseconds
+func histogram(samples ...float64) map[string]string {
+	fields := make(map[string]string)
+	add := func(field string, n int64) {
+		v, _ := strconv.ParseInt(fields[field], 10, 64)
+		fields[field] = strconv.FormatInt(v+n, 10)
+	}
+	var maxUs int64
+	for _, ms := range samples {
+		d := time.Duration(ms * float64(time.Millisecond))
+		add(bucketField(d), 1)
+		add("count", 1)
+		add("sum_us", d.Microseconds())
+		maxUs = max(maxUs, d.Microseconds())
+	}
+	if len(samples) > 0 {
+		fields["max_us"] = strconv.FormatInt(maxUs, 10)
+	}
+	return fields
+}
+
+func repeat(ms float64, n int) []float64 {
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = ms
+	}
+	return samples
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name          string
+		samples       []float64
+		count         int64
+		mean, max     float64
+		p50, p95, p99 float64
+	}{
+		{name: "empty"},
+		{name: "zero latency", samples: []float64{0}, count: 1},
+		// A single sample interpolates within its bucket up to the sample itself
+		{name: "single sample", samples: []float64{3.4}, count: 1, mean: 3.4, max: 3.4, p50: 2.7, p95: 3.33, p99: 3.386},
+		{name: "on a bucket boundary", samples: []float64{5}, count: 1, mean: 5, max: 5, p50: 5, p95: 5, p99: 5},
+		{name: "beyond the last bucket", samples: []float64{90000}, count: 1, mean: 90000, max: 90000, p50: 75000, p95: 88500, p99: 89700},
+		{
+			// Ranks that end exactly on a bucket's cumulative count stay in that bucket
+			name:    "ranks on bucket edges",
+			samples: append(repeat(0.5, 50), repeat(9, 50)...),
+			count:   100, mean: 4.75, max: 9,
+			p50: 1, p95: 8.6, p99: 8.92,
+		},
+		{
+			name:    "tail in a higher bucket",
+			samples: append(repeat(1.5, 98), 150, 150),
+			count:   100, mean: 4.47, max: 150,
+			p50: 1.5102, p95: 1.9694, p99: 125,
+		},
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-3 }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := summarize(histogram(tt.samples...))
+			if s.Count != tt.count || !near(s.MeanMs, tt.mean) || !near(s.MaxMs, tt.max) {
+				t.Errorf("count %d, mean %.3f, max %.3f; want %d, %.3f, %.3f", s.Count, s.MeanMs, s.MaxMs, tt.count, tt.mean, tt.max)
+			}
+			if !near(s.P50Ms, tt.p50) || !near(s.P95Ms, tt.p95) || !near(s.P99Ms, tt.p99) {
+				t.Errorf("p50 %.4f, p95 %.4f, p99 %.4f; want %.4f, %.4f, %.4f", s.P50Ms, s.P95Ms, s.P99Ms, tt.p50, tt.p95, tt.p99)
+			}
+			if s.P50Ms > s.P95Ms || s.P95Ms > s.P99Ms || s.P99Ms > s.MaxMs {
+				t.Errorf("percentiles out of order: %+v", s)
+			}
+			var buckets int64
+			for _, n := range s.Buckets {
+				buckets += n
+			}
+			if buckets != s.Count {
+				t.Errorf("buckets hold %d samples, want %d", buckets, s.Count)
+			}
+		})
+	}
+}
+
+func TestSummarizeIgnoresUnknownFields(t *testing.T) {
+	fields := histogram(3, 3)
+	fields["le_7"] = "5" // not a configured bound
+	fields["other"] = "x"
+	s := summarize(fields)
+	if s.Count != 2 || s.P99Ms > s.MaxMs {
+		t.Errorf("summary %+v, want the two samples only", s)
+	}
+}
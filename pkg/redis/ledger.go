@@ -0,0 +1,198 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	LedgerPrefix = "ledger:" // ledger:<run>:{expected,seen,owner,duplicates,injected}
+
+	// MaxMissingListed caps the missing sequence numbers a verification lists; MissingCount has them all
+	MaxMissingListed = 1000
+)
+
+// ErrRunNotFound is returned when a run has no ledger
+var ErrRunNotFound = errors.New("run not found")
+
+// Duplicate is a sequence number consumed more than once
+type Duplicate struct {
+	Seq       int64    `json:"seq"`
+	Consumers []string `json:"consumers"` // first consumer followed by each duplicate consumer
+}
+
+// Verification is the exactly-once report for a run
+type Verification struct {
+	RunID               string      `json:"run_id"`
+	Expected            int64       `json:"expected"`
+	Consumed            int64       `json:"consumed"` // distinct sequence numbers consumed
+	Missing             []int64     `json:"missing"`  // the lowest MaxMissingListed missing sequence numbers
+	MissingCount        int64       `json:"missing_count"`
+	Duplicates          []Duplicate `json:"duplicates"`
+	DuplicateDeliveries int64       `json:"duplicate_deliveries"`
+	// Injection is present when the generator injected duplicates into the run
+	Injection *InjectionReport `json:"injection,omitempty"`
+	OK        bool             `json:"ok"`
+}
+
+// recordConsumptionScript marks a sequence number as seen in a run's bitmap.
+// It returns 1 for a duplicate and 0 for a first delivery.
+var recordConsumptionScript = redis.NewScript(`
+if redis.call('SETBIT', KEYS[1], ARGV[1], 1) == 1 then
+	redis.call('RPUSH', KEYS[2], ARGV[1] .. '=' .. ARGV[2])
+	return 1
+end
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+return 0
+`)
+
+func ledgerKey(runID, name string) string {
+	return LedgerPrefix + runID + ":" + name
+}
+
+// InitRunLedger creates the verification ledger for a run with its expected key count
+func (c *Client) InitRunLedger(ctx context.Context, runID string, expected int64) error {
+	if err := c.rdb.Set(ctx, ledgerKey(runID, "expected"), expected, 0).Err(); err != nil {
+		return fmt.Errorf("failed to initialize ledger for run %s: %w", runID, err)
+	}
+	return nil
+}
+
+// SetRunExpected updates the number of keys a run is expected to consume
+func (c *Client) SetRunExpected(ctx context.Context, runID string, expected int64) error {
+	if err := c.rdb.Set(ctx, ledgerKey(runID, "expected"), expected, 0).Err(); err != nil {
+		return fmt.Errorf("failed to set expected count for run %s: %w", runID, err)
+	}
+	return nil
+}
+
+// RecordConsumption records that consumerID consumed key in the key's run.
+// It reports whether the key had already been consumed. Keys outside a run are not recorded.
+func (c *Client) RecordConsumption(ctx context.Context, key, consumerID string) (bool, error) {
+	runID, seq, ok := ParseKey(key)
+	if !ok || runID == "" {
+		return false, nil
+	}
+
+	keys := []string{ledgerKey(runID, "seen"), ledgerKey(runID, "duplicates"), ledgerKey(runID, "owner")}
+	res, err := recordConsumptionScript.Run(ctx, c.rdb, keys, seq, consumerID).Int64()
+	if err != nil {
+		return false, fmt.Errorf("failed to record consumption of %s: %w", key, err)
+	}
+	return res == 1, nil
+}
+
+// RunProgress returns a run's expected key count and how many distinct keys have been consumed
+func (c *Client) RunProgress(ctx context.Context, runID string) (expected, consumed int64, err error) {
+	pipe := c.rdb.Pipeline()
+	expectedCmd := pipe.Get(ctx, ledgerKey(runID, "expected"))
+	seenCmd := pipe.BitCount(ctx, ledgerKey(runID, "seen"), nil)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, fmt.Errorf("failed to read progress for run %s: %w", runID, err)
+	}
+
+	expected, err = expectedCmd.Int64()
+	if err == redis.Nil {
+		return 0, 0, ErrRunNotFound
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read expected count for run %s: %w", runID, err)
+	}
+	return expected, seenCmd.Val(), nil
+}
+
+// VerifyRun compares the consumption ledger of a run against its expected key count
+func (c *Client) VerifyRun(ctx context.Context, runID string) (*Verification, error) {
+	pipe := c.rdb.Pipeline()
+	expectedCmd := pipe.Get(ctx, ledgerKey(runID, "expected"))
+	seenCmd := pipe.Get(ctx, ledgerKey(runID, "seen"))
+	dupCmd := pipe.LRange(ctx, ledgerKey(runID, "duplicates"), 0, -1)
+	injectedCmd := pipe.HGetAll(ctx, ledgerKey(runID, "injected"))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read ledger for run %s: %w", runID, err)
+	}
+
+	expected, err := expectedCmd.Int64()
+	if err == redis.Nil {
+		return nil, ErrRunNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expected count for run %s: %w", runID, err)
+	}
+	seen, _ := seenCmd.Bytes()
+
+	v := &Verification{
+		RunID:      runID,
+		Expected:   expected,
+		Missing:    []int64{},
+		Duplicates: []Duplicate{},
+	}
+	for seq := int64(0); seq < expected; seq++ {
+		if bitSet(seen, seq) {
+			v.Consumed++
+		} else {
+			if v.MissingCount < MaxMissingListed {
+				v.Missing = append(v.Missing, seq)
+			}
+			v.MissingCount++
+		}
+	}
+
+	// Group duplicate deliveries by sequence number
+	dups := make(map[int64][]string)
+	for _, entry := range dupCmd.Val() {
+		seqStr, consumerID, _ := strings.Cut(entry, "=")
+		seq, err := strconv.ParseInt(seqStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		dups[seq] = append(dups[seq], consumerID)
+	}
+	if injected := injectedCmd.Val(); len(injected) > 0 {
+		v.Injection = verifyInjected(injected, dups)
+	}
+	for _, consumers := range dups {
+		v.DuplicateDeliveries += int64(len(consumers))
+	}
+
+	if len(dups) > 0 {
+		fields := make([]string, 0, len(dups))
+		for seq := range dups {
+			fields = append(fields, strconv.FormatInt(seq, 10))
+		}
+		owners, err := c.rdb.HMGet(ctx, ledgerKey(runID, "owner"), fields...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ledger owners for run %s: %w", runID, err)
+		}
+		for i, field := range fields {
+			seq, _ := strconv.ParseInt(field, 10, 64)
+			consumers := dups[seq]
+			if owner, ok := owners[i].(string); ok {
+				consumers = append([]string{owner}, consumers...)
+			}
+			v.Duplicates = append(v.Duplicates, Duplicate{Seq: seq, Consumers: consumers})
+		}
+		sort.Slice(v.Duplicates, func(a, b int) bool { return v.Duplicates[a].Seq < v.Duplicates[b].Seq })
+	}
+
+	v.OK = v.MissingCount == 0 && v.DuplicateDeliveries == 0
+	if v.Injection != nil && len(v.Injection.NotRedelivered) > 0 {
+		v.OK = false
+	}
+	return v, nil
+}
+
+// bitSet reports whether bit n is set in a Redis bitmap (most significant bit first)
+func bitSet(bitmap []byte, n int64) bool {
+	i := n / 8
+	if i >= int64(len(bitmap)) {
+		return false
+	}
+	return bitmap[i]&(0x80>>(n%8)) != 0
+}
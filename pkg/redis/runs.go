@@ -0,0 +1,202 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RunPrefix = "runs:"      // runs:<id> is a hash holding the run record
+	RunIndex  = "runs:index" // sorted set of run IDs scored by start time
+)
+
+// Run statuses
+const (
+	RunRunning   = "running"
+	RunCompleted = "completed"
+	RunStopped   = "stopped"
+)
+
+// Run states
+const (
+	RunGenerating = "generating" // keys are still being written
+	RunDraining   = "draining"   // generation is over and keys are still expiring or being consumed
+	RunSettled    = "settled"    // every key was consumed, or consumption stopped making progress
+	RunTimedOut   = "timed_out"  // draining did not finish within the drain timeout
+)
+
+// Reasons a run finished draining
+const (
+	SettledAllConsumed = "all_consumed"
+	SettledQuiet       = "quiet_period"
+	SettledTimeout     = "timeout"
+)
+
+// RunOutcome is the final verdict on a run once it has finished draining
+type RunOutcome struct {
+	Reason     string `json:"reason"`
+	Expected   int64  `json:"expected"`
+	Consumed   int64  `json:"consumed"` // distinct keys consumed
+	Lost       int64  `json:"lost"`
+	Duplicates int64  `json:"duplicates"` // unexpected duplicate deliveries
+	OK         bool   `json:"ok"`
+}
+
+// RunMetrics is the metrics snapshot taken when a run is finalized
+type RunMetrics struct {
+	Generated int64            `json:"generated"`
+	Consumed  int64            `json:"consumed"`
+	Consumers map[string]int64 `json:"consumers"`
+}
+
+// RunRecord describes a single test run
+type RunRecord struct {
+	ID        string          `json:"id"`
+	Status    string          `json:"status"`
+	State     string          `json:"state,omitempty"`
+	Config    json.RawMessage `json:"config"`
+	StartedAt time.Time       `json:"started_at"`
+	EndedAt   *time.Time      `json:"ended_at,omitempty"`
+	Metrics   *RunMetrics     `json:"metrics,omitempty"`
+	Outcome   *RunOutcome     `json:"outcome,omitempty"`
+}
+
+// SaveRun creates or updates a run record and indexes it by start time
+func (c *Client) SaveRun(ctx context.Context, run *RunRecord) error {
+	fields := map[string]interface{}{
+		"id":         run.ID,
+		"status":     run.Status,
+		"state":      run.State,
+		"config":     string(run.Config),
+		"started_at": run.StartedAt.Format(time.RFC3339Nano),
+	}
+	if run.EndedAt != nil {
+		fields["ended_at"] = run.EndedAt.Format(time.RFC3339Nano)
+	}
+	if run.Metrics != nil {
+		metrics, err := json.Marshal(run.Metrics)
+		if err != nil {
+			return fmt.Errorf("failed to encode metrics for run %s: %w", run.ID, err)
+		}
+		fields["metrics"] = string(metrics)
+	}
+	if run.Outcome != nil {
+		outcome, err := json.Marshal(run.Outcome)
+		if err != nil {
+			return fmt.Errorf("failed to encode outcome for run %s: %w", run.ID, err)
+		}
+		fields["outcome"] = string(outcome)
+	}
+
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(ctx, RunPrefix+run.ID, fields)
+	pipe.ZAdd(ctx, RunIndex, redis.Z{Score: float64(run.StartedAt.UnixMilli()), Member: run.ID})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to save run %s: %w", run.ID, err)
+	}
+	return nil
+}
+
+// GetRun returns a run record, or ErrRunNotFound
+func (c *Client) GetRun(ctx context.Context, runID string) (*RunRecord, error) {
+	fields, err := c.rdb.HGetAll(ctx, RunPrefix+runID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get run %s: %w", runID, err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrRunNotFound
+	}
+	return parseRun(fields)
+}
+
+// ListRuns returns up to limit runs, most recent first
+func (c *Client) ListRuns(ctx context.Context, limit int64) ([]*RunRecord, error) {
+	ids, err := c.rdb.ZRevRange(ctx, RunIndex, 0, limit-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+
+	pipe := c.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, RunPrefix+id)
+	}
+	if len(ids) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to get runs: %w", err)
+		}
+	}
+
+	runs := make([]*RunRecord, 0, len(ids))
+	for _, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		run, err := parseRun(fields)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// LatestRunID returns the most recently started run, or "" if there are none
+func (c *Client) LatestRunID(ctx context.Context) (string, error) {
+	ids, err := c.rdb.ZRevRange(ctx, RunIndex, 0, 0).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to get latest run: %w", err)
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return ids[0], nil
+}
+
+func parseRun(fields map[string]string) (*RunRecord, error) {
+	run := &RunRecord{
+		ID:     fields["id"],
+		Status: fields["status"],
+		State:  fields["state"],
+		Config: json.RawMessage(fields["config"]),
+	}
+	if len(run.Config) == 0 {
+		run.Config = json.RawMessage("null")
+	}
+
+	startedAt, err := time.Parse(time.RFC3339Nano, fields["started_at"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid start time for run %s: %w", run.ID, err)
+	}
+	run.StartedAt = startedAt
+
+	if v, ok := fields["ended_at"]; ok {
+		endedAt, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end time for run %s: %w", run.ID, err)
+		}
+		run.EndedAt = &endedAt
+	}
+
+	if v, ok := fields["metrics"]; ok {
+		var metrics RunMetrics
+		if err := json.Unmarshal([]byte(v), &metrics); err != nil {
+			return nil, fmt.Errorf("invalid metrics for run %s: %w", run.ID, err)
+		}
+		run.Metrics = &metrics
+	}
+
+	if v, ok := fields["outcome"]; ok {
+		var outcome RunOutcome
+		if err := json.Unmarshal([]byte(v), &outcome); err != nil {
+			return nil, fmt.Errorf("invalid outcome for run %s: %w", run.ID, err)
+		}
+		run.Outcome = &outcome
+	}
+	return run, nil
+}
@@ -0,0 +1,199 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	JobPrefix = "job:"     // job:<id> expires when the job is due; its payload is in the key's shadow
+	JobIndex  = "jobs:due" // sorted set of scheduled job IDs scored by due unix ms
+	JobDueAt  = "due_at"   // shadow field holding the job's due unix ms
+	JobID     = "job_id"   // shadow field holding the job's ID
+)
+
+var (
+	// ErrJobExists is returned when scheduling a job whose ID is already scheduled
+	ErrJobExists = errors.New("job already scheduled")
+	// ErrJobNotFound is returned for a job that is not scheduled, or has already fired
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobInPast is returned when a job is scheduled for a time that has already passed
+	ErrJobInPast = errors.New("job must be scheduled in the future")
+)
+
+var jobIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// ValidJobID reports whether id is 1-128 letters, digits, '.', '_', ':' or '-'
+func ValidJobID(id string) bool {
+	return jobIDPattern.MatchString(id)
+}
+
+// Scheduler runs delayed jobs on key expiry: each job is a key that expires when the job is due,
+// with its payload in the key's shadow, so the pipeline delivers it deduplicated like any other key.
+// Jobs' deadlines are registered in DeadlineIndex too, so consumers fire them with either source.
+type Scheduler struct {
+	c *Client
+}
+
+// NewScheduler creates a scheduler storing jobs in client
+func NewScheduler(client *Client) *Scheduler {
+	return &Scheduler{c: client}
+}
+
+// Job is a scheduled delayed job
+type Job struct {
+	ID      string    `json:"id"`
+	At      time.Time `json:"at"`
+	Payload string    `json:"payload"`
+}
+
+// pruneJobIndex drops jobs from index KEYS[3] once their shadows have expired, with their entries in
+// deadline index KEYS[5], which nothing claims when consumers do not poll it. The scripts that change
+// jobs run it so List never has to write.
+var pruneJobIndex = fmt.Sprintf(`
+local stale = now - %d
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', stale)) do
+	redis.call('ZREM', KEYS[5], %q .. id)
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', stale)
+`, shadowGrace.Milliseconds(), JobPrefix)
+
+// scheduleJobScript creates job key KEYS[1] expiring at ARGV[3] unix ms, with its shadow KEYS[2],
+// index KEYS[3] and deadline KEYS[5], and deletes dedup key KEYS[4] and lease KEYS[6] left by an
+// earlier job with the same ID, so the new one is neither suppressed nor claimed early when the lease
+// runs out. It returns 0 if the job exists and -1 if ARGV[3] has passed.
+var scheduleJobScript = redis.NewScript(redisNowMs + pruneJobIndex + `
+if tonumber(ARGV[3]) <= now then
+	return -1
+end
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PXAT', ARGV[3])
+redis.call('DEL', KEYS[2], KEYS[4])
+redis.call('HSET', KEYS[2], 'value', ARGV[2], 'job_id', ARGV[1], 'due_at', ARGV[3])
+redis.call('PEXPIREAT', KEYS[2], tonumber(ARGV[3]) + tonumber(ARGV[4]))
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+redis.call('ZADD', KEYS[5], ARGV[3], KEYS[1])
+redis.call('ZREM', KEYS[6], KEYS[1])
+return 1
+`)
+
+// rescheduleJobScript moves the expiry of job key KEYS[1], its shadow KEYS[2] and its deadline KEYS[5]
+// to ARGV[2] unix ms. It returns 0 if the job does not exist and -1 if ARGV[2] has passed.
+var rescheduleJobScript = redis.NewScript(redisNowMs + pruneJobIndex + `
+if tonumber(ARGV[2]) <= now then
+	return -1
+end
+if redis.call('PEXPIREAT', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], 'due_at', ARGV[2])
+redis.call('PEXPIREAT', KEYS[2], tonumber(ARGV[2]) + tonumber(ARGV[3]))
+redis.call('ZADD', KEYS[3], ARGV[2], ARGV[1])
+redis.call('ZADD', KEYS[5], ARGV[2], KEYS[1])
+return 1
+`)
+
+// cancelJobScript deletes job key KEYS[1], which raises no expired event, with its shadow, index
+// entry and deadline. It returns whether the job existed.
+var cancelJobScript = redis.NewScript(redisNowMs + pruneJobIndex + `
+local n = redis.call('DEL', KEYS[1])
+redis.call('DEL', KEYS[2])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[5], KEYS[1])
+return n
+`)
+
+func jobKeys(id string) []string {
+	key := JobPrefix + id
+	return []string{key, ShadowPrefix + key, JobIndex, DedupPrefix + key, DeadlineIndex, DeadlineLeases}
+}
+
+// Schedule schedules a job to fire at at. Its key, job:<id>, expires then and consumers deliver
+// payload with it. An ID can be scheduled again once its job has fired.
+func (s *Scheduler) Schedule(ctx context.Context, id, payload string, at time.Time) error {
+	if !ValidJobID(id) {
+		return fmt.Errorf("invalid job ID %q", id)
+	}
+	n, err := scheduleJobScript.Run(ctx, s.c.rdb, jobKeys(id), id, payload, at.UnixMilli(), shadowGrace.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to schedule job %s: %w", id, err)
+	}
+	switch n {
+	case 0:
+		return ErrJobExists
+	case -1:
+		return ErrJobInPast
+	}
+	return nil
+}
+
+// Reschedule moves a scheduled job to fire at at instead
+func (s *Scheduler) Reschedule(ctx context.Context, id string, at time.Time) error {
+	n, err := rescheduleJobScript.Run(ctx, s.c.rdb, jobKeys(id), id, at.UnixMilli(), shadowGrace.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to reschedule job %s: %w", id, err)
+	}
+	switch n {
+	case 0:
+		return ErrJobNotFound
+	case -1:
+		return ErrJobInPast
+	}
+	return nil
+}
+
+// Cancel removes a scheduled job so it never fires. It reports whether the job was scheduled.
+func (s *Scheduler) Cancel(ctx context.Context, id string) (bool, error) {
+	n, err := cancelJobScript.Run(ctx, s.c.rdb, jobKeys(id), id).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel job %s: %w", id, err)
+	}
+	return n == 1, nil
+}
+
+// List returns up to limit jobs due between from and to, soonest first. A zero to has no upper bound
+// and a zero limit lists every job. Jobs already due are not listed.
+func (s *Scheduler) List(ctx context.Context, from, to time.Time, limit int64) ([]Job, error) {
+	upper := "+inf"
+	if !to.IsZero() {
+		upper = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	// Fired jobs stay in the index until a later change prunes them, so the range starts after now
+	lower := strconv.FormatInt(max(from.UnixMilli(), time.Now().UnixMilli()+1), 10)
+
+	entries, err := s.c.rdb.ZRangeByScoreWithScores(ctx, JobIndex, &redis.ZRangeBy{Min: lower, Max: upper, Count: limit}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	jobs := make([]Job, 0, len(entries))
+	if len(entries) == 0 {
+		return jobs, nil
+	}
+	pipe := s.c.rdb.Pipeline()
+	payloads := make([]*redis.StringCmd, len(entries))
+	for i, e := range entries {
+		payloads[i] = pipe.HGet(ctx, ShadowPrefix+JobPrefix+e.Member.(string), ShadowValue)
+	}
+	pipe.Exec(ctx)
+	for i, e := range entries {
+		payload, err := payloads[i].Result()
+		if err == redis.Nil {
+			// Cancelled or fired between the two round trips
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get payload of job %s: %w", e.Member, err)
+		}
+		jobs = append(jobs, Job{ID: e.Member.(string), At: time.UnixMilli(int64(e.Score)).UTC(), Payload: payload})
+	}
+	return jobs, nil
+}
@@ -0,0 +1,110 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ShadowPrefix = "shadow:" // shadow:<key> is a hash of a key's value and metadata that outlives the key
+	ShadowValue  = "value"   // shadow field holding the key's value
+
+	// shadowGrace keeps the shadow around after the key itself expires, for consumers to read
+	shadowGrace = 10 * time.Minute
+)
+
+// slidingDedupScript claims KEYS[1] for ARGV[1] ms, or restarts the window if it is already claimed
+var slidingDedupScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], 1, 'PX', ARGV[1], 'NX') then
+	return 1
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return 0
+`)
+
+// takeShadowScript returns the fields of shadow KEYS[1] and deletes it, or with a positive ARGV[1]
+// lets it expire in that many ms instead
+var takeShadowScript = redis.NewScript(`
+local fields = redis.call('HGETALL', KEYS[1])
+if #fields > 0 then
+	if tonumber(ARGV[1]) > 0 then
+		redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	else
+		redis.call('DEL', KEYS[1])
+	end
+end
+return fields
+`)
+
+// SetWithShadow sets key to value with a TTL and records value and fields in the key's shadow,
+// which consumers can still read once the key has expired
+func (c *Client) SetWithShadow(ctx context.Context, key, value string, fields map[string]string, ttl time.Duration) error {
+	shadow := ShadowPrefix + key
+	values := make([]interface{}, 0, 2+2*len(fields))
+	values = append(values, ShadowValue, value)
+	for field, v := range fields {
+		if field == ShadowValue {
+			continue
+		}
+		values = append(values, field, v)
+	}
+
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, value, ttl)
+		pipe.Del(ctx, shadow)
+		pipe.HSet(ctx, shadow, values...)
+		pipe.PExpire(ctx, shadow, ttl+shadowGrace)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set key %s with shadow: %w", key, err)
+	}
+	return nil
+}
+
+// GetShadowFields returns the given fields of key's shadow. Fields the shadow lacks, or all of
+// them if the key has no shadow, are left out of the result.
+func (c *Client) GetShadowFields(ctx context.Context, key string, fields []string) (map[string]string, error) {
+	values, err := c.rdb.HMGet(ctx, ShadowPrefix+key, fields...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shadow of %s: %w", key, err)
+	}
+	result := make(map[string]string, len(fields))
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			result[fields[i]] = s
+		}
+	}
+	return result, nil
+}
+
+// TakeShadow removes key's shadow and returns its fields, or nil if it has none. A positive keep
+// leaves the shadow for that long instead, for consumers still reading it to fingerprint the key.
+func (c *Client) TakeShadow(ctx context.Context, key string, keep time.Duration) (map[string]string, error) {
+	values, err := takeShadowScript.Run(ctx, c.rdb, []string{ShadowPrefix + key}, keep.Milliseconds()).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take shadow of %s: %w", key, err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i]] = values[i+1]
+	}
+	return fields, nil
+}
+
+// CreateSlidingDedupKey creates a deduplication key like CreateDedupKey, but when it already
+// exists its TTL is restarted, so a key that keeps expiring stays suppressed
+func (c *Client) CreateSlidingDedupKey(ctx context.Context, originalKey string, ttl time.Duration) (bool, error) {
+	dedupKey := DedupPrefix + originalKey
+	created, err := slidingDedupScript.Run(ctx, c.rdb, []string{dedupKey}, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to set sliding dedup key %s: %w", dedupKey, err)
+	}
+	return created == 1, nil
+}
@@ -0,0 +1,148 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ShapePrefix  = "shape:"         // shape:<key>:claim and shape:<key>:log hold per-key shaping state
+	ShapePending = "shape:pending"  // sorted set of keys awaiting a deferred emission, scored by due unix ms
+	ShapeSince   = "shape:debounce" // hash of debounced key to the unix ms its current burst began
+)
+
+// ShapeDecision is what a shaping policy decided for one expiration
+type ShapeDecision int
+
+const (
+	ShapeEmit      ShapeDecision = iota // publish now
+	ShapeSuppress                       // dropped by the policy
+	ShapeDefer                          // merged into an emission scheduled in ShapePending
+	ShapeDuplicate                      // another consumer already shaped this expiration
+)
+
+func (d ShapeDecision) String() string {
+	switch d {
+	case ShapeEmit:
+		return "emit"
+	case ShapeSuppress:
+		return "suppress"
+	case ShapeDefer:
+		return "defer"
+	case ShapeDuplicate:
+		return "duplicate"
+	default:
+		return fmt.Sprintf("ShapeDecision(%d)", int(d))
+	}
+}
+
+// redisNowMs is Lua computing the server's time in unix ms, so consumers with skewed clocks agree
+const redisNowMs = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+`
+
+// throttleScript admits up to ARGV[2] expirations of a key per sliding ARGV[3] ms. With the
+// leading edge (ARGV[4]) admitted expirations are emitted at once; with the trailing edge (ARGV[5])
+// the rest are merged into one emission when the interval ends.
+var throttleScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], 1, 'PX', ARGV[1], 'NX') then
+	return 3
+end
+` + redisNowMs + `
+local limit, interval = tonumber(ARGV[2]), tonumber(ARGV[3])
+if ARGV[4] == '1' then
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now - interval)
+	if redis.call('ZCARD', KEYS[2]) < limit then
+		redis.call('ZADD', KEYS[2], now, t[1] .. t[2])
+		redis.call('PEXPIRE', KEYS[2], interval)
+		return 0
+	end
+	if ARGV[5] == '1' then
+		local oldest = redis.call('ZRANGE', KEYS[2], 0, 0, 'WITHSCORES')
+		redis.call('ZADD', KEYS[3], 'NX', tonumber(oldest[2]) + interval, ARGV[6])
+		return 2
+	end
+	return 1
+end
+redis.call('ZADD', KEYS[3], 'NX', now + interval, ARGV[6])
+return 2
+`)
+
+// debounceScript schedules one emission ARGV[2] ms after a key's latest expiration, but no
+// later than ARGV[3] ms (if set) after the first expiration of the burst
+var debounceScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], 1, 'PX', ARGV[1], 'NX') then
+	return 3
+end
+` + redisNowMs + `
+local due = now + tonumber(ARGV[2])
+local maxWait = tonumber(ARGV[3])
+if maxWait > 0 then
+	redis.call('HSETNX', KEYS[3], ARGV[4], now)
+	due = math.min(due, tonumber(redis.call('HGET', KEYS[3], ARGV[4])) + maxWait)
+end
+redis.call('ZADD', KEYS[2], due, ARGV[4])
+return 2
+`)
+
+// claimDueScript removes and returns up to ARGV[1] keys whose deferred emission is due
+var claimDueScript = redis.NewScript(`
+` + redisNowMs + `
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, tonumber(ARGV[1]))
+if #due > 0 then
+	redis.call('ZREM', KEYS[1], unpack(due))
+	redis.call('HDEL', KEYS[2], unpack(due))
+end
+return due
+`)
+
+func shapeKey(key, part string) string {
+	return ShapePrefix + key + ":" + part
+}
+
+// Throttle applies an "at most limit per interval" policy to an expiration of key. claim is how
+// long other consumers' notifications of the same expiration are recognized as duplicates.
+func (c *Client) Throttle(ctx context.Context, key string, claim time.Duration, limit int, interval time.Duration, leading, trailing bool) (ShapeDecision, error) {
+	n, err := throttleScript.Run(ctx, c.rdb,
+		[]string{shapeKey(key, "claim"), shapeKey(key, "log"), ShapePending},
+		claim.Milliseconds(), limit, interval.Milliseconds(), flag(leading), flag(trailing), key,
+	).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to throttle %s: %w", key, err)
+	}
+	return ShapeDecision(n), nil
+}
+
+// Debounce defers an expiration of key until it has been quiet for quiet, or maxWait (if
+// positive) has passed since the burst began
+func (c *Client) Debounce(ctx context.Context, key string, claim, quiet, maxWait time.Duration) (ShapeDecision, error) {
+	n, err := debounceScript.Run(ctx, c.rdb,
+		[]string{shapeKey(key, "claim"), ShapePending, ShapeSince},
+		claim.Milliseconds(), quiet.Milliseconds(), maxWait.Milliseconds(), key,
+	).Int()
+	if err != nil {
+		return 0, fmt.Errorf("failed to debounce %s: %w", key, err)
+	}
+	return ShapeDecision(n), nil
+}
+
+// ClaimDueShaped removes up to max keys whose deferred emission is due and returns them.
+// Each key is returned to exactly one caller.
+func (c *Client) ClaimDueShaped(ctx context.Context, max int) ([]string, error) {
+	keys, err := claimDueScript.Run(ctx, c.rdb, []string{ShapePending, ShapeSince}, max).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim due shaped events: %w", err)
+	}
+	return keys, nil
+}
+
+func flag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
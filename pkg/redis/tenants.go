@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TenantUsagePrefix = "tenants:usage:" // tenants:usage:<name> is a hash of usage counters
+	TenantConfig      = "tenants:config" // hash of tenant name to its JSON TenantSettings
+)
+
+// Tenant usage counters, summed over every consumer
+const (
+	TenantPublished  = "published"  // expirations this tenant's consumers claimed and published
+	TenantDuplicates = "duplicates" // expirations already claimed by another consumer
+	TenantShaped     = "shaped"     // expirations a shaping policy suppressed or deferred
+	TenantThrottled  = "throttled"  // expirations that waited for the tenant's rate limit
+	TenantDropped    = "dropped"    // expirations discarded because the tenant's queue was full
+	TenantFailed     = "failed"     // expirations whose claim or publish failed
+	TenantConsumed   = "consumed"   // events handled successfully
+)
+
+// TenantSettings is a tenant's configuration as registered by the consumers
+type TenantSettings struct {
+	Pattern     string            `json:"pattern"`
+	DedupTTLMs  int64             `json:"dedup_ttl_ms"`
+	DedupWindow string            `json:"dedup_window,omitempty"`
+	Fingerprint []string          `json:"fingerprint,omitempty"` // shadow fields hashed with the key name
+	Subject     string            `json:"subject"`
+	RateLimit   float64           `json:"rate_limit,omitempty"` // expirations per second per consumer, 0 for none
+	Burst       int               `json:"burst,omitempty"`
+	Concurrency int               `json:"concurrency"` // workers per consumer
+	QueueSize   int               `json:"queue_size"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// TenantUsage is a tenant's settings and usage counters
+type TenantUsage struct {
+	Name     string           `json:"name"`
+	Settings *TenantSettings  `json:"settings,omitempty"` // nil if no consumer has registered the tenant
+	Usage    map[string]int64 `json:"usage"`
+}
+
+// TenantCount identifies one usage counter of a tenant
+type TenantCount struct {
+	Tenant string
+	Field  string
+}
+
+// IncrementTenantMetric increments one usage counter of a tenant
+func (c *Client) IncrementTenantMetric(ctx context.Context, tenant, field string) error {
+	if err := c.rdb.HIncrBy(ctx, TenantUsagePrefix+tenant, field, 1).Err(); err != nil {
+		return fmt.Errorf("failed to increment %s for tenant %s: %w", field, tenant, err)
+	}
+	return nil
+}
+
+// RegisterTenant records a tenant's settings, replacing any registered before
+func (c *Client) RegisterTenant(ctx context.Context, name string, settings TenantSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode settings for tenant %s: %w", name, err)
+	}
+	if err := c.rdb.HSet(ctx, TenantConfig, name, data).Err(); err != nil {
+		return fmt.Errorf("failed to register tenant %s: %w", name, err)
+	}
+	return nil
+}
+
+// ListTenants returns every registered tenant, and any tenant with usage, sorted by name
+func (c *Client) ListTenants(ctx context.Context) ([]TenantUsage, error) {
+	configs, err := c.rdb.HGetAll(ctx, TenantConfig).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %w", err)
+	}
+
+	names := make(map[string]bool, len(configs))
+	for name := range configs {
+		names[name] = true
+	}
+	iter := c.rdb.Scan(ctx, 0, TenantUsagePrefix+"*", migrateScanCount).Iterator()
+	for iter.Next(ctx) {
+		names[strings.TrimPrefix(iter.Val(), TenantUsagePrefix)] = true
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan tenant usage: %w", err)
+	}
+
+	tenants := make([]TenantUsage, 0, len(names))
+	for name := range names {
+		tenant := TenantUsage{Name: name, Usage: map[string]int64{}}
+		if data, ok := configs[name]; ok {
+			var settings TenantSettings
+			if err := json.Unmarshal([]byte(data), &settings); err == nil {
+				tenant.Settings = &settings
+			}
+		}
+		fields, err := c.rdb.HGetAll(ctx, TenantUsagePrefix+name).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get usage of tenant %s: %w", name, err)
+		}
+		for field, v := range fields {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				tenant.Usage[field] = n
+			}
+		}
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants, nil
+}
@@ -0,0 +1,67 @@
+package secure
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloading caches a value loaded from files and loads it again once any of them changes,
+// so rotated secrets and certificates are picked up without a restart
+type reloading[T any] struct {
+	paths []string
+	load  func() (T, error)
+
+	mu       sync.Mutex
+	modTimes []time.Time
+	val      T
+	loaded   bool
+}
+
+func newReloading[T any](load func() (T, error), paths ...string) *reloading[T] {
+	return &reloading[T]{paths: paths, load: load}
+}
+
+// get returns the current value. If the files changed but cannot be loaded, for example
+// halfway through a rotation, the previous value is kept.
+func (r *reloading[T]) get() (T, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := make([]time.Time, len(r.paths))
+	changed := !r.loaded
+	for i, path := range r.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if r.loaded {
+				return r.val, nil
+			}
+			var zero T
+			return zero, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		modTimes[i] = info.ModTime()
+		if !r.loaded || !modTimes[i].Equal(r.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return r.val, nil
+	}
+
+	val, err := r.load()
+	if err != nil {
+		if r.loaded {
+			return r.val, nil
+		}
+		return val, err
+	}
+	r.val, r.modTimes, r.loaded = val, modTimes, true
+	return val, nil
+}
+
+// WatchFiles returns a function yielding the value load builds from paths, loading it again
+// whenever one of the files changes. A failed reload keeps the previous value.
+func WatchFiles[T any](load func() (T, error), paths ...string) func() (T, error) {
+	return newReloading(load, paths...).get
+}
@@ -0,0 +1,41 @@
+package secure
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Secret is a credential given inline or read from a file
+type Secret struct {
+	Value string
+	File  string
+}
+
+// SecretFromEnv reads a secret from $name, or from the file named by $name_FILE
+func SecretFromEnv(name string) Secret {
+	return Secret{Value: os.Getenv(name), File: os.Getenv(name + "_FILE")}
+}
+
+// IsSet reports whether the secret has a value or a file
+func (s Secret) IsSet() bool {
+	return s.Value != "" || s.File != ""
+}
+
+// Source returns a function yielding the secret's current value. A file is read again when it
+// changes, so mounted secrets can be rotated in place; trailing newlines in it are ignored.
+func (s Secret) Source() func() (string, error) {
+	if s.File == "" {
+		value := s.Value
+		return func() (string, error) { return value, nil }
+	}
+	path := s.File
+	file := newReloading(func() (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}, path)
+	return file.get
+}
@@ -0,0 +1,95 @@
+package secure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretSource(t *testing.T) {
+	if got, err := (Secret{Value: "inline"}).Source()(); err != nil || got != "inline" {
+		t.Errorf("inline secret = %q, %v, want inline", got, err)
+	}
+	if (Secret{}).IsSet() {
+		t.Error("empty secret is set")
+	}
+
+	missing := Secret{File: filepath.Join(t.TempDir(), "none")}
+	if _, err := missing.Source()(); err == nil {
+		t.Error("secret from a missing file loaded")
+	}
+}
+
+// A rotated secret file is read again, and one removed or emptied mid-rotation keeps the last value
+func TestSecretReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	now := time.Now()
+	writeFile(t, path, []byte("first\n"), now)
+	// A file takes precedence over an inline value
+	source := Secret{Value: "inline", File: path}.Source()
+
+	steps := []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{"initial", func() {}, "first"},
+		{"unchanged", func() {}, "first"},
+		{"rotated", func() { writeFile(t, path, []byte("second\r\n"), now.Add(time.Second)) }, "second"},
+		{"removed", func() { os.Remove(path) }, "second"},
+		{"restored", func() { writeFile(t, path, []byte("third"), now.Add(2*time.Second)) }, "third"},
+	}
+	for _, step := range steps {
+		step.change()
+		got, err := source()
+		if err != nil {
+			t.Fatalf("%s: failed to load secret: %v", step.name, err)
+		}
+		if got != step.want {
+			t.Errorf("%s: secret = %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+// A reloading value is loaded again only when one of its files changes
+func TestReloading(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	now := time.Now()
+	writeFile(t, a, []byte("a1"), now)
+	writeFile(t, b, []byte("b1"), now)
+	loads := 0
+	get := newReloading(func() (string, error) {
+		loads++
+		da, err := os.ReadFile(a)
+		if err != nil {
+			return "", err
+		}
+		db, err := os.ReadFile(b)
+		if err != nil {
+			return "", err
+		}
+		return string(da) + string(db), nil
+	}, a, b).get
+
+	for i, step := range []struct {
+		change    func()
+		want      string
+		wantLoads int
+	}{
+		{func() {}, "a1b1", 1},
+		{func() {}, "a1b1", 1},
+		{func() { writeFile(t, b, []byte("b2"), now.Add(time.Second)) }, "a1b2", 2},
+		{func() { writeFile(t, a, []byte("a2"), now.Add(time.Second)) }, "a2b2", 3},
+	} {
+		step.change()
+		got, err := get()
+		if err != nil {
+			t.Fatalf("step %d: failed to load: %v", i, err)
+		}
+		if got != step.want || loads != step.wantLoads {
+			t.Errorf("step %d: got %q after %d loads, want %q after %d", i, got, loads, step.want, step.wantLoads)
+		}
+	}
+}
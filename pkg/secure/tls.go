@@ -0,0 +1,157 @@
+package secure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// TLSConfig describes a client TLS connection. Certificate files are read again when they
+// change, so rotated certificates apply to new connections without a restart.
+type TLSConfig struct {
+	Enabled    bool   // use TLS even if no files are given, verifying against the system roots
+	CAFile     string // PEM bundle of CAs to trust instead of the system roots
+	CertFile   string // client certificate for mutual TLS
+	KeyFile    string
+	ServerName string // name to verify the server certificate against, defaults to the host dialled
+	MinVersion string // "1.2" (default) or "1.3"
+}
+
+// TLSFromEnv reads a TLS config from $prefix_TLS, $prefix_TLS_CA_FILE, $prefix_TLS_CERT_FILE,
+// $prefix_TLS_KEY_FILE, $prefix_TLS_SERVER_NAME and $prefix_TLS_MIN_VERSION
+func TLSFromEnv(prefix string) TLSConfig {
+	enabled, _ := strconv.ParseBool(os.Getenv(prefix + "_TLS"))
+	return TLSConfig{
+		Enabled:    enabled,
+		CAFile:     os.Getenv(prefix + "_TLS_CA_FILE"),
+		CertFile:   os.Getenv(prefix + "_TLS_CERT_FILE"),
+		KeyFile:    os.Getenv(prefix + "_TLS_KEY_FILE"),
+		ServerName: os.Getenv(prefix + "_TLS_SERVER_NAME"),
+		MinVersion: os.Getenv(prefix + "_TLS_MIN_VERSION"),
+	}
+}
+
+// IsSet reports whether TLS should be used
+func (c TLSConfig) IsSet() bool {
+	return c.Enabled || c.CAFile != "" || c.CertFile != ""
+}
+
+// Build returns the tls.Config for a connection to addr, or nil if TLS is not configured. addr is
+// a host, host:port, URL or comma-separated list of URLs, and names the host to verify when
+// ServerName is empty.
+func (c TLSConfig) Build(addr string) (*tls.Config, error) {
+	if !c.IsSet() {
+		return nil, nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("TLS client certificate and key must be given together")
+	}
+
+	cfg := &tls.Config{ServerName: c.ServerName}
+	switch c.MinVersion {
+	case "", "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported TLS min version %q", c.MinVersion)
+	}
+
+	if c.CertFile != "" {
+		certFile, keyFile := c.CertFile, c.KeyFile
+		cert := newReloading(func() (*tls.Certificate, error) {
+			pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+			}
+			return &pair, nil
+		}, certFile, keyFile)
+		// Fail fast on a bad certificate rather than on the first handshake
+		if _, err := cert.get(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get()
+		}
+	}
+
+	if c.CAFile != "" {
+		caFile := c.CAFile
+		roots := newReloading(func() (*x509.CertPool, error) {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read TLS CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in TLS CA file %s", caFile)
+			}
+			return pool, nil
+		}, caFile)
+		if _, err := roots.get(); err != nil {
+			return nil, err
+		}
+		// The state passed to VerifyConnection has no server name when dialling an IP address,
+		// so the host is fixed here, and verification fails rather than skip the host check
+		host := c.ServerName
+		if host == "" {
+			host = dialHost(addr)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("TLS server name is required to verify %q against a CA file", addr)
+		}
+		// tls.Config fixes RootCAs for its lifetime, so to follow a rotated CA bundle the
+		// built-in verification is replaced by the same chain and host name checks against
+		// the current bundle. Verification is never skipped.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			pool, err := roots.get()
+			if err != nil {
+				return err
+			}
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no TLS certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				DNSName:       host,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err = cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return cfg, nil
+}
+
+// dialHost returns the host addr names, or "" if it names none or several
+func dialHost(addr string) string {
+	var host string
+	for _, a := range strings.Split(addr, ",") {
+		a = strings.TrimSpace(a)
+		if strings.Contains(a, "://") {
+			u, err := url.Parse(a)
+			if err != nil {
+				return ""
+			}
+			a = u.Hostname()
+		} else if h, _, err := net.SplitHostPort(a); err == nil {
+			a = h
+		}
+		a = strings.TrimSuffix(strings.TrimPrefix(a, "["), "]")
+		if a == "" || (host != "" && a != host) {
+			return ""
+		}
+		host = a
+	}
+	return host
+}
@@ -0,0 +1,335 @@
+package secure
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for the given DNS names and IP addresses
+func (ca *testCA) issue(t *testing.T, cn string, dnsNames []string, ips []net.IP) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to path with a modification time of at, so a rewrite within the file
+// system's timestamp resolution is still seen as a change
+func writeFile(t *testing.T, path string, data []byte, at time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS accepts TLS connections with certPEM and keyPEM, completing each handshake and sending
+// the subject of the client certificate, if any, on clients
+func serveTLS(t *testing.T, certPEM, keyPEM []byte, clientCAs *x509.CertPool) (addr string, clients <-chan string) {
+	t.Helper()
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	subjects := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := conn.(*tls.Conn)
+				if tc.Handshake() != nil {
+					return
+				}
+				if peers := tc.ConnectionState().PeerCertificates; len(peers) > 0 {
+					subjects <- peers[0].Subject.CommonName
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), subjects
+}
+
+// dial completes a handshake with addr using cfg
+func dial(addr string, cfg *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestTLSHostVerification(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	other := newTestCA(t, "other CA")
+
+	loopback := []net.IP{net.IPv4(127, 0, 0, 1)}
+	tests := []struct {
+		name       string
+		ca         *testCA
+		dnsNames   []string
+		ips        []net.IP
+		serverName string
+		wantErr    bool
+	}{
+		{name: "IP SAN", ca: ca, ips: loopback},
+		{name: "certificate for another host dialled by IP", ca: ca, dnsNames: []string{"other.example"}, wantErr: true},
+		{name: "certificate for another IP", ca: ca, ips: []net.IP{net.IPv4(10, 0, 0, 1)}, wantErr: true},
+		{name: "server name matching a DNS SAN", ca: ca, dnsNames: []string{"redis.internal"}, serverName: "redis.internal"},
+		{name: "server name not matching", ca: ca, ips: loopback, serverName: "redis.internal", wantErr: true},
+		{name: "untrusted CA", ca: other, ips: loopback, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPEM, keyPEM := tt.ca.issue(t, "server", tt.dnsNames, tt.ips)
+			addr, _ := serveTLS(t, certPEM, keyPEM, nil)
+			cfg, err := TLSConfig{CAFile: caFile, ServerName: tt.serverName}.Build(addr)
+			if err != nil {
+				t.Fatalf("Build() failed: %v", err)
+			}
+			err = dial(addr, cfg)
+			if tt.wantErr && err == nil {
+				t.Fatal("handshake succeeded, want a verification failure")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLSBuild(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now())
+	empty := filepath.Join(dir, "empty.pem")
+	writeFile(t, empty, []byte("not a certificate"), time.Now())
+
+	tests := []struct {
+		name    string
+		config  TLSConfig
+		addr    string
+		wantNil bool
+		wantErr string
+	}{
+		{name: "not configured", addr: "localhost:6379", wantNil: true},
+		{name: "system roots", config: TLSConfig{Enabled: true}, addr: "localhost:6379"},
+		{name: "TLS 1.3", config: TLSConfig{Enabled: true, MinVersion: "1.3"}, addr: "localhost:6379"},
+		{name: "unsupported version", config: TLSConfig{Enabled: true, MinVersion: "1.1"}, wantErr: "unsupported TLS min version"},
+		{name: "certificate without key", config: TLSConfig{CertFile: caFile}, wantErr: "given together"},
+		{name: "missing certificate", config: TLSConfig{CertFile: filepath.Join(dir, "none"), KeyFile: filepath.Join(dir, "none")}, wantErr: "failed to stat"},
+		{name: "missing CA file", config: TLSConfig{CAFile: filepath.Join(dir, "none")}, addr: "localhost", wantErr: "failed to stat"},
+		{name: "CA file without certificates", config: TLSConfig{CAFile: empty}, addr: "localhost", wantErr: "no certificates found"},
+		{name: "CA file without a host", config: TLSConfig{CAFile: caFile}, wantErr: "server name is required"},
+		{name: "CA file with hosts that differ", config: TLSConfig{CAFile: caFile}, addr: "nats://a:4222,nats://b:4222", wantErr: "server name is required"},
+		{name: "CA file with a server name", config: TLSConfig{CAFile: caFile, ServerName: "nats.internal"}, addr: "nats://a:4222,nats://b:4222"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.config.Build(tt.addr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Build() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() failed: %v", err)
+			}
+			if (cfg == nil) != tt.wantNil {
+				t.Fatalf("Build() = %v, want nil %v", cfg, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestDialHost(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"redis.internal", "redis.internal"},
+		{"redis.internal:6379", "redis.internal"},
+		{"10.0.0.1:6379", "10.0.0.1"},
+		{"[::1]:6379", "::1"},
+		{"https://generator.internal:8080/api", "generator.internal"},
+		{"nats://10.0.0.1:4222, nats://10.0.0.1:4223", "10.0.0.1"},
+		{"nats://a:4222,nats://b:4222", ""},
+		{"", ""},
+		{":6379", ""},
+	}
+	for _, tt := range tests {
+		if got := dialHost(tt.addr); got != tt.want {
+			t.Errorf("dialHost(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// A rewritten CA bundle is trusted by the next handshake without rebuilding the config, and a
+// bundle that fails to load mid-rotation keeps the previous one
+func TestTLSReloadCA(t *testing.T) {
+	oldCA, newCA := newTestCA(t, "old CA"), newTestCA(t, "new CA")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	now := time.Now()
+	writeFile(t, caFile, oldCA.pem, now)
+
+	loopback := []net.IP{net.IPv4(127, 0, 0, 1)}
+	oldCert, oldKey := oldCA.issue(t, "old server", nil, loopback)
+	oldAddr, _ := serveTLS(t, oldCert, oldKey, nil)
+	newCert, newKey := newCA.issue(t, "new server", nil, loopback)
+	newAddr, _ := serveTLS(t, newCert, newKey, nil)
+
+	cfg, err := TLSConfig{CAFile: caFile}.Build("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if err := dial(oldAddr, cfg); err != nil {
+		t.Fatalf("handshake with the old CA's server failed: %v", err)
+	}
+	if err := dial(newAddr, cfg); err == nil {
+		t.Fatal("handshake with the new CA's server succeeded before the rotation")
+	}
+
+	writeFile(t, caFile, newCA.pem, now.Add(time.Second))
+	if err := dial(newAddr, cfg); err != nil {
+		t.Fatalf("handshake with the new CA's server failed after the rotation: %v", err)
+	}
+	if err := dial(oldAddr, cfg); err == nil {
+		t.Fatal("handshake with the old CA's server succeeded after the rotation")
+	}
+
+	writeFile(t, caFile, []byte("half written"), now.Add(2*time.Second))
+	if err := dial(newAddr, cfg); err != nil {
+		t.Fatalf("handshake failed while the CA file was unreadable: %v", err)
+	}
+}
+
+// A rotated client certificate is presented on the next handshake without rebuilding the config
+func TestTLSReloadClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	now := time.Now()
+	writeFile(t, caFile, ca.pem, now)
+	certPEM, keyPEM := ca.issue(t, "client 1", nil, nil)
+	writeFile(t, certFile, certPEM, now)
+	writeFile(t, keyFile, keyPEM, now)
+
+	serverCert, serverKey := ca.issue(t, "server", nil, []net.IP{net.IPv4(127, 0, 0, 1)})
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	addr, clients := serveTLS(t, serverCert, serverKey, pool)
+
+	cfg, err := TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}.Build(addr)
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	presented := func() string {
+		t.Helper()
+		if err := dial(addr, cfg); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		select {
+		case cn := <-clients:
+			return cn
+		case <-time.After(5 * time.Second):
+			t.Fatal("server saw no client certificate")
+			return ""
+		}
+	}
+	if cn := presented(); cn != "client 1" {
+		t.Fatalf("presented %q, want client 1", cn)
+	}
+
+	certPEM, keyPEM = ca.issue(t, "client 2", nil, nil)
+	writeFile(t, certFile, certPEM, now.Add(time.Second))
+	writeFile(t, keyFile, keyPEM, now.Add(time.Second))
+	if cn := presented(); cn != "client 2" {
+		t.Fatalf("presented %q after the rotation, want client 2", cn)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/handler"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// Consumers capturing values deliver each generated key's shadowed value once, and take the shadow
+func TestCaptureValues(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	var mu sync.Mutex
+	values := make(map[string]string)
+	e.startConsumers(t, 3, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.CaptureValues = true
+		opts.Handlers.Register("*", "values", handler.HandlerFunc(func(ctx context.Context, evt *handler.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			values[evt.Key] = evt.Value
+			return nil
+		}))
+		return opts
+	})
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+	runID := fmt.Sprintf("capture-%d", time.Now().UnixNano())
+	const numKeys = 100
+	gen := pipeline.NewGenerator(redisClient)
+	if _, err := gen.Run(ctx, pipeline.GeneratorConfig{RunID: runID, NumKeys: numKeys, KeyTTL: 100 * time.Millisecond, Shadow: true}); err != nil {
+		t.Fatalf("failed to generate keys: %v", err)
+	}
+	if !rec.waitFor(numKeys, 10*time.Second) {
+		t.Fatalf("consumed %d of %d keys", rec.distinct(), numKeys)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for seq := int64(0); seq < numKeys; seq++ {
+		key := redis.RunKey(runID, seq)
+		if values[key] != fmt.Sprint(seq) {
+			t.Errorf("key %s delivered value %q, want %d", key, values[key], seq)
+		}
+		if n := rec.keys[key]; n != 1 {
+			t.Errorf("key %s delivered %d times, want 1", key, n)
+		}
+		shadow, err := redisClient.GetShadowFields(ctx, key, []string{redis.ShadowValue})
+		if err != nil {
+			t.Fatalf("failed to read shadow of %s: %v", key, err)
+		}
+		if len(shadow) != 0 {
+			t.Errorf("shadow of %s was not taken: %v", key, shadow)
+		}
+	}
+}
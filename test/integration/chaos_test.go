@@ -0,0 +1,120 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/internal/chaos"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// chaosScenarioFile can be overridden with CHAOS_SCENARIOS to run a custom scenario file
+const chaosScenarioFile = "testdata/chaos.json"
+
+func TestChaosScenarios(t *testing.T) {
+	path := chaosScenarioFile
+	if p := os.Getenv("CHAOS_SCENARIOS"); p != "" {
+		path = p
+	}
+	scenarios, err := chaos.LoadScenarios(path)
+	if err != nil {
+		t.Fatalf("failed to load scenarios: %v", err)
+	}
+
+	var results []chaos.Result
+	for _, sc := range scenarios {
+		t.Run(sc.Name, func(t *testing.T) {
+			result := runScenario(t, sc)
+			results = append(results, result)
+			if err := result.Check(sc.Expect); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	if len(results) > 0 {
+		var b strings.Builder
+		chaos.WriteTable(&b, results)
+		t.Logf("chaos results:\n%s", b.String())
+	}
+}
+
+func runScenario(t *testing.T, sc chaos.Scenario) chaos.Result {
+	e := newEnv(t)
+	rec := newRecorder()
+	inj := chaos.NewInjector(sc.Faults, sc.Seed)
+
+	consumers := e.startConsumers(t, sc.Consumers, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.Deduplicator = inj.Deduplicator(opts.Redis)
+		opts.Bus = inj.Bus(opts.Bus)
+		if sc.DedupTTL > 0 {
+			opts.DedupTTL = time.Duration(sc.DedupTTL)
+		}
+		return opts
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go inj.Run(ctx, time.Now(), &chaosTarget{env: e, consumers: consumers})
+
+	gen := pipeline.NewGenerator(e.redisClient(t))
+	runID := fmt.Sprintf("chaos-%d", time.Now().UnixNano())
+	if _, err := gen.Run(ctx, pipeline.GeneratorConfig{
+		RunID:    runID,
+		NumKeys:  sc.NumKeys,
+		KeyDelay: time.Duration(sc.KeyDelay),
+		KeyTTL:   time.Duration(sc.KeyTTL),
+		Profile:  sc.Profile,
+		TTL:      sc.TTL,
+	}); err != nil {
+		t.Fatalf("failed to generate keys: %v", err)
+	}
+
+	settle := time.Duration(sc.Settle)
+	if settle <= 0 {
+		settle = 10 * time.Second
+	}
+	rec.waitFor(int(sc.NumKeys), settle)
+	// Allow redeliveries and late duplicates to surface
+	time.Sleep(time.Second)
+
+	generated := make([]string, sc.NumKeys)
+	for i := range generated {
+		generated[i] = redis.RunKey(runID, int64(i))
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return chaos.Tally(sc.Name, generated, rec.keys, inj.Counts())
+}
+
+// chaosTarget applies scheduled faults to the harness environment
+type chaosTarget struct {
+	env       *env
+	consumers []*consumer
+}
+
+func (c *chaosTarget) DisconnectRedis(ctx context.Context) error {
+	return c.env.disconnectRedis()
+}
+
+func (c *chaosTarget) DisconnectNATS() error {
+	for _, cons := range c.consumers {
+		if err := cons.nats.ForceReconnect(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *chaosTarget) KillConsumer(index int) error {
+	c.consumers[index].stop()
+	return nil
+}
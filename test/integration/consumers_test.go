@@ -0,0 +1,160 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+)
+
+func TestConsumerRegistry(t *testing.T) {
+	e := newEnv(t)
+	consumers := e.startConsumers(t, 2, newRecorder(), nil)
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+
+	registered, err := redisClient.ListConsumers(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to list consumers: %v", err)
+	}
+	if len(registered) != 2 || registered[0].ID != "consumer-0" || registered[1].ID != "consumer-1" {
+		t.Fatalf("registered consumers = %+v, want consumer-0 and consumer-1", registered)
+	}
+	for _, c := range registered {
+		if c.Stale {
+			t.Errorf("consumer %s is stale right after starting", c.ID)
+		}
+	}
+
+	// A consumer that shuts down cleanly deregisters itself
+	consumers[0].stop()
+	registered, err = redisClient.ListConsumers(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to list consumers: %v", err)
+	}
+	if len(registered) != 1 || registered[0].ID != "consumer-1" {
+		t.Fatalf("registered consumers after stop = %+v, want consumer-1", registered)
+	}
+
+	// A consumer that vanished without deregistering goes stale and can be pruned
+	if err := redisClient.Heartbeat(ctx, "ghost"); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := redisClient.Heartbeat(ctx, "consumer-1"); err != nil {
+		t.Fatalf("failed to send heartbeat: %v", err)
+	}
+	removed, err := redisClient.PruneConsumers(ctx, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to prune consumers: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != "ghost" {
+		t.Errorf("pruned %v, want [ghost]", removed)
+	}
+}
+
+func TestMigrateConsumerMetrics(t *testing.T) {
+	e := newEnv(t)
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+
+	raw := goredis.NewClient(&goredis.Options{Addr: e.RedisAddr})
+	t.Cleanup(func() { raw.Close() })
+
+	// Counters in the old key-per-consumer layout, one of them for a consumer already in the hash
+	legacy := map[string]int64{
+		"metrics:consumer:pod-a":            3,
+		"metrics:run-1:consumer:pod-a":      5,
+		"metrics:run-1:consumer:pod-b":      7,
+		"metrics:run-1:consumer:pod-c:fast": 1,
+	}
+	for key, n := range legacy {
+		if err := raw.Set(ctx, key, n, 0).Err(); err != nil {
+			t.Fatalf("failed to set %s: %v", key, err)
+		}
+	}
+	if err := redisClient.IncrementConsumerMetric(ctx, "run-1", "pod-b"); err != nil {
+		t.Fatalf("failed to increment consumer metric: %v", err)
+	}
+
+	migrated, err := redisClient.MigrateConsumerMetrics(ctx)
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if migrated != int64(len(legacy)) {
+		t.Errorf("migrated %d keys, want %d", migrated, len(legacy))
+	}
+
+	got, err := redisClient.GetConsumerMetrics(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("failed to get consumer metrics: %v", err)
+	}
+	want := map[string]int64{"pod-a": 5, "pod-b": 8, "pod-c:fast": 1}
+	for id, n := range want {
+		if got[id] != n {
+			t.Errorf("run-1 consumer %s = %d, want %d", id, got[id], n)
+		}
+	}
+	got, err = redisClient.GetConsumerMetrics(ctx, "")
+	if err != nil {
+		t.Fatalf("failed to get legacy consumer metrics: %v", err)
+	}
+	if got["pod-a"] != 3 {
+		t.Errorf("un-namespaced consumer pod-a = %d, want 3", got["pod-a"])
+	}
+
+	if n, err := raw.Exists(ctx, "metrics:consumer:pod-a", "metrics:run-1:consumer:pod-b").Result(); err != nil || n != 0 {
+		t.Errorf("%d legacy keys left after migration (err %v), want 0", n, err)
+	}
+	// Running it again finds nothing to migrate
+	if migrated, err := redisClient.MigrateConsumerMetrics(ctx); err != nil || migrated != 0 {
+		t.Errorf("second migration moved %d keys (err %v), want 0", migrated, err)
+	}
+}
+
+func TestMetricsAggregator(t *testing.T) {
+	e := newEnv(t)
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+
+	// A long interval and large batch leave everything to the size threshold and the final flush
+	agg := pipeline.NewMetricsAggregator(redisClient, time.Hour, 100)
+	for i := 0; i < 250; i++ {
+		consumerID := fmt.Sprintf("pod-%d", i%2)
+		agg.IncrementConsumerMetric(ctx, "run-1", consumerID)
+		agg.IncrementConsumed(ctx, "run-1")
+	}
+
+	// 500 increments cross the threshold several times; only the last 100 can still be pending
+	time.Sleep(200 * time.Millisecond)
+	_, consumed, err := redisClient.GetMetrics(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+	if consumed < 150 {
+		t.Errorf("consumed = %d before close, want at least 150 flushed by size", consumed)
+	}
+
+	agg.Close(ctx)
+	_, consumed, err = redisClient.GetMetrics(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+	if consumed != 250 {
+		t.Errorf("consumed = %d after close, want 250", consumed)
+	}
+	consumers, err := redisClient.GetConsumerMetrics(ctx, "run-1")
+	if err != nil {
+		t.Fatalf("failed to get consumer metrics: %v", err)
+	}
+	if consumers["pod-0"] != 125 || consumers["pod-1"] != 125 {
+		t.Errorf("consumer metrics = %v, want 125 each", consumers)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+)
+
+// Writes of one key name with different fingerprinted fields are delivered separately, and a sliding
+// window keeps a flapping key suppressed until it settles
+func TestFingerprintAndSlidingDedup(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	config := pipeline.TenantConfig{Tenants: []pipeline.TenantSpec{
+		{Name: "policies", Pattern: "policy:*", DedupTTL: "10s", Fingerprint: []string{"policy_version"}},
+		{Name: "flappy", Pattern: "flap:*", DedupTTL: "500ms", DedupWindow: pipeline.DedupSliding},
+	}}
+	tenants, err := config.Build()
+	if err != nil {
+		t.Fatalf("failed to build tenants: %v", err)
+	}
+	e.startConsumers(t, 2, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.Tenants = tenants
+		return opts
+	})
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+	count := func(key string) int {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return rec.keys[key]
+	}
+	set := func(key, version string) {
+		fields := map[string]string{"policy_version": version}
+		if err := redisClient.SetWithShadow(ctx, key, "payload", fields, 20*time.Millisecond); err != nil {
+			t.Fatalf("failed to set %s: %v", key, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	policy := fmt.Sprintf("policy:%d", suffix)
+	set(policy, "1")
+	set(policy, "1")
+	if n := count(policy); n != 1 {
+		t.Errorf("repeated version delivered %d times, want 1", n)
+	}
+	set(policy, "2")
+	if n := count(policy); n != 2 {
+		t.Errorf("policy delivered %d times after a new version, want 2", n)
+	}
+
+	// Expiring every 200ms keeps restarting the 500ms window, where a fixed one would lapse
+	flap := fmt.Sprintf("flap:%d", suffix)
+	for i := 0; i < 10; i++ {
+		if err := redisClient.SetWithShadow(ctx, flap, "payload", nil, 20*time.Millisecond); err != nil {
+			t.Fatalf("failed to set %s: %v", flap, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if n := count(flap); n != 1 {
+		t.Errorf("flapping key delivered %d times, want 1", n)
+	}
+	time.Sleep(time.Second)
+	set(flap, "")
+	if n := count(flap); n != 2 {
+		t.Errorf("settled key delivered %d times after expiring again, want 2", n)
+	}
+}
@@ -0,0 +1,240 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/handler"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/nats"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+const (
+	startupTimeout = 10 * time.Second
+	// expiryTick is how often the Redis stand-in expires due keys
+	expiryTick = 5 * time.Millisecond
+)
+
+// env is a hermetic Redis + NATS pair running in-process: miniredis, with expired keyspace events
+// simulated on a real-time clock, and an embedded nats-server with JetStream
+type env struct {
+	RedisAddr string
+	NatsURL   string
+
+	redis *miniredis.Miniredis
+}
+
+// newEnv starts miniredis and an embedded nats-server on free ports, both stopped with the test
+func newEnv(t *testing.T) *env {
+	t.Helper()
+	mr := miniredis.NewMiniRedis()
+	if err := mr.Start(); err != nil {
+		t.Fatalf("failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	ns, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      natsserver.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create nats-server: %v", err)
+	}
+	go ns.Start()
+	t.Cleanup(func() {
+		ns.Shutdown()
+		ns.WaitForShutdown()
+	})
+	if !ns.ReadyForConnections(startupTimeout) {
+		t.Fatalf("timed out waiting for nats-server")
+	}
+
+	e := &env{
+		RedisAddr: mr.Addr(),
+		NatsURL:   ns.ClientURL(),
+		redis:     mr,
+	}
+	e.simulateExpiry(t)
+	return e
+}
+
+// simulateExpiry advances miniredis' TTLs in real time, which it otherwise only does on FastForward,
+// and publishes an expired keyspace event for each key that expires, as Redis does with
+// notify-keyspace-events Ex
+func (e *env) simulateExpiry(t *testing.T) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(expiryTick)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				elapsed := now.Sub(last)
+				last = now
+				var due []string
+				for _, key := range e.redis.Keys() {
+					if ttl := e.redis.TTL(key); ttl > 0 && ttl <= elapsed {
+						due = append(due, key)
+					}
+				}
+				e.redis.FastForward(elapsed)
+				for _, key := range due {
+					if !e.redis.Exists(key) {
+						e.redis.Publish(redis.ExpiredChannel, key)
+					}
+				}
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+}
+
+// disconnectRedis drops every Redis connection, as a server restart would, keeping the data
+func (e *env) disconnectRedis() error {
+	e.redis.Close()
+	return e.redis.Restart()
+}
+
+// redisClient connects a new Redis client that is closed with the test
+func (e *env) redisClient(t *testing.T) *redis.Client {
+	t.Helper()
+	c, err := redis.NewClient(e.RedisAddr)
+	if err != nil {
+		t.Fatalf("failed to create Redis client: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// natsClient connects a new NATS client that is closed with the test
+func (e *env) natsClient(t *testing.T) *nats.Client {
+	t.Helper()
+	c, err := nats.NewClient(e.NatsURL)
+	if err != nil {
+		t.Fatalf("failed to create NATS client: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// recorder counts deliveries per key and per consumer across all pipelines
+type recorder struct {
+	mu        sync.Mutex
+	keys      map[string]int
+	consumers map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		keys:      make(map[string]int),
+		consumers: make(map[string]int),
+	}
+}
+
+func (r *recorder) handler() handler.Handler {
+	return handler.HandlerFunc(func(ctx context.Context, evt *handler.Event) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.keys[evt.Key]++
+		r.consumers[evt.ConsumerID]++
+		return nil
+	})
+}
+
+// distinct returns the number of distinct keys delivered
+func (r *recorder) distinct() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.keys)
+}
+
+// waitFor polls until the recorder has seen n distinct keys or the timeout elapses
+func (r *recorder) waitFor(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if r.distinct() >= n {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+// consumer is one in-process pipeline with its own connections
+type consumer struct {
+	id       string
+	nats     *nats.Client
+	pipeline *pipeline.Pipeline
+	done     chan error
+}
+
+// startConsumers runs n pipelines that all feed the same recorder.
+// wrap, when non-nil, may replace options such as the bus or deduplicator.
+func (e *env) startConsumers(t *testing.T, n int, rec *recorder, wrap func(pipeline.Options) pipeline.Options) []*consumer {
+	t.Helper()
+	consumers := make([]*consumer, 0, n)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("consumer-%d", i)
+		redisClient := e.redisClient(t)
+		natsClient := e.natsClient(t)
+
+		handlers := handler.NewRegistry()
+		handlers.Register("*", "metrics", handler.Metrics(redisClient))
+		handlers.Register("*", "ledger", handler.Ledger(redisClient))
+		handlers.Register("*", "recorder", rec.handler())
+
+		opts := pipeline.Options{
+			ConsumerID:     id,
+			Redis:          redisClient,
+			Bus:            natsClient,
+			Handlers:       handlers,
+			DedupTTL:       5 * time.Second,
+			ReconnectDelay: 100 * time.Millisecond,
+		}
+		if wrap != nil {
+			opts = wrap(opts)
+		}
+
+		p, err := pipeline.New(opts)
+		if err != nil {
+			t.Fatalf("failed to create pipeline %s: %v", id, err)
+		}
+
+		c := &consumer{id: id, nats: natsClient, pipeline: p, done: make(chan error, 1)}
+		go func() { c.done <- p.Run(context.Background()) }()
+		t.Cleanup(func() { c.stop() })
+		consumers = append(consumers, c)
+	}
+
+	// Give the Pub/Sub subscriptions time to register before keys start expiring
+	time.Sleep(200 * time.Millisecond)
+	return consumers
+}
+
+// stop shuts the consumer down, waiting briefly for in-flight work
+func (c *consumer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.pipeline.Shutdown(ctx)
+}
@@ -0,0 +1,213 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+func TestPipelineExactlyOnce(t *testing.T) {
+	tests := []struct {
+		name      string
+		consumers int
+		numKeys   int64
+		keyTTL    time.Duration
+	}{
+		{name: "single consumer", consumers: 1, numKeys: 100, keyTTL: 100 * time.Millisecond},
+		{name: "fan-out", consumers: 4, numKeys: 500, keyTTL: 100 * time.Millisecond},
+		{name: "burst", consumers: 6, numKeys: 1000, keyTTL: 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEnv(t)
+			rec := newRecorder()
+			e.startConsumers(t, tt.consumers, rec, nil)
+
+			redisClient := e.redisClient(t)
+			ctx := context.Background()
+			// Run IDs end up in handler patterns, so they must not contain "/"
+			runID := fmt.Sprintf("it-%d", time.Now().UnixNano())
+			if err := redisClient.InitRunLedger(ctx, runID, tt.numKeys); err != nil {
+				t.Fatalf("failed to init run ledger: %v", err)
+			}
+
+			gen := pipeline.NewGenerator(redisClient)
+			generated, err := gen.Run(ctx, pipeline.GeneratorConfig{
+				RunID:   runID,
+				NumKeys: tt.numKeys,
+				KeyTTL:  tt.keyTTL,
+			})
+			if err != nil {
+				t.Fatalf("failed to generate keys: %v", err)
+			}
+			if generated != tt.numKeys {
+				t.Fatalf("generated %d keys, want %d", generated, tt.numKeys)
+			}
+
+			if !rec.waitFor(int(tt.numKeys), 30*time.Second) {
+				t.Fatalf("consumed %d distinct keys, want %d", rec.distinct(), tt.numKeys)
+			}
+			// Allow late duplicates to surface before asserting
+			time.Sleep(500 * time.Millisecond)
+
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			for i := int64(0); i < tt.numKeys; i++ {
+				key := redis.RunKey(runID, i)
+				if n := rec.keys[key]; n != 1 {
+					t.Errorf("key %s consumed %d times, want exactly once", key, n)
+				}
+			}
+			if len(rec.keys) != int(tt.numKeys) {
+				t.Errorf("consumed %d distinct keys, want %d", len(rec.keys), tt.numKeys)
+			}
+
+			gotGenerated, gotConsumed, err := redisClient.GetMetrics(ctx, runID)
+			if err != nil {
+				t.Fatalf("failed to get metrics: %v", err)
+			}
+			if gotGenerated != tt.numKeys || gotConsumed != tt.numKeys {
+				t.Errorf("metrics generated=%d consumed=%d, want %d/%d", gotGenerated, gotConsumed, tt.numKeys, tt.numKeys)
+			}
+			verification, err := redisClient.VerifyRun(ctx, runID)
+			if err != nil {
+				t.Fatalf("failed to verify run: %v", err)
+			}
+			if !verification.OK {
+				t.Errorf("ledger verification failed: missing=%v duplicates=%v", verification.Missing, verification.Duplicates)
+			}
+			t.Logf("distribution across consumers: %v", rec.consumers)
+		})
+	}
+}
+
+func TestDedupKeysAreIgnored(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	e.startConsumers(t, 2, rec, nil)
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+
+	// A dedup key expiring on its own must never be published as an event
+	if _, err := redisClient.CreateDedupKey(ctx, "gen-key:orphan", 50*time.Millisecond); err != nil {
+		t.Fatalf("failed to create dedup key: %v", err)
+	}
+	time.Sleep(time.Second)
+
+	if n := rec.distinct(); n != 0 {
+		t.Errorf("consumed %d keys from dedup expirations, want 0", n)
+	}
+}
+
+func TestConcurrentRunsAreIsolated(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	e.startConsumers(t, 3, rec, nil)
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+	numKeys := map[string]int64{
+		fmt.Sprintf("it-a-%d", time.Now().UnixNano()): 200,
+		fmt.Sprintf("it-b-%d", time.Now().UnixNano()): 300,
+	}
+
+	gen := pipeline.NewGenerator(redisClient)
+	var wg sync.WaitGroup
+	for runID, n := range numKeys {
+		if err := redisClient.InitRunLedger(ctx, runID, n); err != nil {
+			t.Fatalf("failed to init run ledger: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := gen.Run(ctx, pipeline.GeneratorConfig{RunID: runID, NumKeys: n, KeyTTL: 100 * time.Millisecond}); err != nil {
+				t.Errorf("failed to generate keys for run %s: %v", runID, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !rec.waitFor(500, 30*time.Second) {
+		t.Fatalf("consumed %d distinct keys, want 500", rec.distinct())
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	for runID, n := range numKeys {
+		generated, consumed, err := redisClient.GetMetrics(ctx, runID)
+		if err != nil {
+			t.Fatalf("failed to get metrics: %v", err)
+		}
+		if generated != n || consumed != n {
+			t.Errorf("run %s metrics generated=%d consumed=%d, want %d/%d", runID, generated, consumed, n, n)
+		}
+		verification, err := redisClient.VerifyRun(ctx, runID)
+		if err != nil {
+			t.Fatalf("failed to verify run %s: %v", runID, err)
+		}
+		if !verification.OK {
+			t.Errorf("run %s verification failed: missing=%v duplicates=%v", runID, verification.Missing, verification.Duplicates)
+		}
+	}
+}
+
+func TestDuplicateInjection(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	e.startConsumers(t, 3, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.DedupTTL = time.Second
+		return opts
+	})
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+	runID := fmt.Sprintf("it-dup-%d", time.Now().UnixNano())
+	const numKeys = 200
+	if err := redisClient.InitRunLedger(ctx, runID, numKeys); err != nil {
+		t.Fatalf("failed to init run ledger: %v", err)
+	}
+
+	gen := pipeline.NewGenerator(redisClient)
+	if _, err := gen.Run(ctx, pipeline.GeneratorConfig{
+		RunID:   runID,
+		NumKeys: numKeys,
+		KeyTTL:  100 * time.Millisecond,
+		Duplicates: &pipeline.DuplicateConfig{
+			Probability: 0.5,
+			MinDelay:    100,
+			MaxDelay:    3000,
+			Window:      1000,
+			Margin:      300,
+			Seed:        1,
+		},
+	}); err != nil {
+		t.Fatalf("failed to generate keys: %v", err)
+	}
+	// The last duplicates expire up to half the maximum gap after generation returns
+	time.Sleep(3 * time.Second)
+
+	verification, err := redisClient.VerifyRun(ctx, runID)
+	if err != nil {
+		t.Fatalf("failed to verify run: %v", err)
+	}
+	injection := verification.Injection
+	if injection == nil || injection.Within == 0 || injection.Outside == 0 {
+		t.Fatalf("injection report %+v, want duplicates on both sides of the window", injection)
+	}
+	if !verification.OK {
+		t.Errorf("verification failed: missing=%v duplicates=%v unsuppressed=%v not_redelivered=%v",
+			verification.Missing, verification.Duplicates, injection.Unsuppressed, injection.NotRedelivered)
+	}
+	if injection.Suppressed != injection.Within || injection.Redelivered != injection.Outside {
+		t.Errorf("suppressed %d/%d within the window, redelivered %d/%d outside it",
+			injection.Suppressed, injection.Within, injection.Redelivered, injection.Outside)
+	}
+}
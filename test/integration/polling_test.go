@@ -0,0 +1,133 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/handler"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// Consumers polling the deadline index deliver each indexed key once, and a key claimed by a consumer
+// that never acks it is delivered after its lease ends
+func TestPollingSource(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	e.startConsumers(t, 3, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.Source = pipeline.NewPollingSource(opts.Redis, 20*time.Millisecond, 10, time.Second)
+		return opts
+	})
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+	runID := fmt.Sprintf("polling-%d", time.Now().UnixNano())
+	const numKeys = 100
+	gen := pipeline.NewGenerator(redisClient)
+	if _, err := gen.Run(ctx, pipeline.GeneratorConfig{RunID: runID, NumKeys: numKeys, KeyTTL: 100 * time.Millisecond, Index: true}); err != nil {
+		t.Fatalf("failed to generate keys: %v", err)
+	}
+	if !rec.waitFor(numKeys, 10*time.Second) {
+		t.Fatalf("consumed %d of %d keys", rec.distinct(), numKeys)
+	}
+
+	// A consumer that dies after claiming leaves its keys leased
+	abandoned := fmt.Sprintf("abandoned-%d", time.Now().UnixNano())
+	if err := redisClient.RegisterDeadline(ctx, abandoned, time.Now()); err != nil {
+		t.Fatalf("failed to register %s: %v", abandoned, err)
+	}
+	const lease = 500 * time.Millisecond
+	claimed, err := redisClient.ClaimDeadlines(ctx, 10, lease)
+	if err != nil {
+		t.Fatalf("failed to claim due keys: %v", err)
+	}
+	claimedAt := time.Now()
+	if len(claimed) != 1 || claimed[0] != abandoned {
+		t.Fatalf("claimed %v, want only %s", claimed, abandoned)
+	}
+	if rec.waitFor(numKeys+1, lease/2) {
+		t.Fatalf("%s was delivered while leased", abandoned)
+	}
+	if !rec.waitFor(numKeys+1, 5*time.Second) {
+		t.Fatalf("%s was not delivered after its lease ended", abandoned)
+	}
+	if since := time.Since(claimedAt); since < lease {
+		t.Errorf("%s was delivered %v after it was claimed, before its %v lease ended", abandoned, since, lease)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for seq := int64(0); seq < numKeys; seq++ {
+		if n := rec.keys[redis.RunKey(runID, seq)]; n != 1 {
+			t.Errorf("key %s delivered %d times, want 1", redis.RunKey(runID, seq), n)
+		}
+	}
+	if n := rec.keys[abandoned]; n != 1 {
+		t.Errorf("%s delivered %d times, want 1", abandoned, n)
+	}
+}
+
+// Scheduled jobs are registered in the deadline index, so polling consumers fire them with their
+// payload at their latest time, and never fire a cancelled one
+func TestPollingSourceJobs(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	var mu sync.Mutex
+	payloads := make(map[string]string)
+	e.startConsumers(t, 2, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.Source = pipeline.NewPollingSource(opts.Redis, 20*time.Millisecond, 10, time.Second)
+		opts.Handlers.Register(redis.JobPrefix+"*", "payloads", handler.HandlerFunc(func(ctx context.Context, evt *handler.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			payloads[evt.Fields[redis.JobID]] = evt.Value
+			return nil
+		}))
+		return opts
+	})
+
+	scheduler := redis.NewScheduler(e.redisClient(t))
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+	fired, cancelled, moved := fmt.Sprintf("fired-%d", suffix), fmt.Sprintf("cancelled-%d", suffix), fmt.Sprintf("moved-%d", suffix)
+	start := time.Now()
+	for _, id := range []string{fired, cancelled, moved} {
+		if err := scheduler.Schedule(ctx, id, "payload of "+id, start.Add(300*time.Millisecond)); err != nil {
+			t.Fatalf("failed to schedule %s: %v", id, err)
+		}
+	}
+	if ok, err := scheduler.Cancel(ctx, cancelled); err != nil || !ok {
+		t.Fatalf("failed to cancel %s: %v", cancelled, err)
+	}
+	if err := scheduler.Reschedule(ctx, moved, start.Add(time.Second)); err != nil {
+		t.Fatalf("failed to reschedule %s: %v", moved, err)
+	}
+
+	if !rec.waitFor(1, 5*time.Second) {
+		t.Fatalf("job %s was not delivered", fired)
+	}
+	if since := time.Since(start); since < 300*time.Millisecond {
+		t.Errorf("a job was delivered %v after scheduling, before it was due", since)
+	}
+	if rec.waitFor(2, time.Until(start.Add(900*time.Millisecond))) {
+		t.Errorf("job %s fired at its original time", moved)
+	}
+	if !rec.waitFor(2, 5*time.Second) {
+		t.Fatalf("job %s did not fire at its new time", moved)
+	}
+	if rec.waitFor(3, 200*time.Millisecond) {
+		t.Errorf("cancelled job %s fired", cancelled)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range []string{fired, moved} {
+		if payloads[id] != "payload of "+id {
+			t.Errorf("job %s delivered %q, want its payload", id, payloads[id])
+		}
+	}
+}
@@ -0,0 +1,130 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/handler"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// Scheduled jobs fire once with their payload, cancelled jobs never fire, rescheduled jobs fire at
+// their new time and a fired job's ID can be scheduled again within the dedup window. Payloads are
+// delivered without CaptureValues.
+func TestScheduler(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	config := pipeline.TenantConfig{Tenants: []pipeline.TenantSpec{
+		{Name: "jobs", Pattern: redis.JobPrefix + "*", DedupTTL: "1m"},
+	}}
+	tenants, err := config.Build()
+	if err != nil {
+		t.Fatalf("failed to build tenants: %v", err)
+	}
+	var mu sync.Mutex
+	payloads := make(map[string]string)
+	e.startConsumers(t, 2, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.Tenants = tenants
+		opts.Handlers.Register(redis.JobPrefix+"*", "payloads", handler.HandlerFunc(func(ctx context.Context, evt *handler.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			payloads[evt.Fields[redis.JobID]] = evt.Value
+			return nil
+		}))
+		return opts
+	})
+
+	scheduler := redis.NewScheduler(e.redisClient(t))
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+	fired, cancelled, moved := fmt.Sprintf("fired-%d", suffix), fmt.Sprintf("cancelled-%d", suffix), fmt.Sprintf("moved-%d", suffix)
+	start := time.Now()
+	for _, id := range []string{fired, cancelled, moved} {
+		if err := scheduler.Schedule(ctx, id, "payload of "+id, start.Add(500*time.Millisecond)); err != nil {
+			t.Fatalf("failed to schedule %s: %v", id, err)
+		}
+	}
+	if err := scheduler.Schedule(ctx, fired, "again", start.Add(time.Second)); err != redis.ErrJobExists {
+		t.Errorf("scheduling an existing job returned %v, want ErrJobExists", err)
+	}
+	if ok, err := scheduler.Cancel(ctx, cancelled); err != nil || !ok {
+		t.Fatalf("failed to cancel %s: %v", cancelled, err)
+	}
+	if err := scheduler.Reschedule(ctx, moved, start.Add(1500*time.Millisecond)); err != nil {
+		t.Fatalf("failed to reschedule %s: %v", moved, err)
+	}
+
+	jobs, err := scheduler.List(ctx, start, time.Time{}, 0)
+	if err != nil {
+		t.Fatalf("failed to list jobs: %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != fired || jobs[1].ID != moved {
+		t.Fatalf("listed %+v, want %s then %s", jobs, fired, moved)
+	}
+
+	delivered := func(id string) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		payload, ok := payloads[id]
+		return payload, ok
+	}
+	time.Sleep(time.Until(start.Add(time.Second)))
+	if payload, ok := delivered(fired); payload != "payload of "+fired {
+		t.Errorf("job %s delivered %q (delivered %v), want its payload", fired, payload, ok)
+	}
+	if _, ok := delivered(moved); ok {
+		t.Errorf("job %s fired at its original time", moved)
+	}
+	if err := scheduler.Schedule(ctx, fired, "second payload", start.Add(1500*time.Millisecond)); err != nil {
+		t.Fatalf("failed to schedule %s again: %v", fired, err)
+	}
+
+	time.Sleep(time.Until(start.Add(2500 * time.Millisecond)))
+	if _, ok := delivered(moved); !ok {
+		t.Errorf("job %s did not fire at its new time", moved)
+	}
+	if _, ok := delivered(cancelled); ok {
+		t.Errorf("cancelled job %s fired", cancelled)
+	}
+	if payload, _ := delivered(fired); payload != "second payload" {
+		t.Errorf("job %s scheduled again delivered %q, want its new payload", fired, payload)
+	}
+
+	// Listing leaves fired jobs in the index, and the next change to a job prunes them
+	if jobs, err := scheduler.List(ctx, start, time.Time{}, 0); err != nil || len(jobs) != 0 {
+		t.Errorf("listed %+v (%v) after every job fired, want none", jobs, err)
+	}
+	if _, err := e.redis.ZScore(redis.JobIndex, fired); err != nil {
+		t.Errorf("listing removed fired job %s from the index: %v", fired, err)
+	}
+	if ok, err := scheduler.Cancel(ctx, cancelled); err != nil || ok {
+		t.Errorf("cancelling %s again returned %v, %v, want false", cancelled, ok, err)
+	}
+	if _, err := e.redis.ZScore(redis.JobIndex, fired); err != nil {
+		t.Errorf("fired job %s was pruned while its shadow may still be read: %v", fired, err)
+	}
+	// Once their shadows are gone, fired jobs are pruned from both indexes
+	e.redis.SetTime(time.Now().Add(time.Hour))
+	if _, err := scheduler.Cancel(ctx, cancelled); err != nil {
+		t.Errorf("failed to cancel %s: %v", cancelled, err)
+	}
+	if members, _ := e.redis.ZMembers(redis.JobIndex); len(members) != 0 {
+		t.Errorf("job index holds %v, want fired jobs pruned", members)
+	}
+	if members, _ := e.redis.ZMembers(redis.DeadlineIndex); len(members) != 0 {
+		t.Errorf("deadline index holds %v, want fired jobs pruned", members)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for id, want := range map[string]int{fired: 2, moved: 1} {
+		if n := rec.keys[redis.JobPrefix+id]; n != want {
+			t.Errorf("job %s delivered %d times, want %d", id, n, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// A throttled key that keeps expiring is delivered at most limit times per interval, and a debounced
+// key once after it settles
+func TestShapingPolicies(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	suffix := time.Now().UnixNano()
+	throttleRun, debounceRun := fmt.Sprintf("throttle-%d", suffix), fmt.Sprintf("debounce-%d", suffix)
+
+	config := pipeline.ShapingConfig{Policies: []pipeline.PolicySpec{
+		{Pattern: redis.KeyPrefix + "throttle-*", Type: pipeline.PolicyThrottle, Limit: 2, Interval: "1s"},
+		{Pattern: redis.KeyPrefix + "debounce-*", Type: pipeline.PolicyDebounce, Quiet: "500ms", MaxWait: "10s"},
+	}}
+	policies, err := config.Build()
+	if err != nil {
+		t.Fatalf("failed to build policies: %v", err)
+	}
+	e.startConsumers(t, 2, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.Policies = policies
+		return opts
+	})
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+	flap := func(runID string, d time.Duration) {
+		for start := time.Now(); time.Since(start) < d; time.Sleep(200 * time.Millisecond) {
+			if err := redisClient.GenerateKey(ctx, runID, 1, 20*time.Millisecond); err != nil {
+				t.Errorf("failed to generate key: %v", err)
+				return
+			}
+		}
+	}
+	count := func(runID string) int {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return rec.keys[fmt.Sprintf("%s%s:1", redis.KeyPrefix, runID)]
+	}
+
+	// Ten expirations in two seconds, of which the sliding window admits at most two per second
+	flap(throttleRun, 2*time.Second)
+	time.Sleep(500 * time.Millisecond)
+	if n := count(throttleRun); n < 2 || n > 4 {
+		t.Errorf("throttled key delivered %d times, want 2 to 4", n)
+	}
+
+	flap(debounceRun, time.Second)
+	if n := count(debounceRun); n != 0 {
+		t.Errorf("debounced key delivered %d times while still expiring", n)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := count(debounceRun); n != 1 {
+		t.Errorf("debounced key delivered %d times after settling, want 1", n)
+	}
+
+	usage, err := redisClient.ListTenants(ctx)
+	if err != nil {
+		t.Fatalf("failed to list tenants: %v", err)
+	}
+	for _, u := range usage {
+		if u.Name == pipeline.DefaultTenant && u.Usage[redis.TenantShaped] == 0 {
+			t.Errorf("default tenant usage = %v, want shaped expirations", u.Usage)
+		}
+	}
+}
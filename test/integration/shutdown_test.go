@@ -0,0 +1,70 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// blockingDeduplicator holds every claim until release is closed
+type blockingDeduplicator struct {
+	claimed chan string
+	release chan struct{}
+}
+
+func (d *blockingDeduplicator) CreateDedupKey(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	d.claimed <- key
+	<-d.release
+	return false, nil
+}
+
+// A consumer whose in-flight expiration never finishes gives up at Shutdown's deadline, and Run
+// returns rather than blocking the process forever
+func TestShutdownDeadline(t *testing.T) {
+	e := newEnv(t)
+	dedup := &blockingDeduplicator{claimed: make(chan string, 1), release: make(chan struct{})}
+	defer close(dedup.release)
+	consumers := e.startConsumers(t, 1, newRecorder(), func(opts pipeline.Options) pipeline.Options {
+		opts.Deduplicator = dedup
+		return opts
+	})
+
+	runID := fmt.Sprintf("shutdown-%d", time.Now().UnixNano())
+	if err := e.redisClient(t).GenerateKey(context.Background(), runID, 0, 50*time.Millisecond); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	select {
+	case key := <-dedup.claimed:
+		if key != redis.RunKey(runID, 0) {
+			t.Fatalf("claimed %s, want %s", key, redis.RunKey(runID, 0))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the key was never claimed")
+	}
+
+	const deadline = 300 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	start := time.Now()
+	if err := consumers[0].pipeline.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if took := time.Since(start); took < deadline || took > deadline+time.Second {
+		t.Errorf("Shutdown returned after %v, want its %v deadline", took, deadline)
+	}
+	select {
+	case err := <-consumers[0].done:
+		if !errors.Is(err, pipeline.ErrShutdownTimeout) {
+			t.Errorf("Run returned %v, want %v", err, pipeline.ErrShutdownTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run kept waiting for in-flight work after Shutdown gave up")
+	}
+}
@@ -0,0 +1,91 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/pipeline"
+	"github.com/mxie/load-balanced-event-deduplication-pipeline/pkg/redis"
+)
+
+// A rate-limited tenant with a storm of expirations must not delay another tenant's keys
+func TestTenantIsolation(t *testing.T) {
+	e := newEnv(t)
+	rec := newRecorder()
+	config := pipeline.TenantConfig{Tenants: []pipeline.TenantSpec{
+		{Name: "noisy", Pattern: "gen-key:noisy-*", RateLimit: 20, ConcurrencyShare: 0.1},
+		{Name: "quiet", Pattern: "gen-key:quiet-*", DedupTTL: "10s"},
+	}}
+	tenants, err := config.Build()
+	if err != nil {
+		t.Fatalf("failed to build tenants: %v", err)
+	}
+	e.startConsumers(t, 2, rec, func(opts pipeline.Options) pipeline.Options {
+		opts.Tenants = tenants
+		return opts
+	})
+
+	redisClient := e.redisClient(t)
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+	noisyRun, quietRun := fmt.Sprintf("noisy-%d", suffix), fmt.Sprintf("quiet-%d", suffix)
+	const noisyKeys, quietKeys = 500, 50
+
+	gen := pipeline.NewGenerator(redisClient)
+	if _, err := gen.Run(ctx, pipeline.GeneratorConfig{RunID: noisyRun, NumKeys: noisyKeys, KeyTTL: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("failed to generate noisy keys: %v", err)
+	}
+	if _, err := gen.Run(ctx, pipeline.GeneratorConfig{RunID: quietRun, NumKeys: quietKeys, KeyTTL: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("failed to generate quiet keys: %v", err)
+	}
+
+	count := func(prefix string) int {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		n := 0
+		for key := range rec.keys {
+			if strings.HasPrefix(key, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count(redis.KeyPrefix+quietRun) < quietKeys && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := count(redis.KeyPrefix + quietRun); n != quietKeys {
+		t.Fatalf("quiet tenant consumed %d keys, want %d", n, quietKeys)
+	}
+	// At 20/s the noisy tenant is still far from done
+	if n := count(redis.KeyPrefix + noisyRun); n >= noisyKeys {
+		t.Errorf("noisy tenant consumed all %d keys despite its rate limit", n)
+	}
+
+	usage, err := redisClient.ListTenants(ctx)
+	if err != nil {
+		t.Fatalf("failed to list tenants: %v", err)
+	}
+	byName := make(map[string]redis.TenantUsage)
+	for _, u := range usage {
+		byName[u.Name] = u
+	}
+	quiet := byName["quiet"]
+	if quiet.Settings == nil || quiet.Settings.DedupTTLMs != 10000 {
+		t.Errorf("quiet tenant settings = %+v, want a 10s dedup TTL", quiet.Settings)
+	}
+	if quiet.Usage[redis.TenantPublished] != quietKeys || quiet.Usage[redis.TenantConsumed] != quietKeys {
+		t.Errorf("quiet tenant usage = %v, want %d published and consumed", quiet.Usage, quietKeys)
+	}
+	if byName["noisy"].Usage[redis.TenantThrottled] == 0 {
+		t.Errorf("noisy tenant usage = %v, want throttled expirations", byName["noisy"].Usage)
+	}
+	if _, ok := byName[pipeline.DefaultTenant]; !ok {
+		t.Errorf("default tenant was not registered")
+	}
+}
@@ -9,15 +9,67 @@ interface TestConfig {
 }
 
 interface TestStatus {
+    run_id: string;
     is_running: boolean;
     generated: number;
     consumed: number;
+    state: string;
+    outcome?: RunOutcome;
 }
 
+interface RunOutcome {
+    reason: string;
+    expected: number;
+    consumed: number;
+    lost: number;
+    duplicates: number;
+    ok: boolean;
+}
+
+const stateLabels: { [state: string]: string } = {
+    generating: 'Generating',
+    draining: 'Draining',
+    settled: 'Settled',
+    timed_out: 'Timed out',
+};
+
 interface TestMetrics {
     generated: number;
     consumed: number;
     consumers: { [key: string]: number };
+    stale_consumers?: string[];
+}
+
+interface StreamMetrics {
+    run_id: string;
+    generated: number;
+    consumed: number;
+    generated_delta: number;
+    consumed_delta: number;
+    consumers: { [key: string]: number };
+}
+
+interface ApiError {
+    code: string;
+    message: string;
+    details?: { field: string; message: string }[];
+}
+
+const API = '/api/v1';
+
+// errorMessage formats an API error object, including any invalid fields
+function errorMessage(error: unknown): string {
+    if (axios.isAxiosError(error) && error.response?.data?.code) {
+        const body = error.response.data as ApiError;
+        const fields = Array.isArray(body.details) ? body.details.map((d) => `${d.field} ${d.message}`) : [];
+        return fields.length ? `${body.message}: ${fields.join(', ')}` : body.message;
+    }
+    return String(error);
+}
+
+interface ConsumerEvent {
+    consumer_id: string;
+    event: 'join' | 'leave';
 }
 
 export default function App() {
@@ -28,8 +80,16 @@ export default function App() {
         dedup_window: 3000,
     });
 
+    // Last API error from starting or stopping a run
+    const [apiError, setApiError] = useState<string>('');
+
+    // Run started from this browser; empty follows the most recent run
+    const [runId, setRunId] = useState<string>('');
+
     const [status, setStatus] = useState<TestStatus>({
+        run_id: '',
         is_running: false,
+        state: '',
         generated: 0,
         consumed: 0,
     });
@@ -40,45 +100,74 @@ export default function App() {
         consumers: {},
     });
 
+    // API token for generators with authentication enabled, kept across reloads
+    const [token, setToken] = useState<string>(() => localStorage.getItem('apiToken') ?? '');
+
     useEffect(() => {
-        const interval = setInterval(() => {
-            fetchStatus();
-            fetchMetrics();
-        }, 1000);
-        return () => clearInterval(interval);
-    }, []);
-
-    const fetchStatus = async () => {
-        try {
-            const response = await axios.get<TestStatus>('/api/status');
-            setStatus(response.data);
-        } catch (error) {
-            console.error('Failed to fetch status:', error);
+        localStorage.setItem('apiToken', token);
+        if (token) {
+            axios.defaults.headers.common['Authorization'] = `Bearer ${token}`;
+        } else {
+            delete axios.defaults.headers.common['Authorization'];
         }
-    };
+    }, [token]);
 
-    const fetchMetrics = async () => {
-        try {
-            const response = await axios.get<TestMetrics>('/api/metrics');
-            setMetrics(response.data);
-        } catch (error) {
-            console.error('Failed to fetch metrics:', error);
-        }
-    };
+    // Consumers without a recent heartbeat are greyed out until they report in again
+    const [stale, setStale] = useState<{ [id: string]: boolean }>({});
+
+    // The server pushes a snapshot on connect and then only what changed
+    useEffect(() => {
+        // EventSource cannot set headers, so the token goes in the query string
+        const params = new URLSearchParams();
+        if (runId) params.set('run_id', runId);
+        if (token) params.set('access_token', token);
+        const query = params.toString();
+        const source = new EventSource(`${API}/stream` + (query ? `?${query}` : ''));
+
+        source.addEventListener('snapshot', (e) => {
+            const snapshot = JSON.parse((e as MessageEvent).data) as { status: TestStatus; metrics: TestMetrics };
+            setStatus(snapshot.status);
+            setMetrics({ ...snapshot.metrics, consumers: snapshot.metrics.consumers ?? {} });
+            setStale(Object.fromEntries((snapshot.metrics.stale_consumers ?? []).map((id) => [id, true])));
+        });
+        source.addEventListener('state', (e) => {
+            setStatus(JSON.parse((e as MessageEvent).data) as TestStatus);
+        });
+        source.addEventListener('metrics', (e) => {
+            const delta = JSON.parse((e as MessageEvent).data) as StreamMetrics;
+            setStatus((prev) => ({ ...prev, generated: delta.generated, consumed: delta.consumed }));
+            setMetrics((prev) => ({
+                generated: delta.generated,
+                consumed: delta.consumed,
+                consumers: { ...prev.consumers, ...delta.consumers },
+            }));
+        });
+        source.addEventListener('consumer', (e) => {
+            const event = JSON.parse((e as MessageEvent).data) as ConsumerEvent;
+            setStale((prev) => ({ ...prev, [event.consumer_id]: event.event === 'leave' }));
+        });
+        source.onerror = (error) => console.error('Stream error:', error);
+
+        return () => source.close();
+    }, [runId, token]);
 
     const startTest = async () => {
         try {
-            await axios.post('/api/start', config);
+            const response = await axios.post<{ run_id: string }>(`${API}/start`, config);
+            setRunId(response.data.run_id);
+            setApiError('');
         } catch (error) {
             console.error('Failed to start test:', error);
+            setApiError(errorMessage(error));
         }
     };
 
     const stopTest = async () => {
         try {
-            await axios.post('/api/stop');
+            await axios.post(`${API}/stop`, { run_id: runId || status.run_id });
         } catch (error) {
             console.error('Failed to stop test:', error);
+            setApiError(errorMessage(error));
         }
     };
 
@@ -144,13 +233,31 @@ export default function App() {
                                     className="w-full px-3 py-2 border rounded"
                                 />
                             </div>
+                            <div>
+                                <label className="block text-gray-700 mb-1">API Token (if required):</label>
+                                <input
+                                    type="password"
+                                    value={token}
+                                    onChange={(e) => setToken(e.target.value)}
+                                    className="w-full px-3 py-2 border rounded"
+                                />
+                            </div>
                         </div>
                     </div>
 
                     <div className="bg-white rounded-lg shadow p-4">
                         <h2 className="text-xl font-semibold mb-2">Status</h2>
                         <div className="space-y-2">
-                            <p className="text-gray-700">Status: <span className="font-semibold">{status.is_running ? 'Running' : 'Stopped'}</span></p>
+                            <p className="text-gray-700">Status: <span className="font-semibold">{stateLabels[status.state] ?? 'Idle'}</span></p>
+                            {status.outcome && (
+                                <p className="text-gray-700">
+                                    Outcome: <span className={`font-semibold ${status.outcome.ok ? 'text-green-600' : 'text-red-600'}`}>
+                                        {status.outcome.ok ? 'Pass' : 'Fail'}
+                                    </span>{' '}
+                                    ({status.outcome.consumed}/{status.outcome.expected} consumed, {status.outcome.lost} lost, {status.outcome.duplicates} duplicates; {status.outcome.reason.replace('_', ' ')})
+                                </p>
+                            )}
+                            <p className="text-gray-700">Run: <span className="font-mono">{status.run_id || '-'}</span></p>
                             <p className="text-gray-700">Generated Keys: <span className="font-semibold">{status.generated}</span></p>
                             <p className="text-gray-700">Consumed Keys: <span className="font-semibold">{status.consumed}</span></p>
                             <div className="mt-4">
@@ -160,6 +267,7 @@ export default function App() {
                                 >
                                     {status.is_running ? 'Stop Test' : 'Start Test'}
                                 </button>
+                                {apiError && <p className="text-red-600 text-sm mt-2">{apiError}</p>}
                             </div>
                         </div>
                     </div>
@@ -177,8 +285,8 @@ export default function App() {
                             </thead>
                             <tbody>
                                 {Object.entries(metrics.consumers).map(([id, count]) => (
-                                    <tr key={id} className="border-t">
-                                        <td className="px-4 py-2">{id}</td>
+                                    <tr key={id} className={`border-t ${stale[id] ? 'text-gray-400' : ''}`}>
+                                        <td className="px-4 py-2">{id}{stale[id] && ' (stale)'}</td>
                                         <td className="px-4 py-2">{count}</td>
                                     </tr>
                                 ))}